@@ -1,6 +1,8 @@
 package assemblers
 
 import (
+	"io"
+
 	"github.com/mylux/bsistent/interfaces"
 	"github.com/mylux/bsistent/persistence"
 )
@@ -8,3 +10,19 @@ import (
 func NewPersistence[T any](config *interfaces.PersistenceConfig[T]) interfaces.Persistence[T] {
 	return persistence.New[T](config)
 }
+
+func OpenPersistence[T any](config *interfaces.PersistenceConfig[T]) (interfaces.Persistence[T], error) {
+	return persistence.Open[T](config)
+}
+
+func RestorePersistence(r io.Reader, path string) error {
+	return persistence.Restore(r, path)
+}
+
+func OpenSharedFile(path string, readOnly bool, cacheSize uint32) (interfaces.SharedFile, error) {
+	f, err := persistence.OpenShared(path, readOnly, cacheSize)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
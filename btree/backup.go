@@ -0,0 +1,81 @@
+package btree
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mylux/bsistent/assemblers"
+	"github.com/mylux/bsistent/utils"
+)
+
+type BackupOptions struct {
+	// Compact writes the items into new pages, leaving out the unused ones
+	Compact bool
+}
+
+// Backup writes a consistent copy of the data file to w. A copy-on-write btree is copied
+// from a snapshot, so it can be changed while the backup is written
+func (b *Btree[DataType]) Backup(w io.Writer, options ...BackupOptions) error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	// the pages of a tree in a database are mixed with the ones of other trees
+	if utils.Coalesce(options, BackupOptions{}).Compact || b.config.db != nil {
+		return b.backupCompacted(w)
+	}
+	if b.copyOnWrite {
+		snapshot, err := b.Snapshot()
+		if err != nil {
+			return err
+		}
+		defer snapshot.Close()
+		return snapshot.persistence.Backup(w)
+	}
+	return b.persistence.Backup(w)
+}
+
+// BackupTo writes a consistent copy of the data file to the given path, ready to be opened
+func (b *Btree[DataType]) BackupTo(path string, options ...BackupOptions) error {
+	if samePath(path, b.storagePath) {
+		return fmt.Errorf("cannot back %s up into itself", path)
+	}
+	r, w := io.Pipe()
+	go func() { w.CloseWithError(b.Backup(w, options...)) }()
+	err := Restore(r, path)
+	r.CloseWithError(err)
+	return err
+}
+
+// Restore recreates the data file at the given path from a backup written by Backup. The
+// backup is validated before the file is replaced, and the file must not be open.
+// The secondary indexes of the file are removed, to be rebuilt when it is opened
+func Restore(r io.Reader, path string) error {
+	if err := assemblers.RestorePersistence(r, path); err != nil {
+		return err
+	}
+	return removeIndexes(path)
+}
+
+func (b *Btree[DataType]) backupCompacted(w io.Writer) error {
+	temp, err := os.CreateTemp(filepath.Dir(b.storagePath), ".bsistent-backup-*")
+	if err != nil {
+		return err
+	}
+	temp.Close()
+	defer os.Remove(temp.Name())
+	defer removeIndexes(temp.Name())
+	compacted, err := b.CompactTo(temp.Name())
+	if err != nil {
+		return err
+	}
+	defer compacted.Close()
+	return compacted.persistence.Backup(w)
+}
+
+func samePath(p1 string, p2 string) bool {
+	a1, err1 := filepath.Abs(p1)
+	a2, err2 := filepath.Abs(p2)
+	return err1 == nil && err2 == nil && a1 == a2
+}
@@ -0,0 +1,124 @@
+package btree
+
+import (
+	"slices"
+
+	"github.com/mylux/bsistent/constants"
+	"github.com/mylux/bsistent/interfaces"
+	"github.com/mylux/bsistent/utils"
+)
+
+func (b *Btree[DataType]) isBPlus() bool {
+	return b.layout == BPlus
+}
+
+func (b *Btree[DataType]) fixLeaf(leaf interfaces.Page[DataType]) error {
+	parent := leaf.Parent()
+	children := b.LoadPageChildren(parent)
+	slot := children.LookUp(leaf)
+	left, right := children.Nth(slot-1), children.Nth(slot+1)
+	switch {
+	case left != nil && b.PageCanGiveItem(left):
+		b.count(constants.MetricRotations)
+		b.pageGiveItems(left, leaf, left.Size()-1)
+		b.replaceSeparator(parent, slot-1, leaf.Items().First())
+	case right != nil && b.PageCanGiveItem(right):
+		b.count(constants.MetricRotations)
+		b.pageGiveItems(right, leaf, 0)
+		b.replaceSeparator(parent, slot, right.Items().First())
+	case left != nil:
+		return b.mergeLeaves(parent, slot-1, left, leaf)
+	case right != nil:
+		return b.mergeLeaves(parent, slot, leaf, right)
+	}
+	return nil
+}
+
+func (b *Btree[DataType]) linkLeaves(left interfaces.Page[DataType], right interfaces.Page[DataType]) {
+	right.Prev(left.Offset())
+	right.Next(left.Next())
+	if next := left.Next(); next > 0 {
+		nextPage := b.neighbourLeaf(next)
+		nextPage.Prev(right.Offset())
+		b.taintPages(nextPage)
+	}
+	left.Next(right.Offset())
+	b.taintPages(left, right)
+}
+
+func (b *Btree[DataType]) mergeLeaves(parent interfaces.Page[DataType], separatorIndex int, left interfaces.Page[DataType], right interfaces.Page[DataType]) error {
+	b.count(constants.MetricMerges)
+	b.pageGiveItems(right, left, make([]int, right.Size())...)
+	b.unlinkLeaf(left, right)
+	parent.RemoveChild(right)
+	b.pageDeleteItem(parent, separatorIndex)
+	b.taintPages(left, right, parent)
+	if parent.Same(b.Root()) && parent.IsEmpty() {
+		b.shrink(left)
+		return nil
+	}
+	if b.PageNeedsAdjustment(parent) {
+		return b.fixPage(parent)
+	}
+	return nil
+}
+
+// neighbourLeaf loads a leaf reached through the chain, taking the copy changed in memory over
+// the stored one. Its parent is not known that way, and the one a cached copy remembers may be
+// gone, so it is cleared to keep the counts from being refreshed through it
+func (b *Btree[DataType]) neighbourLeaf(offset int64) interfaces.Page[DataType] {
+	if p, changed := b.changed[offset]; changed {
+		return p
+	}
+	p := b.load(offset)
+	p.ResetParent()
+	return p
+}
+
+func (b *Btree[DataType]) removeFromLeaf(index int, leaf interfaces.Page[DataType]) error {
+	if result := b.pageDeleteItem(leaf, index); result == nil {
+		return nil
+	}
+	if b.PageNeedsAdjustment(leaf) {
+		return b.fixLeaf(leaf)
+	}
+	return nil
+}
+
+func (b *Btree[DataType]) replaceSeparator(parent interfaces.Page[DataType], index int, firstItem interfaces.Item[DataType]) {
+	b.pageDeleteItem(parent, index)
+	b.addItemToPage(parent, b.separatorFor(firstItem))
+}
+
+func (b *Btree[DataType]) separatorFor(it interfaces.Item[DataType]) interfaces.Item[DataType] {
+	if b.config.compare != nil {
+		// a comparator may look at any field, so the separators keep them all
+		return b.newItem(it.Content())
+	}
+	return b.newItem(utils.KeepTaggedFields(it.Content(), constants.BsistentFlags.Tag, constants.BsistentFlags.Key))
+}
+
+// unlinkLeaf takes the right leaf out of the chain, linking the left one to the leaf after it
+func (b *Btree[DataType]) unlinkLeaf(left interfaces.Page[DataType], right interfaces.Page[DataType]) {
+	left.Next(right.Next())
+	if next := right.Next(); next > 0 {
+		nextPage := b.neighbourLeaf(next)
+		nextPage.Prev(left.Offset())
+		b.taintPages(nextPage)
+	}
+	b.taintPages(left)
+}
+
+func (b *Btree[DataType]) splitLeaf(page interfaces.Page[DataType]) {
+	items := page.Items().ToSlice()
+	middle := len(items) / 2
+	ppg := page.Parent()
+	if ppg == nil {
+		ppg = b.newRoot(page)
+	}
+	newPageRight := b.newPage(ppg)
+	page.Items(slices.Clone(items[:middle])...)
+	newPageRight.Items(slices.Clone(items[middle:])...)
+	b.linkLeaves(page, newPageRight)
+	b.addItemToPage(ppg, b.separatorFor(newPageRight.Items().First()), newPageRight)
+}
@@ -1,10 +1,11 @@
 package btree
 
 import (
+	"context"
 	"fmt"
 	"math"
-	"reflect"
 	"slices"
+	"time"
 
 	"github.com/mylux/bsistent/constants"
 	"github.com/mylux/bsistent/interfaces"
@@ -23,46 +24,214 @@ type Btree[DataType any] struct {
 	rootChanged bool
 	minItems    int
 	minChildren int
+	layout      Layout
+	config      BTConfig[DataType]
+	closed      bool
+	readOnly    bool
+	durability  Durability
+	syncer      *periodicSync
+	copyOnWrite bool
+	counted     bool
+	changes     changeFeed[DataType]
+	indexes     []*index[DataType]
+	ttlField    int
+	observer    interfaces.Observer
+	// failed is the error that interrupted a change, leaving the pages in memory halfway changed
+	failed error
+}
+
+var ErrAlreadyOpen = constants.ErrAlreadyOpen
+var ErrClosed = constants.ErrClosed
+var ErrDuplicate = constants.ErrDuplicate
+var ErrEncryption = constants.ErrEncryption
+var ErrLayout = constants.ErrLayout
+var ErrLocked = constants.ErrLocked
+var ErrNotCounted = constants.ErrNotCounted
+var ErrNotFound = constants.ErrNotFound
+var ErrOrdering = constants.ErrOrdering
+var ErrReadOnly = constants.ErrReadOnly
+
+func Open[DataType any](path string, config ...*BTConfig[DataType]) (*Btree[DataType], error) {
+	c := *utils.Coalesce(config, Configuration[DataType]())
+	c.storagePath = path
+	return c.make(true)
+}
+
+func (b *Btree[DataType]) Add(value DataType) error {
+	return b.addValue(context.Background(), value)
+}
+
+func (b *Btree[DataType]) addValue(ctx context.Context, value DataType) (err error) {
+	defer b.recoverChange(&err)
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if b.readOnly {
+		return ErrReadOnly
+	}
+	if b.observer != nil {
+		defer b.observeSince(constants.MetricAdd, time.Now())
+	}
+	if item := b.newItem(value); !item.IsEmpty() {
+		var none DataType
+		if err := b.checkUnique(value); err != nil {
+			return err
+		}
+		if err := b.add(ctx, item); err != nil {
+			return err
+		}
+		change := b.logChange(Inserted, none, value)
+		b.persist()
+		if err := b.indexAdd(value); err != nil {
+			return err
+		}
+		b.publish(change)
+	}
+	return nil
 }
 
-func (b *Btree[DataType]) Add(value DataType) {
-	if item := item[DataType](b.itemSize).Load(value); !item.IsEmpty() {
-		leaf := b.findLeafFor(b.root, item)
-		b.addItemToPage(leaf, item)
-		b.size++
+func (b *Btree[DataType]) Close() error {
+	if b.closed {
+		return ErrClosed
+	}
+	// the changes of a tree that failed halfway are left out, so the data file keeps the last
+	// ones that were complete
+	if !b.readOnly && b.failed == nil {
 		b.persist()
 	}
+	b.stopPeriodicSync()
+	b.closed = true
+	if b.config.db != nil {
+		b.config.db.leave(b)
+	}
+	err := b.closeIndexes()
+	if b.changes.log != nil {
+		if logErr := b.changes.log.Close(); err == nil {
+			err = logErr
+		}
+	}
+	if closeErr := b.persistence.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
-func (b *Btree[DataType]) Delete(partialItem DataType) error {
-	if destPage, index := b.find(partialItem); destPage != nil {
-		err := b.removeFromPage(index, destPage)
+type CompactOptions struct {
+	// EncryptionKey encrypts the compacted tree with another key than the one of the tree,
+	// or encrypts it when the tree is not
+	EncryptionKey []byte
+}
+
+func (b *Btree[DataType]) CompactTo(path string, options ...CompactOptions) (*Btree[DataType], error) {
+	return b.compactTo(context.Background(), path, options...)
+}
+
+func (b *Btree[DataType]) compactTo(ctx context.Context, path string, options ...CompactOptions) (*Btree[DataType], error) {
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+	if path == b.storagePath {
+		return nil, fmt.Errorf("cannot compact %s into itself", path)
+	}
+	c := b.config
+	if key := utils.Coalesce(options, CompactOptions{}).EncryptionKey; key != nil {
+		c.key = key
+	}
+	c.storagePath = path
+	c.reset = true
+	c.readOnly = false
+	c.logChanges = false
+	c.db, c.name, c.header = nil, "", 0
+	compacted := c.Make()
+	values := make([]DataType, 0, b.Size())
+	it := b.IterateCtx(ctx)
+	for it.Next() {
+		values = append(values, it.Value())
+	}
+	err := it.Err()
+	if err == nil {
+		err = compacted.BulkLoadCtx(ctx, values...)
+	}
+	if err != nil {
+		compacted.Close()
+		return nil, err
+	}
+	return compacted, nil
+}
+
+func (b *Btree[DataType]) Delete(partialItem DataType) (err error) {
+	defer b.recoverChange(&err)
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if b.readOnly {
+		return ErrReadOnly
+	}
+	if b.observer != nil {
+		defer b.observeSince(constants.MetricDelete, time.Now())
+	}
+	destPage, index, err := b.find(context.Background(), partialItem)
+	if err != nil {
+		return err
+	}
+	if destPage != nil {
+		var none DataType
+		old := destPage.Item(index).Content()
+		err = b.removeFromPage(index, destPage)
 		if err != nil {
 			return err
 		}
 		b.size--
+		change := b.logChange(Deleted, old, none)
 		b.persist()
-		return nil
+		if err = b.indexRemove(old); err != nil {
+			return err
+		}
+		b.publish(change)
 	}
 	return nil
 }
 
+// Find panics when a page cannot be read, while FindCtx returns the error
 func (b *Btree[DataType]) Find(partialItem DataType) (bool, DataType) {
-	destPage, index := b.find(partialItem)
-	if destPage != nil {
-		return true, destPage.Item(index).Content()
+	found, value, _ := b.findValue(context.Background(), partialItem)
+	return found, value
+}
+
+func (b *Btree[DataType]) findValue(ctx context.Context, partialItem DataType) (bool, DataType, error) {
+	if b.observer != nil {
+		defer b.observeSince(constants.MetricFind, time.Now())
+	}
+	var zero DataType
+	if err := b.checkOpen(); err != nil {
+		return false, zero, err
 	}
-	return false, reflect.Zero(reflect.TypeFor[DataType]()).Interface().(DataType)
+	destPage, index, err := b.find(ctx, partialItem)
+	if err != nil {
+		return false, zero, err
+	}
+	if destPage != nil && !b.expired(destPage.Item(index).Content()) {
+		return true, destPage.Item(index).Content(), nil
+	}
+	return false, zero, nil
 }
 
 func (b *Btree[DataType]) IsEmpty() bool {
 	return b.root.Size() == 0
 }
 
+func (b *Btree[DataType]) Iterate() *Iterator[DataType] {
+	return iterator(context.Background(), b, nil)
+}
+
+func (b *Btree[DataType]) IterateFrom(partialItem DataType) *Iterator[DataType] {
+	return iterator(context.Background(), b, b.newItem(partialItem))
+}
+
 func (b *Btree[DataType]) LoadOffsets(offsets []int64) []interfaces.Page[DataType] {
 	c := make([]interfaces.Page[DataType], len(offsets))
 	for i, o := range offsets {
-		c[i] = b.persistence.Load(o)
+		c[i] = b.load(o)
 	}
 	return c
 }
@@ -90,10 +259,12 @@ func (b *Btree[DataType]) PageIsValid(page interfaces.Page[DataType]) bool {
 	return (pSize >= b.minItems || page.Same(root)) && (slices.Contains([]int{0, pSize + 1}, cSize))
 }
 
-func (b *Btree[DataType]) Save(value DataType) {
-	b.Add(value)
+func (b *Btree[DataType]) Save(value DataType) error {
+	return b.Add(value)
 }
 
+// Size returns the number of items in the tree, counting the expired ones until Sweep deletes
+// them
 func (b *Btree[DataType]) Size() int64 {
 	return b.size
 }
@@ -110,6 +281,55 @@ func (b *Btree[DataType]) String() string {
 	return b.genPagePrettyPrint(b.root, "")
 }
 
+// add inserts the item into its leaf. The context is only checked on the way down to the
+// leaf, so a change is never left halfway
+func (b *Btree[DataType]) add(ctx context.Context, item interfaces.Item[DataType]) error {
+	leaf, err := b.findLeafFor(ctx, b.root, item)
+	if err != nil {
+		return err
+	}
+	b.addItemToPage(leaf, item)
+	b.size++
+	return nil
+}
+
+// checkOpen fails the operations on a closed tree, whose data file cannot be read or written
+// anymore, and on a tree left halfway changed by a failure, which must be opened again
+func (b *Btree[DataType]) checkOpen() error {
+	if b.closed {
+		return ErrClosed
+	}
+	return b.failed
+}
+
+// recoverChange turns the error a change panics with, such as the one of a page that failed
+// authentication, into the error of the change. A change that had started leaves the pages
+// in memory halfway changed, so they are never saved and the tree fails from then on
+func (b *Btree[DataType]) recoverChange(err *error) {
+	if r := recover(); r != nil {
+		e, isError := r.(error)
+		if !isError {
+			panic(r)
+		}
+		*err = e
+		if len(b.changed) > 0 {
+			b.failed = e
+		}
+	}
+}
+
+// recoverError turns the error a lookup panics with, when a page cannot be read, into the
+// error of the lookup
+func recoverError(err *error) {
+	if r := recover(); r != nil {
+		e, isError := r.(error)
+		if !isError {
+			panic(r)
+		}
+		*err = e
+	}
+}
+
 func (b *Btree[DataType]) addChildToPage(page interfaces.Page[DataType], child interfaces.Page[DataType]) {
 	page.AddChild(child)
 	b.taintPages(page)
@@ -126,31 +346,72 @@ func (b *Btree[DataType]) addItemToPage(page interfaces.Page[DataType], item int
 	b.taintPages(page)
 }
 
-func btree[DataType any](
-	grade int,
-	itemSize int64,
-	storagePath string,
-	reset bool,
-	p interfaces.Persistence[DataType]) *Btree[DataType] {
-
-	if reset {
+func btree[DataType any](c *BTConfig[DataType], p interfaces.Persistence[DataType]) (*Btree[DataType], error) {
+	if c.reset {
 		p.Reset()
 	}
-	size := utils.ReturnOrPanic[int64](p.LoadSize)
-	minChildren := int(math.Ceil(float64(grade) / 2))
+	size, err := p.LoadSize()
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	root, err := p.LoadRoot()
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	minChildren := int(math.Ceil(float64(c.grade) / 2))
 	minItems := minChildren - 1
 
-	return &Btree[DataType]{
-		grade:       grade,
-		itemSize:    itemSize,
-		storagePath: storagePath,
+	b := &Btree[DataType]{
+		grade:       c.grade,
+		itemSize:    c.itemSize,
+		storagePath: c.storagePath,
 		persistence: p,
 		changed:     map[int64]interfaces.Page[DataType]{},
-		root:        utils.ReturnOrPanic[interfaces.Page[DataType]](p.LoadRoot),
+		root:        root,
 		size:        size,
 		minItems:    minItems,
 		minChildren: minChildren,
+		layout:      c.layout,
+		readOnly:    c.readOnly,
+		durability:  c.durability,
+		copyOnWrite: c.copyOnWrite,
+		counted:     c.countItems,
+		config:      *c,
+		observer:    c.observer,
+	}
+	if b.ttlField, err = ttlFieldOf(b.itemType()); err != nil {
+		p.Close()
+		return nil, err
+	}
+	if c.logChanges {
+		b.config.changeLog = c.changeLogPath()
+		if !b.readOnly {
+			if b.changes.log, b.changes.seq, err = openChangeLog(b.config.changeLog, c.reset); err != nil {
+				p.Close()
+				return nil, err
+			}
+			if err = b.reconcileChanges(); err != nil {
+				b.changes.log.Close()
+				p.Close()
+				return nil, err
+			}
+		}
+	}
+	if !c.skipIndexes {
+		if err = b.openIndexes(); err != nil {
+			if b.changes.log != nil {
+				b.changes.log.Close()
+			}
+			p.Close()
+			return nil, err
+		}
+	}
+	if b.durability.mode == syncPeriodically && !b.readOnly {
+		b.startPeriodicSync()
 	}
+	return b, nil
 }
 
 func (b *Btree[DataType]) determineItemToGive(selected interfaces.Page[DataType], other interfaces.Page[DataType], siblingsDelta interfaces.PageDelta) (int, int, error) {
@@ -171,12 +432,14 @@ func (b *Btree[DataType]) determineItemToGive(selected interfaces.Page[DataType]
 	return itemIndexToGive, childIndexToGive, nil
 }
 
-func (b *Btree[DataType]) findLeafFor(page interfaces.Page[DataType], item interfaces.Item[DataType]) interfaces.Page[DataType] {
+func (b *Btree[DataType]) findLeafFor(ctx context.Context, page interfaces.Page[DataType], item interfaces.Item[DataType]) (interfaces.Page[DataType], error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if page.IsLeaf() {
-		return page
-	} else {
-		return b.findLeafFor(b.LoadPageChildren(page).ChildFor(item), item)
+		return page, nil
 	}
+	return b.findLeafFor(ctx, b.LoadPageChildren(page).ChildFor(item), item)
 }
 
 func (b *Btree[DataType]) FindEdgeItem(page interfaces.Page[DataType], left ...bool) (interfaces.Page[DataType], int) {
@@ -191,19 +454,23 @@ func (b *Btree[DataType]) FindEdgeItem(page interfaces.Page[DataType], left ...b
 	}
 }
 
-func (b *Btree[DataType]) find(partialItem DataType) (interfaces.Page[DataType], int) {
+// find looks for the page holding the item, checking the context before every page it loads
+func (b *Btree[DataType]) find(ctx context.Context, partialItem DataType) (interfaces.Page[DataType], int, error) {
 	currentPage := b.Root()
-	item := item[DataType](b.itemSize).Load(partialItem)
+	item := b.newItem(partialItem)
 	for currentPage != nil {
 		slot := currentPage.Items().SlotFor(item)
-		if previousItemPos := slot - 1; slot > 0 {
+		if previousItemPos := slot - 1; slot > 0 && (currentPage.IsLeaf() || !b.isBPlus()) {
 			if res, err := currentPage.Item(previousItemPos).Compare(item); err == nil && res == 0 {
-				return currentPage, previousItemPos
+				return currentPage, previousItemPos, nil
 			}
 		}
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
 		currentPage = b.LoadPageChildren(currentPage).Nth(slot)
 	}
-	return nil, 0
+	return nil, 0, nil
 }
 
 func (b *Btree[DataType]) genPagePrettyPrint(p interfaces.Page[DataType], prefix string) string {
@@ -221,6 +488,7 @@ func (b *Btree[DataType]) genPagePrettyPrint(p interfaces.Page[DataType], prefix
 }
 
 func (b *Btree[DataType]) mergePages(p1 interfaces.Page[DataType], p2 interfaces.Page[DataType]) {
+	b.count(constants.MetricMerges)
 	parentPage := p1.Parent()
 	parentSlot := p1.ParentSlotFor(p2)
 	if !p2.IsLeaf() {
@@ -232,6 +500,14 @@ func (b *Btree[DataType]) mergePages(p1 interfaces.Page[DataType], p2 interfaces
 	b.taintPages(p1, parentPage)
 }
 
+func (b *Btree[DataType]) load(offset int64) interfaces.Page[DataType] {
+	return b.persistence.Load(offset)
+}
+
+func (b *Btree[DataType]) newItem(value DataType) interfaces.Item[DataType] {
+	return item[DataType](b.itemSize, b.config.compare).Load(value)
+}
+
 func (b *Btree[DataType]) newPage(parent interfaces.Page[DataType]) interfaces.Page[DataType] {
 	p, _ := b.persistence.NewPage()
 	p.Parent(parent)
@@ -261,17 +537,24 @@ func (b *Btree[DataType]) pageGiveItems(from interfaces.Page[DataType], to inter
 }
 
 func (b *Btree[DataType]) persist() {
+	if b.counted {
+		b.updateCounts()
+	}
+	if b.copyOnWrite {
+		utils.PanicOnError(func() error { return b.commit(b.persistCopyOnWrite()) })
+		return
+	}
+	pagesSaved := false
 	for _, p := range b.changed {
-		if p.Size() > 0 {
+		// an empty root is saved as well, or the tree would come back with its last items
+		if p.Size() > 0 || p.Same(b.root) {
 			utils.PanicOnError(func() error { return b.persistence.Save(p) })
-			if b.rootChanged {
-				utils.PanicOnError(b.persistRoot)
-			}
 			p.Children().Unload()
+			pagesSaved = true
 		}
 		delete(b.changed, p.Offset())
 	}
-	utils.PanicOnError(b.persistSize)
+	utils.PanicOnError(func() error { return b.commit(pagesSaved) })
 }
 
 func (b *Btree[DataType]) persistRoot() error {
@@ -316,8 +599,10 @@ func (b *Btree[DataType]) maneuverItem(page interfaces.Page[DataType], index int
 			b.pageGiveItems(page, leaf, newIndex)
 			return leaf, edgeItemIndex, nil
 		} else {
+			wasRoot := page.Same(b.Root())
 			b.mergePages(biggestChild, children.Nth(1))
-			if b.PageNeedsAdjustment(page) {
+			// a root left empty by the merge is replaced by the merged page, and needs no adjustment
+			if !wasRoot && b.PageNeedsAdjustment(page) {
 				err := b.fixPage(page)
 				if err != nil {
 					return nil, -1, err
@@ -330,6 +615,9 @@ func (b *Btree[DataType]) maneuverItem(page interfaces.Page[DataType], index int
 }
 
 func (b *Btree[DataType]) removeFromPage(index int, page interfaces.Page[DataType]) error {
+	if b.isBPlus() {
+		return b.removeFromLeaf(index, page)
+	}
 	newPage, newIndex, err := b.maneuverItem(page, index)
 	if err != nil {
 		return err
@@ -348,7 +636,7 @@ func (b *Btree[DataType]) safeGiveItem(from interfaces.Page[DataType], itemIndex
 	// this method assumes that left and right pages from from[itemIndex] were already merged
 	b.pageGiveItems(from, to, itemIndex)
 	if from.Same(b.Root()) && from.IsEmpty() {
-		b.shrink()
+		b.shrink(to)
 	}
 }
 
@@ -362,12 +650,17 @@ func (b *Btree[DataType]) setRoot(page interfaces.Page[DataType]) interfaces.Pag
 	return b.root
 }
 
-func (b *Btree[DataType]) shrink() {
-	b.setRoot(b.LoadPageChildren(b.root).First())
+func (b *Btree[DataType]) shrink(newRoot interfaces.Page[DataType]) {
+	b.setRoot(newRoot)
 	b.root.ResetParent()
 }
 
 func (b *Btree[DataType]) splitPage(page interfaces.Page[DataType]) {
+	b.count(constants.MetricSplits)
+	if b.isBPlus() && page.IsLeaf() {
+		b.splitLeaf(page)
+		return
+	}
 	left, right, middle := page.Items().Split()
 	pivot := page.Item(middle)
 	childrenLeft, childrenRight := b.LoadPageChildren(page).Split(middle)
@@ -396,6 +689,7 @@ func (b *Btree[DataType]) taintPages(pages ...interfaces.Page[DataType]) {
 }
 
 func (b *Btree[DataType]) transferSelectedSiblingItem(selectedSibling interfaces.Page[DataType], siblingToReceive interfaces.Page[DataType]) error {
+	b.count(constants.MetricRotations)
 	var itemIndexToGivePR int
 	parentPage := selectedSibling.Parent()
 	delta := selectedSibling.Delta(siblingToReceive)
@@ -0,0 +1,146 @@
+package btree
+
+import (
+	"context"
+	"slices"
+
+	"github.com/mylux/bsistent/interfaces"
+)
+
+func (b *Btree[DataType]) BulkLoad(values ...DataType) error {
+	return b.bulkLoad(context.Background(), values...)
+}
+
+func (b *Btree[DataType]) bulkLoad(ctx context.Context, values ...DataType) (err error) {
+	defer b.recoverChange(&err)
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if b.readOnly {
+		return ErrReadOnly
+	}
+	items := make([]interfaces.Item[DataType], 0, len(values))
+	for _, value := range values {
+		if it := b.newItem(value); !it.IsEmpty() {
+			items = append(items, it)
+		}
+	}
+	slices.SortStableFunc(items, compareItems[DataType])
+	contents := make([]DataType, len(items))
+	for i, it := range items {
+		contents[i] = it.Content()
+	}
+	if err := b.checkUnique(contents...); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var none DataType
+	if !b.IsEmpty() {
+		// pages are reloaded from the persistence layer on every insertion, so each one must be persisted
+		for _, it := range items {
+			if err := b.add(ctx, it); err != nil {
+				return err
+			}
+			change := b.logChange(Inserted, none, it.Content())
+			b.persist()
+			if err := b.indexAdd(it.Content()); err != nil {
+				return err
+			}
+			b.publish(change)
+		}
+		return nil
+	}
+	changes := make([]Change[DataType], len(contents))
+	if len(items) > 0 {
+		b.build(items)
+		b.size = int64(len(items))
+		for i, value := range contents {
+			changes[i] = b.logChange(Inserted, none, value)
+		}
+		b.persist()
+	}
+	if err := b.indexAdd(contents...); err != nil {
+		return err
+	}
+	b.publish(changes...)
+	return nil
+}
+
+func (b *Btree[DataType]) build(items []interfaces.Item[DataType]) {
+	var pages []interfaces.Page[DataType]
+	var separators []interfaces.Item[DataType]
+	// the empty root is reused as the first page, so no page is left behind in the data file
+	spare := b.root
+	if b.isBPlus() {
+		pages = b.buildPages(chunkSizes(len(items), spare.Capacity(), 0), items, nil, &spare)
+		for _, p := range pages[1:] {
+			separators = append(separators, b.separatorFor(p.Items().First()))
+		}
+		for i := 1; i < len(pages); i++ {
+			b.linkLeaves(pages[i-1], pages[i])
+		}
+	} else {
+		pages, separators = b.buildLevel(items, nil, &spare)
+	}
+	for len(pages) > 1 {
+		pages, separators = b.buildLevel(separators, pages, &spare)
+	}
+	b.setRoot(pages[0])
+}
+
+func (b *Btree[DataType]) buildLevel(items []interfaces.Item[DataType], children []interfaces.Page[DataType], spare *interfaces.Page[DataType]) ([]interfaces.Page[DataType], []interfaces.Item[DataType]) {
+	sizes := chunkSizes(len(items), b.root.Capacity(), 1)
+	separators := make([]interfaces.Item[DataType], 0, len(sizes)-1)
+	pageItems := make([]interfaces.Item[DataType], 0, len(items))
+	start := 0
+	for i, size := range sizes {
+		pageItems = append(pageItems, items[start:start+size]...)
+		start += size
+		if i < len(sizes)-1 {
+			separators = append(separators, items[start])
+			start++
+		}
+	}
+	return b.buildPages(sizes, pageItems, children, spare), separators
+}
+
+func (b *Btree[DataType]) buildPages(sizes []int, items []interfaces.Item[DataType], children []interfaces.Page[DataType], spare *interfaces.Page[DataType]) []interfaces.Page[DataType] {
+	pages := make([]interfaces.Page[DataType], len(sizes))
+	start, childStart := 0, 0
+	for i, size := range sizes {
+		pages[i] = b.bulkPage(spare)
+		pages[i].Items(slices.Clone(items[start : start+size])...)
+		if children != nil {
+			pages[i].Children(children[childStart : childStart+size+1])
+			childStart += size + 1
+		}
+		start += size
+		b.taintPages(pages[i])
+	}
+	return pages
+}
+
+func (b *Btree[DataType]) bulkPage(spare *interfaces.Page[DataType]) interfaces.Page[DataType] {
+	if p := *spare; p != nil {
+		*spare = nil
+		return p
+	}
+	return b.newPage(nil)
+}
+
+// chunkSizes splits n items into as few pages as possible, spreading them evenly.
+// Each page but the last consumes separator extra items, which go up to the next level
+func chunkSizes(n int, capacity int, separator int) []int {
+	pages := max(1, (n+separator+capacity+separator-1)/(capacity+separator))
+	total := n - (pages-1)*separator
+	sizes := make([]int, pages)
+	for i := range sizes {
+		sizes[i] = total / pages
+		if i < total%pages {
+			sizes[i]++
+		}
+	}
+	return sizes
+}
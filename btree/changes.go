@@ -0,0 +1,341 @@
+package btree
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/mylux/bsistent/utils"
+)
+
+type ChangeOp int
+
+const (
+	Inserted ChangeOp = iota + 1
+	Updated
+	Deleted
+)
+
+var changeOpNames = map[ChangeOp]string{
+	Inserted: "inserted",
+	Updated:  "updated",
+	Deleted:  "deleted",
+}
+
+// Change describes an item inserted, updated or deleted. Old is only filled for updates and
+// deletions, New for insertions and updates
+type Change[DataType any] struct {
+	Seq uint64
+	Op  ChangeOp
+	Old DataType
+	New DataType
+}
+
+type changeRecord struct {
+	Seq uint64          `json:"seq"`
+	Op  ChangeOp        `json:"op"`
+	Old json.RawMessage `json:"old,omitempty"`
+	New json.RawMessage `json:"new,omitempty"`
+}
+
+type subscriber[DataType any] struct {
+	id int
+	f  func(Change[DataType])
+}
+
+type changeFeed[DataType any] struct {
+	seq         uint64
+	log         *os.File
+	subscribers []subscriber[DataType]
+	lastID      int
+	// held keeps the changes of the transaction in progress, which are logged and handed to the
+	// subscribers once it commits. began is the sequence number before it, and logged is where
+	// the log ended before its changes were written, -1 until they are
+	holding bool
+	held    []Change[DataType]
+	began   uint64
+	logged  int64
+}
+
+// ChangeIterator reads the change log in sequence order
+type ChangeIterator[DataType any] struct {
+	tree    *Btree[DataType]
+	file    *os.File
+	scanner *bufio.Scanner
+	after   uint64
+	current Change[DataType]
+	err     error
+}
+
+func (o ChangeOp) String() string {
+	if name, found := changeOpNames[o]; found {
+		return name
+	}
+	return fmt.Sprintf("ChangeOp(%d)", int(o))
+}
+
+func (o ChangeOp) MarshalText() ([]byte, error) {
+	if _, found := changeOpNames[o]; !found {
+		return nil, fmt.Errorf("unknown change operation %d", int(o))
+	}
+	return []byte(o.String()), nil
+}
+
+func (o *ChangeOp) UnmarshalText(text []byte) error {
+	for op, name := range changeOpNames {
+		if name == string(text) {
+			*o = op
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown change operation %q", text)
+}
+
+// OnChange calls f after every change made to the btree, once it is persisted. The returned
+// function cancels the subscription
+func (b *Btree[DataType]) OnChange(f func(Change[DataType])) func() {
+	b.changes.lastID++
+	id := b.changes.lastID
+	b.changes.subscribers = append(b.changes.subscribers, subscriber[DataType]{id: id, f: f})
+	return func() {
+		b.changes.subscribers = slices.DeleteFunc(b.changes.subscribers, func(s subscriber[DataType]) bool { return s.id == id })
+	}
+}
+
+// Changes reads the change log from the first change after the given sequence number, so a
+// consumer can resume from the last change it handled. Pass 0 to read the whole log
+func (b *Btree[DataType]) Changes(after uint64) (*ChangeIterator[DataType], error) {
+	if b.config.changeLog == "" {
+		return nil, fmt.Errorf("the change log is not enabled")
+	}
+	f, err := os.Open(b.config.changeLog)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), int(b.itemSize)*16+bufio.MaxScanTokenSize)
+	return &ChangeIterator[DataType]{tree: b, file: f, scanner: scanner, after: after}, nil
+}
+
+func (i *ChangeIterator[DataType]) Next() bool {
+	for i.err == nil && i.scanner.Scan() {
+		var record changeRecord
+		if i.err = json.Unmarshal(i.scanner.Bytes(), &record); i.err != nil {
+			break
+		}
+		if record.Seq > i.after {
+			i.current, i.err = i.tree.decodeChange(record)
+			return i.err == nil
+		}
+	}
+	if i.err == nil {
+		i.err = i.scanner.Err()
+	}
+	return false
+}
+
+func (i *ChangeIterator[DataType]) Value() Change[DataType] {
+	return i.current
+}
+
+// Err returns the error that stopped the iteration, if any
+func (i *ChangeIterator[DataType]) Err() error {
+	return i.err
+}
+
+func (i *ChangeIterator[DataType]) Close() error {
+	return i.file.Close()
+}
+
+func (b *Btree[DataType]) decodeChange(record changeRecord) (Change[DataType], error) {
+	change := Change[DataType]{Seq: record.Seq, Op: record.Op}
+	for _, v := range []struct {
+		raw json.RawMessage
+		to  *DataType
+	}{{record.Old, &change.Old}, {record.New, &change.New}} {
+		if len(v.raw) > 0 {
+			value := b.newValue()
+			if err := json.Unmarshal(v.raw, value.Addr().Interface()); err != nil {
+				return change, fmt.Errorf("change %d: %w", record.Seq, err)
+			}
+			*v.to = value.Interface().(DataType)
+		}
+	}
+	return change, nil
+}
+
+// logChange numbers the change and appends it to the log before the tree saves it, so the data
+// file never holds a change the log misses. A change the log cannot take panics, leaving the
+// tree failed with its pages in memory changed. The changes of a transaction are logged when
+// it commits
+func (b *Btree[DataType]) logChange(op ChangeOp, old DataType, new DataType) Change[DataType] {
+	b.changes.seq++
+	change := Change[DataType]{Seq: b.changes.seq, Op: op, Old: old, New: new}
+	if b.changes.holding {
+		b.changes.held = append(b.changes.held, change)
+	} else if b.changes.log != nil {
+		utils.PanicOnError(func() error { return b.writeChange(change) })
+	}
+	return change
+}
+
+// publish hands the changes to the subscribers, once the tree saved them. The changes of a
+// transaction are held until it commits
+func (b *Btree[DataType]) publish(changes ...Change[DataType]) {
+	if b.changes.holding {
+		return
+	}
+	subscribers := slices.Clone(b.changes.subscribers)
+	for _, change := range changes {
+		for _, s := range subscribers {
+			s.f(change)
+		}
+	}
+}
+
+func (b *Btree[DataType]) writeChange(change Change[DataType]) error {
+	var err error
+	record := changeRecord{Seq: change.Seq, Op: change.Op}
+	if change.Op != Inserted {
+		if record.Old, err = json.Marshal(change.Old); err != nil {
+			return err
+		}
+	}
+	if change.Op != Deleted {
+		if record.New, err = json.Marshal(change.New); err != nil {
+			return err
+		}
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err = b.changes.log.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	switch b.durability.mode {
+	case syncOnCommit:
+		return b.changes.log.Sync()
+	case syncPeriodically:
+		b.syncer.dirty.Store(true)
+	}
+	return nil
+}
+
+// openChangeLog opens the change log for appending and finds the last sequence number in it.
+// A line left incomplete by a crash is dropped
+func openChangeLog(path string, reset bool) (*os.File, uint64, error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if reset {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0666)
+	if err != nil {
+		return nil, 0, err
+	}
+	record, _, end, err := lastChange(f)
+	if err == nil {
+		err = truncateChangeLog(f, end)
+	}
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, record.Seq, nil
+}
+
+// reconcileChanges drops the changes at the end of the log the tree does not hold, which were
+// logged by a change interrupted before the tree saved it
+func (b *Btree[DataType]) reconcileChanges() (err error) {
+	defer recoverError(&err)
+	for b.changes.seq > 0 {
+		record, start, end, err := lastChange(b.changes.log)
+		if err != nil || end == 0 {
+			return err
+		}
+		change, err := b.decodeChange(record)
+		if err != nil {
+			return err
+		}
+		if b.holds(change) {
+			return nil
+		}
+		if err = truncateChangeLog(b.changes.log, start); err != nil {
+			return err
+		}
+		b.changes.seq = record.Seq - 1
+	}
+	return nil
+}
+
+// holds tells whether the tree holds the outcome of the change: the new item, or no longer the
+// deleted one. All the items with its key are looked at, since the tree may hold several
+func (b *Btree[DataType]) holds(change Change[DataType]) bool {
+	value := utils.Ternary(change.Op == Deleted, change.Old, change.New)
+	logged := utils.ReturnOrPanic(func() ([]byte, error) { return json.Marshal(value) })
+	item := b.newItem(value)
+	found := false
+	it := iterator(context.Background(), b, item)
+	for !found && it.advance() && compareItems(it.current, item) == 0 {
+		stored, err := json.Marshal(it.current.Content())
+		found = err == nil && bytes.Equal(stored, logged)
+	}
+	utils.PanicOnError(func() error { return it.err })
+	return found != (change.Op == Deleted)
+}
+
+func truncateChangeLog(f *os.File, end int64) error {
+	if err := f.Truncate(end); err != nil {
+		return err
+	}
+	_, err := f.Seek(end, io.SeekStart)
+	return err
+}
+
+// lastChange reads the file backwards up to the last complete line, returning its record and
+// where it starts and ends
+func lastChange(f *os.File) (changeRecord, int64, int64, error) {
+	var record changeRecord
+	st, err := f.Stat()
+	if err != nil {
+		return record, 0, 0, err
+	}
+	end := int64(-1)
+	start := int64(0)
+	buf := make([]byte, 4096)
+search:
+	for pos := st.Size(); pos > 0; {
+		n := min(int64(len(buf)), pos)
+		pos -= n
+		if _, err := f.ReadAt(buf[:n], pos); err != nil {
+			return record, 0, 0, err
+		}
+		for i := n - 1; i >= 0; i-- {
+			if buf[i] != '\n' {
+				continue
+			}
+			if end < 0 {
+				end = pos + i + 1
+				continue
+			}
+			start = pos + i + 1
+			break search
+		}
+	}
+	if end < 0 {
+		return record, 0, 0, nil
+	}
+	line := make([]byte, end-start)
+	if _, err := f.ReadAt(line, start); err != nil {
+		return record, 0, 0, err
+	}
+	if err := json.Unmarshal(line, &record); err != nil {
+		return record, 0, 0, fmt.Errorf("corrupted change log %s: %w", f.Name(), err)
+	}
+	return record, start, end, nil
+}
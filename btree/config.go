@@ -3,6 +3,9 @@ package btree
 import (
 	"fmt"
 	"os"
+	"reflect"
+	"regexp"
+	"runtime"
 
 	"github.com/mylux/bsistent/assemblers"
 	"github.com/mylux/bsistent/interfaces"
@@ -10,6 +13,16 @@ import (
 	"github.com/mylux/bsistent/utils"
 )
 
+type Layout int
+
+const (
+	Classic Layout = iota
+	BPlus
+)
+
+// anonymousName matches the names of function literals, such as main.main.func1 or pkg.glob..func2.3
+var anonymousName = regexp.MustCompile(`\.func\d+(\.\d+)*$`)
+
 var defaultConfig BTConfig[any] = BTConfig[any]{
 	grade:       500,
 	itemSize:    64,
@@ -17,6 +30,8 @@ var defaultConfig BTConfig[any] = BTConfig[any]{
 	storagePath: fmt.Sprintf("%s/.bsistent/bsistent", os.Getenv("HOME")),
 	reset:       false,
 	cacheSize:   0,
+	layout:      Classic,
+	durability:  DurabilityNone,
 }
 
 type BTConfig[DataType any] struct {
@@ -26,6 +41,26 @@ type BTConfig[DataType any] struct {
 	storagePath string
 	reset       bool
 	cacheSize   uint32
+	layout      Layout
+	itemType    reflect.Type
+	readOnly    bool
+	durability  Durability
+	copyOnWrite bool
+	logChanges  bool
+	changeLog   string
+	countItems  bool
+	compress    bool
+	key         []byte
+	writeBehind *interfaces.WriteBehind
+	observer    interfaces.Observer
+	compare     func(DataType, DataType) int
+	ordering    string
+	// skipIndexes leaves the secondary indexes closed, for trees that never use them
+	skipIndexes bool
+	// db holds the trees kept in a database file, found by their name in its catalog
+	db     *DB
+	name   string
+	header int64
 }
 
 func Configuration[DataType any]() *BTConfig[DataType] {
@@ -34,6 +69,8 @@ func Configuration[DataType any]() *BTConfig[DataType] {
 		itemSize:    defaultConfig.itemSize,
 		storagePath: defaultConfig.storagePath,
 		reset:       defaultConfig.reset,
+		layout:      defaultConfig.layout,
+		durability:  defaultConfig.durability,
 	}
 }
 
@@ -54,6 +91,7 @@ func (c *BTConfig[DataType]) ItemSize(itemSize int64) *BTConfig[DataType] {
 
 func (c *BTConfig[DataType]) ItemShape(shape any) *BTConfig[DataType] {
 	c.itemSize = int64(utils.ReturnOrPanic(func() (int, error) { return (&serialization.Serializer{}).SizeOf(shape) }))
+	c.itemType = reflect.TypeOf(shape)
 	return c
 }
 
@@ -67,20 +105,216 @@ func (c *BTConfig[DataType]) CacheSize(size uint32) *BTConfig[DataType] {
 	return c
 }
 
+func (c *BTConfig[DataType]) Layout(layout Layout) *BTConfig[DataType] {
+	c.layout = layout
+	return c
+}
+
+// ChangeLog keeps a durable log of the changes made to the btree, which can be read with
+// Changes. The log is kept next to the data file unless another path is given
+func (c *BTConfig[DataType]) ChangeLog(path ...string) *BTConfig[DataType] {
+	c.logChanges = true
+	c.changeLog = utils.Coalesce(path, "")
+	return c
+}
+
+// Compare orders the items with the given function, which returns a negative number when a
+// comes before b, a positive one when it comes after and 0 when they are equal. The ordering is
+// recorded in the data file by name, which is the name of the function unless one is given, and
+// the file cannot be opened with another ordering afterwards. Anonymous functions must be given
+// a name, since theirs changes as the code around them does
+func (c *BTConfig[DataType]) Compare(compare func(a DataType, b DataType) int, name ...string) *BTConfig[DataType] {
+	c.compare = compare
+	c.ordering = utils.Coalesce(name, functionName(compare))
+	return c
+}
+
+// Compression compresses each page of new data files, which are stored mostly as the blank
+// room left for the items. Existing data files keep the format they were started with
+func (c *BTConfig[DataType]) Compression() *BTConfig[DataType] {
+	c.compress = true
+	return c
+}
+
+// Encryption encrypts each page of the data file with AES-GCM and the given key, which must
+// be 16, 24 or 32 bytes long. The root reference, the size and the ordering in the header are
+// left readable. An encrypted data file must always be opened with its key, and the key is
+// changed by compacting the file with another one
+func (c *BTConfig[DataType]) Encryption(key []byte) *BTConfig[DataType] {
+	c.key = key
+	return c
+}
+
+// CopyOnWrite saves the changed pages at new offsets instead of overwriting them, so the
+// committed tree is never modified in place and snapshots can be taken from it
+func (c *BTConfig[DataType]) CopyOnWrite() *BTConfig[DataType] {
+	c.copyOnWrite = true
+	return c
+}
+
+// WriteBehind saves the changed pages in the background instead of writing them while the
+// tree is changed. They are read back from memory until they are written, which Sync forces
+func (c *BTConfig[DataType]) WriteBehind(options ...WriteBehindOptions) *BTConfig[DataType] {
+	o := utils.Coalesce(options, WriteBehindOptions{})
+	c.writeBehind = &interfaces.WriteBehind{
+		FlushPages:    utils.Ternary(o.FlushPages > 0, o.FlushPages, defaultFlushPages),
+		FlushInterval: utils.Ternary(o.FlushInterval > 0, o.FlushInterval, defaultFlushInterval),
+		MaxDirtyPages: utils.Ternary(o.MaxDirtyPages > 0, o.MaxDirtyPages, defaultMaxDirtyPages),
+	}
+	c.writeBehind.FlushPages = min(c.writeBehind.FlushPages, c.writeBehind.MaxDirtyPages)
+	return c
+}
+
+func (c *BTConfig[DataType]) Durability(durability Durability) *BTConfig[DataType] {
+	c.durability = durability
+	return c
+}
+
+// Metrics reports the metrics of the btree to the observer, which must be safe for concurrent
+// use. The secondary indexes of the btree are not observed. See metrics.Expvar to publish
+// them through expvar
+func (c *BTConfig[DataType]) Metrics(observer interfaces.Observer) *BTConfig[DataType] {
+	c.observer = observer
+	return c
+}
+
+// OrderStatistics keeps the number of items under each child of the pages, so items can be
+// ranked and looked up by position. The setting is recorded in the data file, which fails to
+// open with ErrLayout when the other one is given
+func (c *BTConfig[DataType]) OrderStatistics() *BTConfig[DataType] {
+	c.countItems = true
+	return c
+}
+
+// ReadOnly opens the data file for reading only. The file is then locked in shared mode,
+// so several readers can use it at the same time, and the tree rejects any change
+func (c *BTConfig[DataType]) ReadOnly() *BTConfig[DataType] {
+	c.readOnly = true
+	return c
+}
+
+// Less orders the items with the given function, which reports whether a comes before b.
+// It is recorded in the data file as Compare does
+func (c *BTConfig[DataType]) Less(less func(a DataType, b DataType) bool, name ...string) *BTConfig[DataType] {
+	c.Compare(func(a DataType, b DataType) int {
+		if less(a, b) {
+			return -1
+		}
+		if less(b, a) {
+			return 1
+		}
+		return 0
+	})
+	c.ordering = utils.Coalesce(name, functionName(less))
+	return c
+}
+
 func (c *BTConfig[DataType]) Make() *Btree[DataType] {
+	return utils.ReturnOrPanic(func() (*Btree[DataType], error) { return c.make(false) })
+}
+
+func (c *BTConfig[DataType]) make(exclusive bool) (*Btree[DataType], error) {
+	if c.readOnly && c.reset {
+		return nil, fmt.Errorf("a read-only tree cannot be reset")
+	}
+	if c.copyOnWrite && c.layout == BPlus {
+		return nil, fmt.Errorf("copy-on-write is not supported by the B+ layout, whose leaves are linked in place")
+	}
+	if c.compress && c.db != nil {
+		return nil, fmt.Errorf("compression is not supported by the trees of a database, whose pages share the file")
+	}
+	if c.key != nil && (c.compress || c.db != nil) {
+		return nil, fmt.Errorf("encryption is not supported along with compression or by the trees of a database")
+	}
+	if c.key != nil && c.logChanges {
+		return nil, fmt.Errorf("the change log would keep the items of an encrypted tree unencrypted")
+	}
+	if c.writeBehind != nil && (c.compress || c.db != nil) {
+		return nil, fmt.Errorf("write-behind is not supported along with compression or by the trees of a database")
+	}
+	if c.writeBehind != nil && c.durability.mode == syncOnCommit {
+		return nil, fmt.Errorf("write-behind cannot be used with durability on commit, which writes every change right away")
+	}
+	if c.compare != nil && anonymousFunction(c.ordering) {
+		return nil, fmt.Errorf("the ordering %s is an anonymous function, which must be given a name", c.ordering)
+	}
+	if c.durability.mode == syncPeriodically && c.durability.interval <= 0 {
+		return nil, fmt.Errorf("periodic durability needs a positive interval")
+	}
 	fp := func(offset int64) interfaces.Page[DataType] {
 		return page[DataType](offset, c.grade-1)
 	}
 
 	fi := func() interfaces.Item[DataType] {
-		return item[DataType](c.itemSize)
+		return item[DataType](c.itemSize, c.compare)
 	}
-	p := assemblers.NewPersistence[DataType](
+	var shared interfaces.SharedFile
+	if c.db != nil {
+		if c.header == 0 {
+			header, err := c.db.headerOf(c.name, !c.readOnly)
+			if err != nil {
+				return nil, err
+			}
+			c.header = header
+		}
+		shared = c.db.file
+	}
+	p, err := assemblers.OpenPersistence[DataType](
 		&interfaces.PersistenceConfig[DataType]{
 			Path:            c.storagePath,
 			PageConstructor: fp,
 			ItemConstructor: fi,
 			CacheSize:       c.cacheSize,
+			ItemType:        c.itemType,
+			Exclusive:       exclusive,
+			ReadOnly:        c.readOnly,
+			CopyOnWrite:     c.copyOnWrite,
+			Compress:        c.compress,
+			EncryptionKey:   c.key,
+			WriteBehind:     c.writeBehind,
+			Observer:        c.observer,
+			SubtreeCounts:   c.countItems,
+			Ordering:        c.ordering,
+			BPlus:           c.layout == BPlus,
+			Reset:           c.reset,
+			Shared:          shared,
+			Header:          c.header,
 		})
-	return btree[DataType](c.grade, c.itemSize, c.storagePath, c.reset, p)
+	if err != nil {
+		return nil, err
+	}
+	b, err := btree[DataType](c, p)
+	if err == nil && c.db != nil && !c.readOnly {
+		c.db.join(b)
+	}
+	return b, err
+}
+
+// exists tells whether the tree was ever stored where the configuration points
+func (c *BTConfig[DataType]) exists() bool {
+	if c.db != nil {
+		return c.db.has(c.name)
+	}
+	_, err := os.Stat(c.storagePath)
+	return err == nil
+}
+
+func (c *BTConfig[DataType]) changeLogPath() string {
+	if c.changeLog == "" && c.db != nil {
+		return fmt.Sprintf("%s.%s.changes", c.storagePath, c.name)
+	}
+	if c.changeLog == "" {
+		return c.storagePath + ".changes"
+	}
+	return c.changeLog
+}
+
+func functionName(f any) string {
+	return runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
+}
+
+// anonymousFunction tells whether the name is the one the runtime gives to function literals,
+// which are numbered in the order they appear in their enclosing function
+func anonymousFunction(name string) bool {
+	return anonymousName.MatchString(name)
 }
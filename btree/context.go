@@ -0,0 +1,58 @@
+package btree
+
+import (
+	"context"
+)
+
+// AddCtx adds the item like Add, unless the context is done before the tree starts changing
+func (b *Btree[DataType]) AddCtx(ctx context.Context, value DataType) error {
+	return b.addValue(ctx, value)
+}
+
+// FindCtx looks the item up like Find, stopping when the context is done. A page that cannot
+// be read fails the lookup instead of panicking
+func (b *Btree[DataType]) FindCtx(ctx context.Context, partialItem DataType) (found bool, value DataType, err error) {
+	defer recoverError(&err)
+	return b.findValue(ctx, partialItem)
+}
+
+// IterateCtx iterates over the items like Iterate. The iteration ends when the context is
+// done, which Err then tells
+func (b *Btree[DataType]) IterateCtx(ctx context.Context) *Iterator[DataType] {
+	return iterator(ctx, b, nil)
+}
+
+// IterateFromCtx iterates over the items like IterateFrom, ending when the context is done
+func (b *Btree[DataType]) IterateFromCtx(ctx context.Context, partialItem DataType) *Iterator[DataType] {
+	return iterator(ctx, b, b.newItem(partialItem))
+}
+
+// PrefixCtx iterates over the items matching the prefix like Prefix, ending when the context
+// is done
+func (b *Btree[DataType]) PrefixCtx(ctx context.Context, partial DataType) *Iterator[DataType] {
+	return b.prefix(ctx, partial)
+}
+
+// BulkLoadCtx adds the items like BulkLoad. Items added one by one to a tree that is not empty
+// stop being added when the context is done, while the ones already added stay in the tree.
+// An empty tree is built in a single step, which only starts if the context is not done
+func (b *Btree[DataType]) BulkLoadCtx(ctx context.Context, values ...DataType) error {
+	return b.bulkLoad(ctx, values...)
+}
+
+// CompactToCtx compacts the tree like CompactTo, stopping when the context is done while the
+// items are read. The new data file is left incomplete then
+func (b *Btree[DataType]) CompactToCtx(ctx context.Context, path string, options ...CompactOptions) (*Btree[DataType], error) {
+	return b.compactTo(ctx, path, options...)
+}
+
+// VerifyCtx checks the tree like Verify, stopping when the context is done
+func (b *Btree[DataType]) VerifyCtx(ctx context.Context) error {
+	return b.verify(ctx)
+}
+
+// Err returns the error that ended the iteration, such as the one of its context or of a page
+// that could not be read, if any
+func (i *Iterator[DataType]) Err() error {
+	return i.err
+}
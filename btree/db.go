@@ -0,0 +1,338 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/mylux/bsistent/assemblers"
+	"github.com/mylux/bsistent/interfaces"
+	"github.com/mylux/bsistent/utils"
+)
+
+// DB keeps several named trees in a single data file. The trees take their pages from the
+// same file as they grow, and a catalog stored in it tells where the header of each one is
+type DB struct {
+	sync.Mutex
+	path     string
+	file     interfaces.SharedFile
+	catalog  *Btree[catalogEntry]
+	trees    []io.Closer
+	readOnly bool
+	closed   bool
+	// transaction is held by the transaction in progress, and inTransaction tells whether
+	// there is one
+	transaction   sync.Mutex
+	inTransaction bool
+	// members are the trees open for writing, which take part in the transactions. They have
+	// their own lock, since the trees leave them when the database closes them
+	members     map[member]bool
+	membersLock sync.Mutex
+}
+
+type DBOptions struct {
+	// ReadOnly opens the database file for reading only, along with all its trees
+	ReadOnly bool
+	// CacheSize is the number of pages kept in memory for all the trees of the database, which
+	// share them. The cache size of the trees is not used
+	CacheSize uint32
+}
+
+// member is a tree of a database taking part in its transactions
+type member interface {
+	begin() error
+	prepare() error
+	complete()
+	rollback(kept error)
+}
+
+// catalogEntry tells where the header of a tree of a database is
+type catalogEntry struct {
+	Name   string `bsistent:"key;maxSize:256"`
+	Header int64
+}
+
+// OpenDB opens the database file at the given path, creating it when it does not exist
+func OpenDB(path string, options ...DBOptions) (*DB, error) {
+	o := utils.Coalesce(options, DBOptions{})
+	file, err := assemblers.OpenSharedFile(path, o.ReadOnly, o.CacheSize)
+	if err != nil {
+		return nil, err
+	}
+	readOnly := o.ReadOnly
+	db := &DB{path: path, file: file, readOnly: readOnly, members: map[member]bool{}}
+	c := Configuration[catalogEntry]().Grade(16).ItemShape(catalogEntry{}).StoragePath(path)
+	c.readOnly = readOnly
+	c.db = db
+	c.header = file.Catalog()
+	if db.catalog, err = c.make(false); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Tree opens the tree with the given name in the database, creating it when it does not exist.
+// The storage path of the configuration is not used, and a tree must always be opened with
+// the same configuration
+func Tree[DataType any](db *DB, name string, config ...*BTConfig[DataType]) (*Btree[DataType], error) {
+	if name == "" {
+		return nil, fmt.Errorf("trees of a database need a name")
+	}
+	db.Lock()
+	closed, inTransaction := db.closed, db.inTransaction
+	db.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	if inTransaction {
+		return nil, fmt.Errorf("trees cannot be opened during a transaction")
+	}
+	c := *utils.Coalesce(config, Configuration[DataType]())
+	c.storagePath = db.path
+	c.db = db
+	c.name = name
+	c.header = 0
+	c.readOnly = c.readOnly || db.readOnly
+	b, err := c.make(false)
+	if err != nil {
+		return nil, err
+	}
+	db.Lock()
+	db.trees = append(db.trees, b)
+	db.Unlock()
+	return b, nil
+}
+
+// Trees returns the names of the trees in the database, including the ones holding the
+// secondary indexes of the others
+func (db *DB) Trees() []string {
+	db.Lock()
+	defer db.Unlock()
+	var names []string
+	for it := db.catalog.Iterate(); it.Next(); {
+		names = append(names, it.Value().Name)
+	}
+	return names
+}
+
+// Update runs the change as a transaction: the pages and the headers it writes, in any of the
+// trees, are committed together when it returns no error, and none of them are when it does or
+// when it panics. The trees cannot be opened and snapshots cannot be taken during the change
+func (db *DB) Update(change func() error) (err error) {
+	db.transaction.Lock()
+	defer db.transaction.Unlock()
+	db.Lock()
+	closed := db.closed
+	db.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	members := db.participants()
+	begun, committed := 0, false
+	defer func() {
+		if committed {
+			return
+		}
+		kept := db.file.Rollback()
+		for _, m := range members[:begun] {
+			m.rollback(kept)
+		}
+	}()
+	// the changes made before the transaction are saved apart from it
+	for _, m := range members {
+		if err = m.begin(); err != nil {
+			return err
+		}
+		begun++
+	}
+	if err = db.file.Begin(); err != nil {
+		return err
+	}
+	db.setTransaction(true)
+	defer db.setTransaction(false)
+	if err = change(); err != nil {
+		return err
+	}
+	// the changes are logged before the transaction commits, as they are outside of one
+	for _, m := range members {
+		if err = m.prepare(); err != nil {
+			return err
+		}
+	}
+	if err = db.file.Commit(); err != nil {
+		return err
+	}
+	committed = true
+	for _, m := range members {
+		m.complete()
+	}
+	return nil
+}
+
+// Sync flushes the changes made to any of the trees to the disk
+func (db *DB) Sync() error {
+	db.Lock()
+	defer db.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	return db.file.Sync()
+}
+
+// Close closes the trees of the database still open, and then the data file
+func (db *DB) Close() error {
+	db.Lock()
+	defer db.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	db.closed = true
+	var err error
+	for _, t := range db.trees {
+		if closeErr := t.Close(); err == nil && !errors.Is(closeErr, ErrClosed) {
+			err = closeErr
+		}
+	}
+	if closeErr := db.catalog.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := db.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (db *DB) join(m member) {
+	db.membersLock.Lock()
+	defer db.membersLock.Unlock()
+	db.members[m] = true
+}
+
+func (db *DB) leave(m member) {
+	db.membersLock.Lock()
+	defer db.membersLock.Unlock()
+	delete(db.members, m)
+}
+
+func (db *DB) participants() []member {
+	db.membersLock.Lock()
+	defer db.membersLock.Unlock()
+	members := make([]member, 0, len(db.members))
+	for m := range db.members {
+		members = append(members, m)
+	}
+	return members
+}
+
+func (db *DB) setTransaction(inTransaction bool) {
+	db.Lock()
+	defer db.Unlock()
+	db.inTransaction = inTransaction
+}
+
+func (db *DB) transacting() bool {
+	db.Lock()
+	defer db.Unlock()
+	return db.inTransaction
+}
+
+// begin saves the changes of the tree made so far, before a transaction of its database begins.
+// The changes made from then on are held until the transaction commits
+func (b *Btree[DataType]) begin() (err error) {
+	defer b.recoverChange(&err)
+	b.changes.holding, b.changes.began, b.changes.logged = true, b.changes.seq, -1
+	// a tree that failed cannot be changed in the transaction either
+	if b.checkOpen() != nil {
+		return nil
+	}
+	b.persist()
+	b.persistence.Begin()
+	return nil
+}
+
+// prepare writes the changes held by the transaction to the change log, before it commits
+func (b *Btree[DataType]) prepare() error {
+	if b.changes.log == nil || len(b.changes.held) == 0 {
+		return nil
+	}
+	var err error
+	if b.changes.logged, err = b.changes.log.Seek(0, io.SeekCurrent); err != nil {
+		return err
+	}
+	for _, change := range b.changes.held {
+		if err = b.writeChange(change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// complete hands the changes held by the transaction to the subscribers, once it committed
+func (b *Btree[DataType]) complete() {
+	held := b.changes.held
+	b.changes.holding, b.changes.held = false, nil
+	b.publish(held...)
+}
+
+// rollback goes back to the tree as its database holds it, once a transaction was rolled back.
+// The pages changed in memory are dropped, and so are the changes held and the failure of a
+// change in the transaction. A transaction the database kept, since it could only write it to
+// its journal, leaves the tree failed until the database is opened again
+func (b *Btree[DataType]) rollback(kept error) {
+	b.changes.holding, b.changes.held = false, nil
+	if b.closed {
+		return
+	}
+	if kept != nil {
+		b.failed = kept
+		return
+	}
+	if b.changes.logged >= 0 {
+		if err := truncateChangeLog(b.changes.log, b.changes.logged); err != nil {
+			b.failed = err
+			return
+		}
+	}
+	b.changes.seq = b.changes.began
+	clear(b.changed)
+	b.rootChanged, b.failed = false, nil
+	if err := b.persistence.Rollback(); err != nil {
+		b.failed = err
+		return
+	}
+	size, err := b.persistence.LoadSize()
+	if err == nil {
+		b.root, err = b.persistence.LoadRoot()
+	}
+	b.size, b.failed = size, err
+}
+
+func (db *DB) has(name string) bool {
+	db.Lock()
+	defer db.Unlock()
+	found, _ := db.catalog.Find(catalogEntry{Name: name})
+	return found
+}
+
+// headerOf returns where the header of the named tree is, adding the tree to the catalog
+// when it is not there and create is set
+func (db *DB) headerOf(name string, create bool) (int64, error) {
+	db.Lock()
+	defer db.Unlock()
+	if found, entry := db.catalog.Find(catalogEntry{Name: name}); found {
+		return entry.Header, nil
+	}
+	if !create {
+		return 0, fmt.Errorf("%w: no tree named %s in %s", ErrNotFound, name, db.path)
+	}
+	header, err := db.file.NewHeader()
+	if err != nil {
+		return 0, err
+	}
+	return header, db.catalog.Add(catalogEntry{Name: name, Header: header})
+}
@@ -0,0 +1,364 @@
+package btree
+
+import (
+	"slices"
+
+	"github.com/mylux/bsistent/constants"
+	"github.com/mylux/bsistent/interfaces"
+	"github.com/samber/lo"
+)
+
+// childRef is a child page along with its subtree count, so that moving children between
+// pages keeps the counts of the subtrees that did not change
+type childRef[DataType any] struct {
+	page  interfaces.Page[DataType]
+	count int64
+}
+
+// removal gathers what a range deletion removes: its items, when the indexes or the change feed
+// need them, and their number
+type removal[DataType any] struct {
+	items   []interfaces.Item[DataType]
+	count   int64
+	collect bool
+}
+
+func (r *removal[DataType]) add(items ...interfaces.Item[DataType]) {
+	r.count += int64(len(items))
+	if r.collect {
+		r.items = append(r.items, items...)
+	}
+}
+
+// DeleteRange removes the items between from and to, both included, and returns how many were
+// removed. The subtrees lying wholly in the range are dropped at once, and only the pages along
+// the paths to both ends of the range are rebalanced
+func (b *Btree[DataType]) DeleteRange(from DataType, to DataType) (removed int64, err error) {
+	defer b.recoverChange(&err)
+	if err := b.checkOpen(); err != nil {
+		return 0, err
+	}
+	if b.readOnly {
+		return 0, ErrReadOnly
+	}
+	lower, upper := b.newItem(from), b.newItem(to)
+	if compareItems(lower, upper) > 0 {
+		return 0, nil
+	}
+	return b.deleteRanges([][2]interfaces.Item[DataType]{{lower, upper}})
+}
+
+// DeletePrefix removes the items Prefix returns for the partial item, along with the expired ones
+// it passes over, and returns how many were removed. Each run of matching items is removed as a range
+func (b *Btree[DataType]) DeletePrefix(partial DataType) (removed int64, err error) {
+	defer b.recoverChange(&err)
+	if err := b.checkOpen(); err != nil {
+		return 0, err
+	}
+	if b.readOnly {
+		return 0, ErrReadOnly
+	}
+	var ranges [][2]interfaces.Item[DataType]
+	it := b.Prefix(partial)
+	for it.advance() {
+		if len(ranges) == 0 || it.prefix != nil && it.prefix.skipped {
+			ranges = append(ranges, [2]interfaces.Item[DataType]{it.current, it.current})
+		} else {
+			ranges[len(ranges)-1][1] = it.current
+		}
+	}
+	if err = it.Err(); err != nil {
+		return 0, err
+	}
+	return b.deleteRanges(ranges)
+}
+
+func (b *Btree[DataType]) deleteRanges(ranges [][2]interfaces.Item[DataType]) (int64, error) {
+	removed := &removal[DataType]{collect: len(b.indexes) > 0 || b.changes.log != nil || len(b.changes.subscribers) > 0}
+	for _, r := range ranges {
+		b.cut(b.root, r[0], r[1], removed)
+		b.collapseRoot()
+	}
+	if removed.count == 0 {
+		return 0, nil
+	}
+	b.size -= removed.count
+	if !removed.collect {
+		// nothing follows the changes, which take their sequence numbers all the same
+		b.changes.seq += uint64(removed.count)
+		b.persist()
+		return removed.count, nil
+	}
+	slices.SortStableFunc(removed.items, compareItems[DataType])
+	var none DataType
+	changes := make([]Change[DataType], len(removed.items))
+	for i, it := range removed.items {
+		changes[i] = b.logChange(Deleted, it.Content(), none)
+	}
+	b.persist()
+	for _, it := range removed.items {
+		if err := b.indexRemove(it.Content()); err != nil {
+			return removed.count, err
+		}
+	}
+	b.publish(changes...)
+	return removed.count, nil
+}
+
+// cut removes the items between from and to from the subtree of the page, where a nil bound
+// leaves that side open. Afterwards every page below it is valid, except for pages left with a
+// single child and no items, whose only child may be short of items as well
+func (b *Btree[DataType]) cut(page interfaces.Page[DataType], from interfaces.Item[DataType], to interfaces.Item[DataType], removed *removal[DataType]) {
+	items := page.Items().ToSlice()
+	lower, upper := 0, len(items)
+	if from != nil {
+		lower = page.Items().LowerSlotFor(from)
+	}
+	if to != nil {
+		upper = page.Items().SlotFor(to)
+	}
+	if page.IsLeaf() {
+		if lower < upper {
+			removed.add(items[lower:upper]...)
+			b.setPage(page, slices.Concat(items[:lower], items[upper:]), nil)
+		}
+		return
+	}
+	kids := b.childrenOf(page)
+	if from != nil && to != nil && lower == upper {
+		b.cut(kids[lower].page, from, to, removed)
+		b.fixChild(page, lower)
+		return
+	}
+	// the children between the ones holding the ends of the range are wholly in it
+	first, end := lower, upper
+	if from != nil {
+		first++
+	}
+	if to == nil {
+		end++
+	}
+	for _, k := range kids[first:end] {
+		b.dropSubtree(k, removed)
+	}
+	if !b.isBPlus() {
+		removed.add(items[lower:upper]...)
+	}
+	remaining := slices.Concat(items[:lower], items[upper:])
+	var edges []interfaces.Page[DataType]
+	switch {
+	case from != nil && to != nil:
+		b.cut(kids[lower].page, from, nil, removed)
+		b.cut(kids[upper].page, nil, to, removed)
+		joined, separator := b.joinSubtrees(kids[lower].page, kids[upper].page)
+		if separator != nil {
+			remaining = slices.Insert(remaining, lower, separator)
+		}
+		kids = slices.Concat(kids[:lower], refsTo(joined), kids[upper+1:])
+		edges = joined
+	case from != nil:
+		b.cut(kids[lower].page, from, nil, removed)
+		kids, edges = kids[:lower+1], []interfaces.Page[DataType]{kids[lower].page}
+	default:
+		b.cut(kids[upper].page, nil, to, removed)
+		kids, edges = kids[upper:], []interfaces.Page[DataType]{kids[upper].page}
+	}
+	b.setPage(page, remaining, kids)
+	b.fixChildren([]interfaces.Page[DataType]{page}, edges)
+}
+
+// joinSubtrees puts together two neighbouring subtrees of the same height, whose items were
+// separated by items now removed. It returns one page, or two and the separator between them
+// when the items do not fit in one
+func (b *Btree[DataType]) joinSubtrees(left interfaces.Page[DataType], right interfaces.Page[DataType]) ([]interfaces.Page[DataType], interfaces.Item[DataType]) {
+	items := slices.Concat(left.Items().ToSlice(), right.Items().ToSlice())
+	var kids []childRef[DataType]
+	var inner []interfaces.Page[DataType]
+	if !left.IsLeaf() {
+		var separator interfaces.Item[DataType]
+		leftKids, rightKids := b.childrenOf(left), b.childrenOf(right)
+		last := len(leftKids) - 1
+		inner, separator = b.joinSubtrees(leftKids[last].page, rightKids[0].page)
+		if separator != nil {
+			items = slices.Insert(items, last, separator)
+		}
+		kids = slices.Concat(leftKids[:last], refsTo(inner), rightKids[1:])
+	}
+	if len(items) <= left.Capacity() {
+		b.count(constants.MetricMerges)
+		b.setPage(left, items, kids)
+		if b.isBPlus() && left.IsLeaf() {
+			b.unlinkLeaf(left, right)
+		}
+		b.dropPage(right)
+		b.fixChildren([]interfaces.Page[DataType]{left}, inner)
+		return []interfaces.Page[DataType]{left}, nil
+	}
+	separator := b.spread(left, right, items, kids)
+	if b.isBPlus() && left.IsLeaf() {
+		// the leaves that were between them are gone
+		left.Next(right.Offset())
+		right.Prev(left.Offset())
+	}
+	b.fixChildren([]interfaces.Page[DataType]{left, right}, inner)
+	return []interfaces.Page[DataType]{left, right}, separator
+}
+
+// fixChildren fixes the given children wherever they are among the children of the pages. Each
+// fix may leave its page one item short, so the pages are fixed in turn by the caller
+func (b *Btree[DataType]) fixChildren(pages []interfaces.Page[DataType], children []interfaces.Page[DataType]) {
+	for _, child := range children {
+		for _, p := range pages {
+			if index := p.Children().LookUp(child); index >= 0 {
+				b.fixChild(p, index)
+				break
+			}
+		}
+	}
+}
+
+// fixChild brings a child short of items back to size by merging it with a sibling, or by
+// sharing their items when they do not fit in one page. The siblings may be one item short
+// at most, as the pages left that way by fixChild itself
+func (b *Btree[DataType]) fixChild(page interfaces.Page[DataType], index int) {
+	kids := b.childrenOf(page)
+	child := kids[index].page
+	if child.Size() >= b.minItems || len(kids) < 2 {
+		return
+	}
+	var lonely interfaces.Page[DataType]
+	if !child.IsLeaf() && child.IsEmpty() {
+		lonely = b.childrenOf(child)[0].page
+	}
+	l := max(index-1, 0)
+	left, right := kids[l].page, kids[l+1].page
+	leaves := b.isBPlus() && left.IsLeaf()
+	items := left.Items().ToSlice()
+	if !leaves {
+		items = append(items, page.Item(l))
+	}
+	items = append(items, right.Items().ToSlice()...)
+	var grandchildren []childRef[DataType]
+	if !left.IsLeaf() {
+		grandchildren = slices.Concat(b.childrenOf(left), b.childrenOf(right))
+	}
+	separators := page.Items().ToSlice()
+	if len(items) <= left.Capacity() {
+		b.count(constants.MetricMerges)
+		b.setPage(left, items, grandchildren)
+		if leaves {
+			b.unlinkLeaf(left, right)
+		}
+		b.dropPage(right)
+		b.setPage(page, slices.Delete(separators, l, l+1), slices.Delete(kids, l+1, l+2))
+	} else {
+		separators[l] = b.spread(left, right, items, grandchildren)
+		b.setPage(page, separators, kids)
+	}
+	// a child with no items had its only child left alone, which may be short of items too
+	if lonely == nil || lonely.Size() >= b.minItems {
+		return
+	}
+	for _, holder := range []interfaces.Page[DataType]{left, right} {
+		if i := holder.Children().LookUp(lonely); i >= 0 {
+			b.fixChild(holder, i)
+			if i = page.Children().LookUp(holder); i >= 0 {
+				b.fixChild(page, i)
+			}
+			return
+		}
+	}
+}
+
+// spread shares the items, and the children, between two neighbouring pages and returns the
+// separator that goes between them
+func (b *Btree[DataType]) spread(left interfaces.Page[DataType], right interfaces.Page[DataType], items []interfaces.Item[DataType], kids []childRef[DataType]) interfaces.Item[DataType] {
+	b.count(constants.MetricRotations)
+	middle := len(items) / 2
+	if b.isBPlus() && left.IsLeaf() {
+		b.setPage(left, items[:middle], nil)
+		b.setPage(right, items[middle:], nil)
+		return b.separatorFor(items[middle])
+	}
+	if kids == nil {
+		b.setPage(left, items[:middle], nil)
+		b.setPage(right, items[middle+1:], nil)
+	} else {
+		b.setPage(left, items[:middle], kids[:middle+1])
+		b.setPage(right, items[middle+1:], kids[middle+1:])
+	}
+	return items[middle]
+}
+
+// collapseRoot replaces a root left with no items by its only child, as often as needed
+func (b *Btree[DataType]) collapseRoot() {
+	for b.root.IsEmpty() && !b.root.IsLeaf() {
+		old := b.root
+		child := b.childrenOf(old)[0].page
+		b.dropPage(old)
+		b.shrink(child)
+	}
+}
+
+// childrenOf returns the children of a page, taking the ones changed in memory over the ones
+// stored, so each page is worked on through a single copy
+func (b *Btree[DataType]) childrenOf(page interfaces.Page[DataType]) []childRef[DataType] {
+	children := page.Children()
+	kids := make([]childRef[DataType], children.Size())
+	for i, offset := range children.Offsets() {
+		child, changed := b.changed[offset]
+		if !changed {
+			child = b.loadChild(page, i)
+		}
+		child.Parent(page)
+		kids[i] = childRef[DataType]{page: child, count: children.Count(i)}
+	}
+	return kids
+}
+
+func (b *Btree[DataType]) dropPage(page interfaces.Page[DataType]) {
+	page.EmptyItems()
+	page.Children([]interfaces.Page[DataType]{})
+	page.ResetParent()
+	b.taintPages(page)
+}
+
+// dropSubtree removes the subtree of a child wholly in the range. Its pages are only loaded when
+// its items are needed, or when there are no subtree counts to tell how many they are. The ones
+// left behind by a copy-on-write tree in a data file of its own are reused once it is opened again
+func (b *Btree[DataType]) dropSubtree(child childRef[DataType], removed *removal[DataType]) {
+	page := child.page
+	if _, changed := b.changed[page.Offset()]; !removed.collect && b.counted && child.count >= 0 && !changed {
+		removed.count += child.count
+		b.dropPage(page)
+		return
+	}
+	if !page.IsLeaf() {
+		for _, k := range b.childrenOf(page) {
+			b.dropSubtree(k, removed)
+		}
+	}
+	if page.IsLeaf() || !b.isBPlus() {
+		removed.add(page.Items().ToSlice()...)
+	}
+	b.dropPage(page)
+}
+
+func (b *Btree[DataType]) setPage(page interfaces.Page[DataType], items []interfaces.Item[DataType], kids []childRef[DataType]) {
+	if len(items) == 0 {
+		page.EmptyItems()
+	} else {
+		page.Items(slices.Clone(items)...)
+	}
+	page.Children(lo.Map(kids, func(k childRef[DataType], _ int) interfaces.Page[DataType] { return k.page }))
+	for i, k := range kids {
+		page.Children().Count(i, k.count)
+	}
+	b.taintPages(page)
+}
+
+func refsTo[DataType any](pages []interfaces.Page[DataType]) []childRef[DataType] {
+	return lo.Map(pages, func(p interfaces.Page[DataType], _ int) childRef[DataType] {
+		return childRef[DataType]{page: p, count: -1}
+	})
+}
@@ -0,0 +1,128 @@
+package btree
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type durabilityMode int
+
+const (
+	noSync durabilityMode = iota
+	syncOnCommit
+	syncPeriodically
+)
+
+// Durability tells when the changes written to the data file are flushed to the disk
+type Durability struct {
+	mode     durabilityMode
+	interval time.Duration
+}
+
+var (
+	// DurabilityNone leaves the flushing to the operating system, Sync and Close
+	DurabilityNone = Durability{mode: noSync}
+	// DurabilityOnCommit flushes the pages and then the header after every change
+	DurabilityOnCommit = Durability{mode: syncOnCommit}
+)
+
+// DurabilityPeriodic flushes the changes in the background, at most once per interval
+func DurabilityPeriodic(interval time.Duration) Durability {
+	return Durability{mode: syncPeriodically, interval: interval}
+}
+
+type periodicSync struct {
+	dirty atomic.Bool
+	stop  chan struct{}
+	done  sync.WaitGroup
+}
+
+func (b *Btree[DataType]) Sync() error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	return b.syncFiles()
+}
+
+func (b *Btree[DataType]) syncFiles() error {
+	if b.changes.log != nil {
+		if err := b.changes.log.Sync(); err != nil {
+			return err
+		}
+	}
+	return b.persistence.Sync()
+}
+
+// commit writes the header once the pages are saved, so it never refers to pages that
+// did not reach the disk
+func (b *Btree[DataType]) commit(pagesSaved bool) error {
+	if pagesSaved && b.durability.mode == syncOnCommit {
+		if err := b.persistence.Sync(); err != nil {
+			return err
+		}
+	}
+	if pagesSaved && b.rootChanged {
+		if err := b.persistRoot(); err != nil {
+			return err
+		}
+	}
+	if err := b.persistSize(); err != nil {
+		return err
+	}
+	if err := b.persistence.Commit(); err != nil {
+		return err
+	}
+	switch b.durability.mode {
+	case syncOnCommit:
+		return b.persistence.Sync()
+	case syncPeriodically:
+		b.syncer.dirty.Store(true)
+	}
+	return nil
+}
+
+func (b *Btree[DataType]) startPeriodicSync() {
+	s := &periodicSync{stop: make(chan struct{})}
+	ticker := time.NewTicker(b.durability.interval)
+	s.done.Add(1)
+	go func() {
+		defer s.done.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if s.dirty.Swap(false) {
+					b.syncFiles()
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	b.syncer = s
+}
+
+func (b *Btree[DataType]) stopPeriodicSync() {
+	if b.syncer != nil {
+		close(b.syncer.stop)
+		b.syncer.done.Wait()
+		b.syncer = nil
+	}
+}
+
+const (
+	defaultFlushPages    = 64
+	defaultFlushInterval = 100 * time.Millisecond
+	defaultMaxDirtyPages = 1024
+)
+
+type WriteBehindOptions struct {
+	// FlushPages starts writing the saved pages once that many are waiting, 64 by default
+	FlushPages int
+	// FlushInterval writes the saved pages at least that often, every 100ms by default
+	FlushInterval time.Duration
+	// MaxDirtyPages makes the changes wait for the saved pages to be written once that many
+	// are waiting, 1024 by default
+	MaxDirtyPages int
+}
@@ -0,0 +1,364 @@
+package btree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mylux/bsistent/constants"
+	"github.com/mylux/bsistent/serialization"
+	"github.com/mylux/bsistent/utils"
+)
+
+type Format int
+
+const (
+	JSONL Format = iota
+	CSV
+)
+
+const csvValueColumn = "value"
+
+type LineError struct {
+	Line int
+	Err  error
+}
+
+type ImportError struct {
+	Lines []LineError
+}
+
+type column struct {
+	name  string
+	index int
+	key   bool
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ImportError) Error() string {
+	messages := make([]string, len(e.Lines))
+	for i := range e.Lines {
+		messages[i] = e.Lines[i].Error()
+	}
+	return fmt.Sprintf("%d invalid line(s): %s", len(e.Lines), strings.Join(messages, "; "))
+}
+
+func (b *Btree[DataType]) Export(w io.Writer, format Format) error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	switch format {
+	case JSONL:
+		return b.exportJSONL(w)
+	case CSV:
+		return b.exportCSV(w)
+	}
+	return fmt.Errorf("unknown export format %d", format)
+}
+
+// Import reads the items written by Export into the tree, adding them with BulkLoad
+func Import[DataType any](b *Btree[DataType], r io.Reader, format Format) error {
+	var values []DataType
+	var lineErrors []LineError
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	var err error
+	if b.readOnly {
+		return ErrReadOnly
+	}
+	switch format {
+	case JSONL:
+		values, lineErrors, err = b.importJSONL(r)
+	case CSV:
+		values, lineErrors, err = b.importCSV(r)
+	default:
+		err = fmt.Errorf("unknown import format %d", format)
+	}
+	if err != nil {
+		return err
+	}
+	if err = b.BulkLoad(values...); err != nil {
+		return err
+	}
+	if len(lineErrors) > 0 {
+		return &ImportError{Lines: lineErrors}
+	}
+	return nil
+}
+
+func (b *Btree[DataType]) exportCSV(w io.Writer) error {
+	columns := b.columns()
+	writer := csv.NewWriter(w)
+	record := make([]string, len(columns))
+	for i, c := range columns {
+		record[i] = c.name
+	}
+	if err := writer.Write(record); err != nil {
+		return err
+	}
+	it := b.Iterate()
+	for it.Next() {
+		value := reflect.ValueOf(it.Value())
+		for i, c := range columns {
+			field := columnValue(value, c)
+			s, err := formatCSVValue(field)
+			if err != nil {
+				return err
+			}
+			record[i] = s
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func (b *Btree[DataType]) exportJSONL(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	it := b.Iterate()
+	for it.Next() {
+		if err := encoder.Encode(it.Value()); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+func (b *Btree[DataType]) importCSV(r io.Reader) ([]DataType, []LineError, error) {
+	var values []DataType
+	var lineErrors []LineError
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read the CSV header: %w", err)
+	}
+	columns, err := b.headerColumns(header)
+	if err != nil {
+		return nil, nil, err
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line, _ := reader.FieldPos(0)
+		if err == nil {
+			var value DataType
+			if value, err = b.parseCSVRecord(columns, record); err == nil {
+				values = append(values, value)
+				continue
+			}
+		} else if !errors.Is(err, csv.ErrFieldCount) {
+			var parseError *csv.ParseError
+			if !errors.As(err, &parseError) {
+				return nil, nil, err
+			}
+			line = parseError.Line
+		}
+		lineErrors = append(lineErrors, LineError{Line: line, Err: err})
+	}
+	return values, lineErrors, nil
+}
+
+func (b *Btree[DataType]) importJSONL(r io.Reader) ([]DataType, []LineError, error) {
+	var values []DataType
+	var lineErrors []LineError
+	reader := bufio.NewReader(r)
+	// an item that fits takes less than this written as JSON, even with every byte escaped,
+	// leaving room for the names of its fields
+	limit := int(b.itemSize)*8 + bufio.MaxScanTokenSize
+	for line := 1; ; line++ {
+		data, tooLong, err := readLine(reader, limit)
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		if tooLong {
+			lineErrors = append(lineErrors, LineError{Line: line, Err: fmt.Errorf("the line is longer than %d bytes", limit)})
+		} else if len(bytes.TrimSpace(data)) > 0 {
+			if value, parseError := b.parseJSONLine(data); parseError != nil {
+				lineErrors = append(lineErrors, LineError{Line: line, Err: parseError})
+			} else {
+				values = append(values, value)
+			}
+		}
+		if err == io.EOF {
+			return values, lineErrors, nil
+		}
+	}
+}
+
+func (b *Btree[DataType]) parseJSONLine(data []byte) (DataType, error) {
+	var zero DataType
+	value := b.newValue()
+	if err := json.Unmarshal(data, value.Addr().Interface()); err != nil {
+		return zero, err
+	}
+	if err := b.checkItem(value); err != nil {
+		return zero, err
+	}
+	return value.Interface().(DataType), nil
+}
+
+// readLine reads the next line. A line longer than the limit is read to its end without
+// being kept, which tooLong tells
+func readLine(reader *bufio.Reader, limit int) (line []byte, tooLong bool, err error) {
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !tooLong {
+			line = append(line, chunk...)
+			if tooLong = len(line) > limit; tooLong {
+				line = nil
+			}
+		}
+		if err != bufio.ErrBufferFull {
+			return line, tooLong, err
+		}
+	}
+}
+
+func (b *Btree[DataType]) checkItem(value reflect.Value) error {
+	if size, err := (&serialization.Serializer{}).SizeOf(value.Interface()); err != nil {
+		return err
+	} else if int64(size) > b.itemSize {
+		return fmt.Errorf("the item takes %d bytes, but items are limited to %d", size, b.itemSize)
+	}
+	if value.IsZero() {
+		return errors.New("the item is empty")
+	}
+	for _, c := range b.columns() {
+		if c.key && columnValue(value, c).IsZero() {
+			return fmt.Errorf("the key field %s is empty", c.name)
+		}
+	}
+	return nil
+}
+
+// columns lists the CSV columns of the tree items, with the key fields first
+func (b *Btree[DataType]) columns() []column {
+	t := b.newValue().Type()
+	if t.Kind() != reflect.Struct {
+		return []column{{name: csvValueColumn, index: -1}}
+	}
+	columns := make([]column, 0, t.NumField())
+	for i := range t.NumField() {
+		isKey, _ := utils.GetFieldTagKey(t.Field(i), constants.BsistentFlags.Tag, constants.BsistentFlags.Key)
+		columns = append(columns, column{name: t.Field(i).Name, index: i, key: isKey})
+	}
+	slices.SortStableFunc(columns, func(c1, c2 column) int {
+		return utils.Ternary(c1.key == c2.key, 0, utils.Ternary(c1.key, -1, 1))
+	})
+	return columns
+}
+
+func (b *Btree[DataType]) headerColumns(header []string) ([]column, error) {
+	available := b.columns()
+	columns := make([]column, len(header))
+	for i, name := range header {
+		found := slices.IndexFunc(available, func(c column) bool { return strings.EqualFold(c.name, strings.TrimSpace(name)) })
+		if found < 0 {
+			return nil, fmt.Errorf("unknown CSV column %q", name)
+		}
+		columns[i] = available[found]
+	}
+	for _, c := range available {
+		if c.key && !slices.ContainsFunc(columns, func(h column) bool { return h.index == c.index }) {
+			return nil, fmt.Errorf("missing CSV key column %q", c.name)
+		}
+	}
+	return columns, nil
+}
+
+func (b *Btree[DataType]) newValue() reflect.Value {
+	t := reflect.TypeFor[DataType]()
+	if t.Kind() == reflect.Interface && b.config.itemType != nil {
+		t = b.config.itemType
+	}
+	return reflect.New(t).Elem()
+}
+
+func (b *Btree[DataType]) parseCSVRecord(columns []column, record []string) (DataType, error) {
+	var zero DataType
+	value := b.newValue()
+	for i, c := range columns {
+		if err := parseCSVValue(record[i], columnValue(value, c)); err != nil {
+			return zero, fmt.Errorf("column %s: %w", c.name, err)
+		}
+	}
+	if err := b.checkItem(value); err != nil {
+		return zero, err
+	}
+	return value.Interface().(DataType), nil
+}
+
+func columnValue(value reflect.Value, c column) reflect.Value {
+	if c.index < 0 {
+		return value
+	}
+	return value.Field(c.index)
+}
+
+func formatCSVValue(v reflect.Value) (string, error) {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits()), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	}
+	data, err := json.Marshal(v.Interface())
+	return string(data), err
+}
+
+func parseCSVValue(s string, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		v.SetInt(n)
+		return err
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		v.SetUint(n)
+		return err
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		v.SetFloat(n)
+		return err
+	case reflect.Bool:
+		n, err := strconv.ParseBool(s)
+		v.SetBool(n)
+		return err
+	}
+	if s == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(s), v.Addr().Interface())
+}
@@ -0,0 +1,401 @@
+package btree
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/mylux/bsistent/constants"
+	"github.com/mylux/bsistent/serialization"
+	"github.com/mylux/bsistent/utils"
+)
+
+const indexTag = "index"
+const uniqueTag = "unique"
+
+// hashes have a fixed length, so the entries of the same value are next to each other
+var lowestHash = strings.Repeat("0", sha256.Size*2)
+
+// indexEntry maps the hash of an indexed value, followed by the hash of the primary key in
+// non-unique indexes, to the primary key of the item
+type indexEntry struct {
+	Key     string `bsistent:"key;maxSize:128"`
+	Primary []byte
+}
+
+type index[DataType any] struct {
+	name   string
+	field  int
+	unique bool
+	// expiry indexes order the items by the expiry held in their ttl field
+	expiry bool
+	tree   *Btree[indexEntry]
+}
+
+// FindBy returns the items whose field indexed under the given name holds the value
+func (b *Btree[DataType]) FindBy(name string, value any) (found []DataType, err error) {
+	defer recoverError(&err)
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+	ix := b.index(name)
+	if ix == nil {
+		return nil, fmt.Errorf("unknown index %q", name)
+	}
+	if ix.tree == nil {
+		return nil, fmt.Errorf("index %q is not built yet, open the btree for writing to build it", name)
+	}
+	v, err := ix.convert(b.itemType(), value)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := hashValue(v)
+	if err != nil {
+		return nil, err
+	}
+	var entries []indexEntry
+	if ix.unique {
+		if found, e := ix.tree.Find(indexEntry{Key: hash}); found {
+			entries = append(entries, e)
+		}
+	} else {
+		it := ix.tree.IterateFrom(indexEntry{Key: hash + lowestHash})
+		for it.Next() && strings.HasPrefix(it.Value().Key, hash) {
+			entries = append(entries, it.Value())
+		}
+		if err = it.Err(); err != nil {
+			return nil, err
+		}
+	}
+	var r []DataType
+	for _, e := range entries {
+		partial, err := b.primaryItem(e.Primary)
+		if err != nil {
+			return nil, err
+		}
+		// the stored value is compared as well, since different values may share a hash
+		if found, item := b.Find(partial); found && reflect.DeepEqual(fieldOf(item, ix.field).Interface(), v.Interface()) {
+			r = append(r, item)
+		}
+	}
+	return r, nil
+}
+
+// RebuildIndexes erases the secondary indexes and fills them again from the items
+func (b *Btree[DataType]) RebuildIndexes() error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if b.readOnly {
+		return ErrReadOnly
+	}
+	for _, ix := range b.indexes {
+		if err := ix.tree.Close(); err != nil {
+			return err
+		}
+		tree, err := b.indexConfig(ix).Reset().make(false)
+		if err != nil {
+			return err
+		}
+		ix.tree = tree
+	}
+	return b.fillIndexes()
+}
+
+// Update replaces the item with the same key, returning ErrNotFound when there is none
+func (b *Btree[DataType]) Update(value DataType) (err error) {
+	defer b.recoverChange(&err)
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if b.readOnly {
+		return ErrReadOnly
+	}
+	newItem := b.newItem(value)
+	if newItem.IsEmpty() {
+		return fmt.Errorf("the item is empty or does not fit in %d bytes", b.itemSize)
+	}
+	page, index, err := b.find(context.Background(), value)
+	if err != nil {
+		return err
+	}
+	if page == nil || b.expired(page.Item(index).Content()) {
+		return ErrNotFound
+	}
+	old := page.Item(index).Content()
+	if err := b.checkUnique(value); err != nil {
+		return err
+	}
+	page.Item(index).Load(value)
+	b.taintPages(page)
+	change := b.logChange(Updated, old, value)
+	b.persist()
+	if err := b.indexRemove(old); err != nil {
+		return err
+	}
+	if err := b.indexAdd(value); err != nil {
+		return err
+	}
+	b.publish(change)
+	return nil
+}
+
+// checkUnique makes sure no other item holds the values of the given ones in unique indexes
+func (b *Btree[DataType]) checkUnique(values ...DataType) error {
+	for _, ix := range b.indexes {
+		if !ix.unique {
+			continue
+		}
+		batch := map[string][]byte{}
+		for _, value := range values {
+			e, err := b.indexEntry(ix, value)
+			if err != nil {
+				return err
+			}
+			primary, inBatch := batch[e.Key]
+			if !inBatch {
+				var found bool
+				var existing indexEntry
+				if found, existing = ix.tree.Find(indexEntry{Key: e.Key}); found {
+					primary, inBatch = existing.Primary, true
+				}
+			}
+			if inBatch && string(primary) != string(e.Primary) {
+				return fmt.Errorf("%w: %s = %v", ErrDuplicate, ix.name, fieldOf(value, ix.field))
+			}
+			batch[e.Key] = e.Primary
+		}
+	}
+	return nil
+}
+
+func (b *Btree[DataType]) closeIndexes() error {
+	var err error
+	for _, ix := range b.indexes {
+		if ix.tree == nil {
+			continue
+		}
+		if closeErr := ix.tree.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (b *Btree[DataType]) fillIndexes() (err error) {
+	defer recoverError(&err)
+	values := make([]DataType, 0, b.Size())
+	// the expired items are indexed as well, until they are swept
+	it := b.Iterate()
+	for it.advance() {
+		values = append(values, it.Value())
+	}
+	if err = it.Err(); err != nil {
+		return err
+	}
+	return b.indexAdd(values...)
+}
+
+func (b *Btree[DataType]) index(name string) *index[DataType] {
+	for _, ix := range b.indexes {
+		if ix.name == name && !ix.expiry {
+			return ix
+		}
+	}
+	return nil
+}
+
+func (b *Btree[DataType]) indexAdd(values ...DataType) error {
+	for _, ix := range b.indexes {
+		entries := make([]indexEntry, 0, len(values))
+		for _, value := range values {
+			if !ix.holds(value) {
+				continue
+			}
+			e, err := b.indexEntry(ix, value)
+			if err != nil {
+				return err
+			}
+			if found, _ := ix.tree.Find(e); !found {
+				entries = append(entries, e)
+			}
+		}
+		if err := ix.tree.BulkLoad(entries...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Btree[DataType]) indexConfig(ix *index[DataType]) *BTConfig[indexEntry] {
+	c := Configuration[indexEntry]().
+		Grade(b.grade).
+		StoragePath(indexPath(b.storagePath, ix.name)).
+		CacheSize(b.config.cacheSize).
+		Durability(b.durability)
+	// the primary key never takes more room than the whole item
+	c.itemSize = int64(utils.ReturnOrPanic(func() (int, error) {
+		return (&serialization.Serializer{}).SizeOf(indexEntry{Key: lowestHash + lowestHash})
+	})) + b.itemSize
+	c.readOnly = b.readOnly
+	c.copyOnWrite = b.copyOnWrite
+	// the indexes hold the primary keys of the items
+	c.key = b.config.key
+	c.writeBehind = b.config.writeBehind
+	if b.config.db != nil {
+		// the indexes of a tree in a database are trees of the database as well
+		c.storagePath = b.storagePath
+		c.db = b.config.db
+		c.name = indexPath(b.config.name, ix.name)
+	}
+	return c
+}
+
+func (b *Btree[DataType]) indexEntry(ix *index[DataType], value DataType) (indexEntry, error) {
+	primary, err := (&serialization.Serializer{}).Serialize(primaryOf(value))
+	if err != nil {
+		return indexEntry{}, err
+	}
+	var hash string
+	if ix.expiry {
+		hash = expiryKey(fieldOf(value, ix.field).Int())
+	} else if hash, err = hashValue(fieldOf(value, ix.field)); err != nil {
+		return indexEntry{}, err
+	}
+	if !ix.unique {
+		primaryHash := sha256.Sum256(primary)
+		hash += hex.EncodeToString(primaryHash[:])
+	}
+	return indexEntry{Key: hash, Primary: primary}, nil
+}
+
+func (b *Btree[DataType]) indexRemove(value DataType) error {
+	for _, ix := range b.indexes {
+		if !ix.holds(value) {
+			continue
+		}
+		e, err := b.indexEntry(ix, value)
+		if err != nil {
+			return err
+		}
+		if err = ix.tree.Delete(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Btree[DataType]) itemType() reflect.Type {
+	t := reflect.TypeFor[DataType]()
+	if t.Kind() == reflect.Interface && b.config.itemType != nil {
+		t = b.config.itemType
+	}
+	return t
+}
+
+// openIndexes opens the trees of the fields tagged with index, filling the ones not found
+func (b *Btree[DataType]) openIndexes() error {
+	t := b.itemType()
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	for i := range t.NumField() {
+		if found, name := utils.GetFieldTagKey(t.Field(i), constants.BsistentFlags.Tag, indexTag); found {
+			unique, _ := utils.GetFieldTagKey(t.Field(i), constants.BsistentFlags.Tag, uniqueTag)
+			b.indexes = append(b.indexes, &index[DataType]{name: utils.Ternary(name == "", t.Field(i).Name, name), field: i, unique: unique})
+		}
+	}
+	if b.ttlField >= 0 {
+		if b.index(expiryIndex) != nil {
+			return fmt.Errorf("index %s is kept for the expiry of the items", expiryIndex)
+		}
+		b.indexes = append(b.indexes, &index[DataType]{name: expiryIndex, field: b.ttlField, expiry: true})
+	}
+	missing := false
+	for _, ix := range b.indexes {
+		c := b.indexConfig(ix)
+		if !c.exists() || b.config.reset {
+			if b.readOnly {
+				continue
+			}
+			missing = true
+			c.reset = true
+		}
+		tree, err := c.make(false)
+		if err != nil {
+			b.closeIndexes()
+			return fmt.Errorf("index %s: %w", ix.name, err)
+		}
+		ix.tree = tree
+	}
+	if missing && b.size > 0 {
+		return b.fillIndexes()
+	}
+	return nil
+}
+
+// primaryItem builds an item with only the primary key, as serialized in the index entries
+func (b *Btree[DataType]) primaryItem(primary []byte) (DataType, error) {
+	value := reflect.New(b.itemType())
+	if err := (&serialization.Serializer{}).Deserialize(primary, value.Interface()); err != nil {
+		var zero DataType
+		return zero, err
+	}
+	return value.Elem().Interface().(DataType), nil
+}
+
+// primaryOf returns the value identifying the item: its key fields, or the whole item
+func primaryOf[DataType any](value DataType) any {
+	return utils.KeepTaggedFields(value, constants.BsistentFlags.Tag, constants.BsistentFlags.Key)
+}
+
+func (ix *index[DataType]) convert(t reflect.Type, value any) (reflect.Value, error) {
+	fieldType := t.Field(ix.field).Type
+	v := reflect.ValueOf(value)
+	if !v.IsValid() || !v.Type().ConvertibleTo(fieldType) {
+		return v, fmt.Errorf("index %s holds %s values, %T given", ix.name, fieldType, value)
+	}
+	return v.Convert(fieldType), nil
+}
+
+// holds tells whether the item has an entry in the index, which is not the case for the items
+// that never expire in expiry indexes
+func (ix *index[DataType]) holds(value DataType) bool {
+	return !ix.expiry || fieldOf(value, ix.field).Int() != 0
+}
+
+func fieldOf[DataType any](value DataType, field int) reflect.Value {
+	return reflect.ValueOf(value).Field(field)
+}
+
+func hashValue(v reflect.Value) (string, error) {
+	b, err := (&serialization.Serializer{}).Serialize(v.Interface())
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(b)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+func indexPath(storagePath string, name string) string {
+	return fmt.Sprintf("%s.%s.index", storagePath, name)
+}
+
+// removeIndexes deletes the index files of a data file, so they are rebuilt when it is opened
+func removeIndexes(storagePath string) error {
+	files, err := filepath.Glob(indexPath(storagePath, "*"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err = os.Remove(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
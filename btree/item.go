@@ -17,6 +17,7 @@ import (
 type BTItem[DataType any] struct {
 	content  DataType
 	capacity int64
+	compare  func(DataType, DataType) int
 }
 
 func (b *BTItem[DataType]) Capacity() int64 {
@@ -27,6 +28,9 @@ func (b *BTItem[DataType]) Compare(j interfaces.Item[DataType]) (int, error) {
 	var r int
 	contentB := b.Content()
 	contentJ := j.Content()
+	if b.compare != nil {
+		return max(-1, min(1, b.compare(contentB, contentJ))), nil
+	}
 	compareFieldsB := utils.GetTaggedFieldValues(contentB, constants.BsistentFlags.Tag, constants.BsistentFlags.Key)
 	compareFieldsJ := utils.GetTaggedFieldValues(contentJ, constants.BsistentFlags.Tag, constants.BsistentFlags.Key)
 	if lcf := len(compareFieldsB); lcf == 0 || lcf != len(compareFieldsJ) {
@@ -92,6 +96,6 @@ func getBytes(s any) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func item[DataType any](capacity int64) interfaces.Item[DataType] {
-	return &BTItem[DataType]{capacity: capacity}
+func item[DataType any](capacity int64, compare ...func(DataType, DataType) int) interfaces.Item[DataType] {
+	return &BTItem[DataType]{capacity: capacity, compare: utils.Coalesce(compare, nil)}
 }
@@ -0,0 +1,141 @@
+package btree
+
+import (
+	"context"
+
+	"github.com/mylux/bsistent/interfaces"
+)
+
+type iteratorFrame[DataType any] struct {
+	page  interfaces.Page[DataType]
+	index int
+}
+
+type Iterator[DataType any] struct {
+	tree    *Btree[DataType]
+	frames  []*iteratorFrame[DataType]
+	current interfaces.Item[DataType]
+	prefix  *prefixScan[DataType]
+	// ctx is checked before every page the iterator loads, and err is what ended the iteration
+	ctx context.Context
+	err error
+}
+
+func iterator[DataType any](ctx context.Context, tree *Btree[DataType], from interfaces.Item[DataType]) *Iterator[DataType] {
+	i := newIterator(ctx, tree)
+	if i.err == nil {
+		i.run(func() { i.seek(tree.Root(), from) })
+	}
+	return i
+}
+
+// newIterator makes an iterator that fails at once on a closed tree or a context already done
+func newIterator[DataType any](ctx context.Context, tree *Btree[DataType]) *Iterator[DataType] {
+	i := &Iterator[DataType]{tree: tree, ctx: ctx}
+	if i.err = tree.checkOpen(); i.err == nil {
+		i.err = ctx.Err()
+	}
+	return i
+}
+
+// Next moves to the next item, passing over the expired ones. The iteration ends once the
+// context is done or a page cannot be read, which Err then tells
+func (i *Iterator[DataType]) Next() (found bool) {
+	if i.err != nil {
+		return false
+	}
+	i.run(func() { found = i.nextLive() })
+	return found && i.err == nil
+}
+
+// run runs a step of the iteration, ending the iteration when the step fails
+func (i *Iterator[DataType]) run(step func()) {
+	defer func() {
+		if i.err != nil {
+			i.frames, i.current = nil, nil
+		}
+	}()
+	defer recoverError(&i.err)
+	step()
+}
+
+func (i *Iterator[DataType]) nextLive() bool {
+	for i.advance() {
+		if !i.tree.expired(i.current.Content()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *Iterator[DataType]) advance() bool {
+	if i.prefix != nil {
+		return i.prefix.next(i)
+	}
+	return i.next()
+}
+
+func (i *Iterator[DataType]) Value() DataType {
+	var r DataType
+	if i.current != nil {
+		r = i.current.Content()
+	}
+	return r
+}
+
+func (i *Iterator[DataType]) next() bool {
+	for len(i.frames) > 0 && i.err == nil {
+		top := i.frames[len(i.frames)-1]
+		if top.index < top.page.Size() {
+			i.current = top.page.Item(top.index)
+			top.index++
+			if !top.page.IsLeaf() {
+				i.seek(i.child(top.page, top.index), nil)
+			}
+			return true
+		}
+		i.frames = i.frames[:len(i.frames)-1]
+		if next := top.page.Next(); i.tree.isBPlus() && next > 0 && i.running() {
+			// B+ leaves are chained, so the scan moves sideways without going back to the internal pages
+			i.frames = append(i.frames, &iteratorFrame[DataType]{page: i.tree.load(next)})
+		}
+	}
+	i.current = nil
+	return false
+}
+
+func (i *Iterator[DataType]) seek(page interfaces.Page[DataType], from interfaces.Item[DataType]) {
+	for page != nil {
+		index, childIndex := 0, 0
+		if from != nil {
+			index = page.Items().LowerSlotFor(from)
+			childIndex = index
+			if i.tree.isBPlus() {
+				childIndex = page.Items().SlotFor(from)
+			}
+		}
+		if page.IsLeaf() || !i.tree.isBPlus() {
+			i.frames = append(i.frames, &iteratorFrame[DataType]{page: page, index: index})
+		}
+		if page.IsLeaf() {
+			return
+		}
+		page = i.child(page, childIndex)
+	}
+}
+
+// child loads the child of the page at the given index, unless the context is done
+func (i *Iterator[DataType]) child(page interfaces.Page[DataType], index int) interfaces.Page[DataType] {
+	if !i.running() {
+		return nil
+	}
+	return i.tree.LoadPageChildren(page).Nth(index)
+}
+
+// running checks the context before a page is loaded, keeping its error once it is done
+func (i *Iterator[DataType]) running() bool {
+	if i.err == nil {
+		i.err = i.ctx.Err()
+	}
+	return i.err == nil
+}
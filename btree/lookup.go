@@ -0,0 +1,156 @@
+package btree
+
+import (
+	"github.com/mylux/bsistent/interfaces"
+)
+
+// Ceil returns the lowest item not lower than the given one
+func (b *Btree[DataType]) Ceil(value DataType) (DataType, bool) {
+	if b.checkOpen() != nil {
+		return contentOf[DataType](nil)
+	}
+	found, ok := b.above(value, false)
+	return b.skipExpired(found, ok, b.successor)
+}
+
+// Floor returns the greatest item not greater than the given one
+func (b *Btree[DataType]) Floor(value DataType) (DataType, bool) {
+	if b.checkOpen() != nil {
+		return contentOf[DataType](nil)
+	}
+	found, ok := b.below(value, false)
+	return b.skipExpired(found, ok, b.predecessor)
+}
+
+func (b *Btree[DataType]) Max() (DataType, bool) {
+	if b.checkOpen() != nil {
+		return contentOf[DataType](nil)
+	}
+	page := b.Root()
+	for !page.IsLeaf() {
+		page = b.loadChild(page, page.Children().Size()-1)
+	}
+	found, ok := contentOf(page.Items().Last())
+	return b.skipExpired(found, ok, b.predecessor)
+}
+
+func (b *Btree[DataType]) Min() (DataType, bool) {
+	if b.checkOpen() != nil {
+		return contentOf[DataType](nil)
+	}
+	page := b.Root()
+	for !page.IsLeaf() {
+		page = b.loadChild(page, 0)
+	}
+	found, ok := contentOf(page.Items().First())
+	return b.skipExpired(found, ok, b.successor)
+}
+
+// Next returns the lowest item greater than the given one
+func (b *Btree[DataType]) Next(value DataType) (DataType, bool) {
+	if b.checkOpen() != nil {
+		return contentOf[DataType](nil)
+	}
+	found, ok := b.successor(value)
+	return b.skipExpired(found, ok, b.successor)
+}
+
+// Prev returns the greatest item lower than the given one
+func (b *Btree[DataType]) Prev(value DataType) (DataType, bool) {
+	if b.checkOpen() != nil {
+		return contentOf[DataType](nil)
+	}
+	found, ok := b.predecessor(value)
+	return b.skipExpired(found, ok, b.predecessor)
+}
+
+// above looks for the lowest item greater than the given one, or equal to it unless strict.
+// Only the pages on the way down are loaded, plus the next leaf of a B+ tree
+func (b *Btree[DataType]) above(value DataType, strict bool) (DataType, bool) {
+	it := b.newItem(value)
+	slotFor := func(page interfaces.Page[DataType]) int {
+		if strict {
+			return page.Items().SlotFor(it)
+		}
+		return page.Items().LowerSlotFor(it)
+	}
+	if b.isBPlus() {
+		leaf := b.leafFor(it)
+		if slot := slotFor(leaf); slot < leaf.Size() {
+			return contentOf(leaf.Item(slot))
+		}
+		if next := leaf.Next(); next > 0 {
+			return contentOf(b.load(next).Items().First())
+		}
+		return contentOf[DataType](nil)
+	}
+	var found interfaces.Item[DataType]
+	for page := b.Root(); ; {
+		slot := slotFor(page)
+		if slot < page.Size() {
+			// the items further down are lower, so they are closer to the given one
+			found = page.Item(slot)
+		}
+		if page.IsLeaf() {
+			return contentOf(found)
+		}
+		page = b.loadChild(page, slot)
+	}
+}
+
+// below looks for the greatest item lower than the given one, or equal to it unless strict
+func (b *Btree[DataType]) below(value DataType, strict bool) (DataType, bool) {
+	it := b.newItem(value)
+	slotFor := func(page interfaces.Page[DataType]) int {
+		if strict {
+			return page.Items().LowerSlotFor(it)
+		}
+		return page.Items().SlotFor(it)
+	}
+	if b.isBPlus() {
+		leaf := b.leafFor(it)
+		if slot := slotFor(leaf); slot > 0 {
+			return contentOf(leaf.Item(slot - 1))
+		}
+		if prev := leaf.Prev(); prev > 0 {
+			return contentOf(b.load(prev).Items().Last())
+		}
+		return contentOf[DataType](nil)
+	}
+	var found interfaces.Item[DataType]
+	for page := b.Root(); ; {
+		slot := slotFor(page)
+		if slot > 0 {
+			found = page.Item(slot - 1)
+		}
+		if page.IsLeaf() {
+			return contentOf(found)
+		}
+		page = b.loadChild(page, slot)
+	}
+}
+
+func (b *Btree[DataType]) predecessor(value DataType) (DataType, bool) {
+	return b.below(value, true)
+}
+
+func (b *Btree[DataType]) successor(value DataType) (DataType, bool) {
+	return b.above(value, true)
+}
+
+// leafFor follows the separators of a B+ tree down to the leaf where the item belongs
+func (b *Btree[DataType]) leafFor(it interfaces.Item[DataType]) interfaces.Page[DataType] {
+	page := b.Root()
+	for !page.IsLeaf() {
+		page = b.loadChild(page, page.Items().SlotFor(it))
+	}
+	return page
+}
+
+func contentOf[DataType any](it interfaces.Item[DataType]) (DataType, bool) {
+	var zero DataType
+	if it == nil {
+		return zero, false
+	}
+	return it.Content(), true
+}
@@ -0,0 +1,15 @@
+package btree
+
+import "time"
+
+// count adds one to a counter of the observer, when there is one
+func (b *Btree[DataType]) count(metric string) {
+	if b.observer != nil {
+		b.observer.Count(metric, 1)
+	}
+}
+
+// observeSince reports the time elapsed since start to the observer
+func (b *Btree[DataType]) observeSince(metric string, start time.Time) {
+	b.observer.Observe(metric, time.Since(start).Seconds())
+}
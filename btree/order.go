@@ -0,0 +1,148 @@
+package btree
+
+import (
+	"fmt"
+
+	"github.com/mylux/bsistent/interfaces"
+	"github.com/samber/lo"
+)
+
+// At returns the item in the given position, counting from 0 in ascending order. The expired
+// items are counted, and returned, until Sweep deletes them
+func (b *Btree[DataType]) At(position int64) (value DataType, err error) {
+	defer recoverError(&err)
+	var zero DataType
+	if err := b.checkOpen(); err != nil {
+		return zero, err
+	}
+	if !b.counted {
+		return zero, ErrNotCounted
+	}
+	if position < 0 || position >= b.size {
+		return zero, ErrNotFound
+	}
+	page := b.Root()
+	for !page.IsLeaf() {
+		index := 0
+		for ; index < page.Children().Size(); index++ {
+			count := page.Children().Count(index)
+			if position < count {
+				break
+			}
+			position -= count
+			if !b.isBPlus() && index < page.Size() {
+				if position == 0 {
+					return page.Item(index).Content(), nil
+				}
+				position--
+			}
+		}
+		if index == page.Children().Size() {
+			return zero, fmt.Errorf("page %d counts fewer items than the tree holds", page.Offset())
+		}
+		page = b.loadChild(page, index)
+	}
+	if it := page.Item(int(position)); it != nil {
+		return it.Content(), nil
+	}
+	return zero, fmt.Errorf("page %d counts more items than it holds", page.Offset())
+}
+
+// CountRange returns how many items are between from and to, both included. The expired items
+// are counted until Sweep deletes them
+func (b *Btree[DataType]) CountRange(from DataType, to DataType) (count int64, err error) {
+	defer recoverError(&err)
+	if err := b.checkOpen(); err != nil {
+		return 0, err
+	}
+	if !b.counted {
+		return 0, ErrNotCounted
+	}
+	count = b.countBelow(b.newItem(to), true) - b.countBelow(b.newItem(from), false)
+	return max(count, 0), nil
+}
+
+// Rank returns the number of items lower than the given one, which is its position when found.
+// The expired items are counted until Sweep deletes them
+func (b *Btree[DataType]) Rank(value DataType) (rank int64, err error) {
+	defer recoverError(&err)
+	if err := b.checkOpen(); err != nil {
+		return 0, err
+	}
+	if !b.counted {
+		return 0, ErrNotCounted
+	}
+	return b.countBelow(b.newItem(value), false), nil
+}
+
+// countBelow counts the items lower than the given one, or not greater than it when inclusive,
+// loading only the pages on its way down
+func (b *Btree[DataType]) countBelow(it interfaces.Item[DataType], inclusive bool) int64 {
+	var count int64
+	page := b.Root()
+	for {
+		slot := lo.Ternary(inclusive, page.Items().SlotFor(it), page.Items().LowerSlotFor(it))
+		if page.IsLeaf() {
+			return count + int64(slot)
+		}
+		childIndex := slot
+		if b.isBPlus() {
+			// the separators are copies of the leaf items, so only the children are counted
+			childIndex = page.Items().SlotFor(it)
+		} else {
+			count += int64(slot)
+		}
+		for i := range childIndex {
+			count += page.Children().Count(i)
+		}
+		page = b.loadChild(page, childIndex)
+	}
+}
+
+// loadChild returns a child page, loading only that one when the children are not fetched
+func (b *Btree[DataType]) loadChild(page interfaces.Page[DataType], index int) interfaces.Page[DataType] {
+	if child := page.Child(index); child != nil {
+		return child
+	}
+	return b.load(page.Children().Offsets()[index])
+}
+
+// subtreeCount works out the number of items under the page, refreshing the counts of its
+// children that changed or were moved from another page
+func (b *Btree[DataType]) subtreeCount(page interfaces.Page[DataType]) int64 {
+	count := lo.Ternary(b.isBPlus() && !page.IsLeaf(), int64(0), int64(page.Size()))
+	children := page.Children()
+	for i, offset := range children.Offsets() {
+		c := children.Count(i)
+		if child, changed := b.changed[offset]; changed {
+			c = b.subtreeCount(child)
+		} else if c < 0 {
+			c = b.subtreeCount(b.load(offset))
+		}
+		children.Count(i, c)
+		count += c
+	}
+	return count
+}
+
+// updateCounts refreshes the counts along the paths from the root to the changed pages. The
+// pages above the changed ones hold counts that changed as well, so they are saved with them
+func (b *Btree[DataType]) updateCounts() {
+	if len(b.changed) == 0 {
+		return
+	}
+	pages := make([]interfaces.Page[DataType], 0, len(b.changed))
+	for _, p := range b.changed {
+		pages = append(pages, p)
+	}
+	for _, p := range pages {
+		for parent := p.Parent(); parent != nil; parent = parent.Parent() {
+			if _, found := b.changed[parent.Offset()]; found {
+				break
+			}
+			b.taintPages(parent)
+		}
+	}
+	b.taintPages(b.root)
+	b.subtreeCount(b.root)
+}
@@ -15,6 +15,8 @@ type BTPage[DataType any] struct {
 	items    []interfaces.Item[DataType]
 	parent   interfaces.Page[DataType]
 	children interfaces.PageChildren[DataType]
+	next     int64
+	prev     int64
 }
 
 func page[DataType any](offset int64, capacity int) interfaces.Page[DataType] {
@@ -132,11 +134,21 @@ func (b *BTPage[DataType]) IsFull() bool {
 	return len(b.items) > b.capacity
 }
 
+func (b *BTPage[DataType]) Next(next ...int64) int64 {
+	if len(next) > 0 {
+		b.next = next[0]
+	}
+	return b.next
+}
+
 func (b *BTPage[DataType]) NotSame(page interfaces.Page[DataType]) bool {
 	return !b.Same(page)
 }
 
-func (b *BTPage[DataType]) Offset() int64 {
+func (b *BTPage[DataType]) Offset(offset ...int64) int64 {
+	if len(offset) > 0 {
+		b.offset = offset[0]
+	}
 	return b.offset
 }
 
@@ -164,6 +176,13 @@ func (b *BTPage[DataType]) ParentSlotFor(sibling interfaces.Page[DataType]) int
 	return -1
 }
 
+func (b *BTPage[DataType]) Prev(prev ...int64) int64 {
+	if len(prev) > 0 {
+		b.prev = prev[0]
+	}
+	return b.prev
+}
+
 func (b *BTPage[DataType]) Same(page interfaces.Page[DataType]) bool {
 	return b.Offset() == page.Offset()
 }
@@ -9,9 +9,12 @@ import (
 	"github.com/samber/lo"
 )
 
+// BTChildPage refers to a child page. Count is the number of items under it when the tree
+// keeps subtree counts, or -1 until it is worked out again
 type BTChildPage[DataType any] struct {
 	Offset int64
 	Page   interfaces.Page[DataType]
+	Count  int64
 }
 
 type BTPageChildren[DataType any] struct {
@@ -27,6 +30,7 @@ func NewPageChildren[DataType any](parent interfaces.Page[DataType], childrenPag
 		children[i] = &BTChildPage[DataType]{
 			Offset: child.Offset(),
 			Page:   child,
+			Count:  -1,
 		}
 	}
 	return &BTPageChildren[DataType]{
@@ -65,6 +69,13 @@ func (b *BTPageChildren[DataType]) ChildFor(item interfaces.Item[DataType]) inte
 	return b.Nth(b.children[0].Page.Parent().Items().SlotFor(item))
 }
 
+func (b *BTPageChildren[DataType]) Count(index int, count ...int64) int64 {
+	if len(count) > 0 {
+		b.children[index].Count = count[0]
+	}
+	return b.children[index].Count
+}
+
 func (b *BTPageChildren[DataType]) First() interfaces.Page[DataType] {
 	return b.Nth(0)
 }
@@ -126,7 +137,7 @@ func (b *BTPageChildren[DataType]) Popped(index int) (int64, interfaces.PageChil
 }
 
 func (b *BTPageChildren[DataType]) Put(offset int64, index ...int) { // NAO ESTA MANTENDO ORDEM!!!
-	nc := &BTChildPage[DataType]{Offset: offset}
+	nc := &BTChildPage[DataType]{Offset: offset, Count: -1}
 	nChildren := len(b.children)
 	if where := utils.Coalesce(index, nChildren); where > len(b.children) {
 		b.children = append(b.children, nc)
@@ -135,6 +146,15 @@ func (b *BTPageChildren[DataType]) Put(offset int64, index ...int) { // NAO ESTA
 	}
 }
 
+// Relocate points the children moved to new offsets at their new place
+func (b *BTPageChildren[DataType]) Relocate(offsets map[int64]int64) {
+	for _, c := range b.children {
+		if offset, moved := offsets[c.Offset]; moved {
+			c.Offset = offset
+		}
+	}
+}
+
 func (b *BTPageChildren[DataType]) Set(parent interfaces.Page[DataType], pages ...interfaces.Page[DataType]) interfaces.PageChildren[DataType] {
 	b.children = make([]*BTChildPage[DataType], len(pages))
 	for i, p := range pages {
@@ -188,5 +208,5 @@ func (b *BTPageChildren[DataType]) Unload() {
 }
 
 func (b *BTPageChildren[DataType]) createChildPage(page interfaces.Page[DataType]) *BTChildPage[DataType] {
-	return &BTChildPage[DataType]{Offset: page.Offset(), Page: page}
+	return &BTChildPage[DataType]{Offset: page.Offset(), Page: page, Count: -1}
 }
@@ -31,6 +31,16 @@ func (i *BTPageItems[DataType]) Lookup(item interfaces.Item[DataType]) int {
 	return -1
 }
 
+func (i *BTPageItems[DataType]) LowerSlotFor(item interfaces.Item[DataType]) int {
+	var it int
+	for it = 0; it < i.page.Size(); it++ {
+		if res, _ := i.Item(it).Compare(item); res >= 0 {
+			return it
+		}
+	}
+	return it
+}
+
 func (i *BTPageItems[DataType]) Pop(index int) interfaces.Item[DataType] {
 	item := i.page.Item(index)
 	currentList := i.ToSlice()
@@ -0,0 +1,174 @@
+package btree
+
+import (
+	"context"
+	"reflect"
+	"strings"
+
+	"github.com/mylux/bsistent/constants"
+	"github.com/mylux/bsistent/utils"
+)
+
+// keyCondition matches a key field of the items, or the whole item when field is -1
+type keyCondition struct {
+	field  int
+	value  reflect.Value
+	prefix bool
+}
+
+// prefixScan walks the items matching a partial item. Keys are ordered by their encoded
+// length before their bytes, so the strings starting with a prefix are found in one run
+// for each length, each run starting at the prefix padded with zero bytes up to the length
+type prefixScan[DataType any] struct {
+	conditions []keyCondition
+	length     int
+	done       bool
+	// skipped tells whether items not matching were passed over since the last match
+	skipped bool
+	// unordered scans go through all the items, as a custom comparator keeps no key order
+	unordered bool
+}
+
+// Prefix returns an iterator over the items whose key fields match the ones set in the partial
+// item, up to the last one set. That last field, or the whole item when it has no key fields,
+// is matched as a prefix when it is a string, so Prefix(Item{Id: "tenant/project/"}) finds
+// every item under that path
+func (b *Btree[DataType]) Prefix(partial DataType) *Iterator[DataType] {
+	return b.prefix(context.Background(), partial)
+}
+
+func (b *Btree[DataType]) prefix(ctx context.Context, partial DataType) *Iterator[DataType] {
+	conditions := keyConditions(reflect.ValueOf(partial))
+	if len(conditions) == 0 {
+		return iterator(ctx, b, nil)
+	}
+	i := newIterator(ctx, b)
+	i.prefix = &prefixScan[DataType]{conditions: conditions, unordered: b.config.compare != nil}
+	if i.err != nil {
+		return i
+	}
+	i.run(func() {
+		if i.prefix.unordered {
+			i.seek(b.Root(), nil)
+		} else if conditions[0].prefix {
+			i.prefix.seek(i, conditions[0].value.Len())
+		} else {
+			i.seek(b.Root(), b.newItem(partial))
+		}
+	})
+	return i
+}
+
+func (s *prefixScan[DataType]) next(i *Iterator[DataType]) bool {
+	s.skipped = false
+	if s.unordered {
+		for i.next() {
+			if s.matches(reflect.ValueOf(i.Value()), s.conditions) {
+				return true
+			}
+			s.skipped = true
+		}
+		return false
+	}
+	first := s.conditions[0]
+	for !s.done && i.next() {
+		content := reflect.ValueOf(i.Value())
+		key := first.of(content)
+		switch {
+		case !first.prefix && !reflect.DeepEqual(key.Interface(), first.value.Interface()):
+			s.done = true
+		case first.prefix && !strings.HasPrefix(key.String(), first.value.String()):
+			// past the matches of this length, the next ones are at least one byte longer
+			s.seek(i, max(key.Len(), s.length+1))
+			s.skipped = true
+		default:
+			s.length = key.Len()
+			if s.matches(content, s.conditions[1:]) {
+				return true
+			}
+			s.skipped = true
+		}
+	}
+	i.current = nil
+	return false
+}
+
+// seek moves the iterator to the first item whose key is as long as length and not lower
+// than the prefix padded to it
+func (s *prefixScan[DataType]) seek(i *Iterator[DataType], length int) {
+	s.length = length
+	i.frames = nil
+	first := s.conditions[0]
+	if length == 0 {
+		i.seek(i.tree.Root(), nil)
+		return
+	}
+	padded := reflect.New(first.value.Type()).Elem()
+	padded.SetString(first.value.String() + strings.Repeat("\x00", length-first.value.Len()))
+	value := reflect.New(i.tree.itemType()).Elem()
+	if first.field < 0 {
+		value.Set(padded)
+	} else {
+		value.Field(first.field).Set(padded)
+	}
+	from := i.tree.newItem(value.Interface().(DataType))
+	// a partial item too big to be stored is longer than any key in the tree
+	if from.IsEmpty() {
+		s.done = true
+		return
+	}
+	i.seek(i.tree.Root(), from)
+}
+
+func (s *prefixScan[DataType]) matches(content reflect.Value, conditions []keyCondition) bool {
+	for _, c := range conditions {
+		value := c.of(content)
+		if c.prefix && !strings.HasPrefix(value.String(), c.value.String()) || !c.prefix && !reflect.DeepEqual(value.Interface(), c.value.Interface()) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c keyCondition) of(content reflect.Value) reflect.Value {
+	if c.field < 0 {
+		return content
+	}
+	return content.Field(c.field)
+}
+
+// keyConditions lists the key fields of the partial item up to the last one that is set
+func keyConditions(partial reflect.Value) []keyCondition {
+	if !partial.IsValid() || partial.IsZero() {
+		return nil
+	}
+	var fields []int
+	if partial.Kind() == reflect.Struct {
+		fields = keyFields(partial.Type())
+	}
+	if len(fields) == 0 {
+		return []keyCondition{{field: -1, value: partial, prefix: partial.Kind() == reflect.String}}
+	}
+	last := -1
+	for i, f := range fields {
+		if !partial.Field(f).IsZero() {
+			last = i
+		}
+	}
+	conditions := make([]keyCondition, last+1)
+	for i, f := range fields[:last+1] {
+		value := partial.Field(f)
+		conditions[i] = keyCondition{field: f, value: value, prefix: i == last && value.Kind() == reflect.String}
+	}
+	return conditions
+}
+
+func keyFields(t reflect.Type) []int {
+	var fields []int
+	for i := range t.NumField() {
+		if found, _ := utils.GetFieldTagKey(t.Field(i), constants.BsistentFlags.Tag, constants.BsistentFlags.Key); found {
+			fields = append(fields, i)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,71 @@
+package btree
+
+import (
+	"fmt"
+
+	"github.com/mylux/bsistent/interfaces"
+	"github.com/mylux/bsistent/utils"
+)
+
+// Snapshot opens a read-only btree over the last committed version of a copy-on-write
+// btree. It is not affected by the changes made afterwards and must be closed to let
+// the pages it reaches be reused
+func (b *Btree[DataType]) Snapshot() (*Btree[DataType], error) {
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+	if b.config.db != nil && b.config.db.transacting() {
+		return nil, fmt.Errorf("snapshots cannot be taken during a transaction")
+	}
+	p, err := b.persistence.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	c := b.config
+	c.readOnly = true
+	c.reset = false
+	// the index files are changed in place, so they cannot follow the snapshot
+	c.skipIndexes = true
+	return btree(&c, p)
+}
+
+// persistCopyOnWrite saves the changed pages and every page above them at new offsets,
+// leaving the committed version untouched until the header points at the new root
+func (b *Btree[DataType]) persistCopyOnWrite() bool {
+	if len(b.changed) == 0 {
+		return false
+	}
+	pages := map[int64]interfaces.Page[DataType]{b.root.Offset(): b.root}
+	for offset, p := range b.changed {
+		if p.NotSame(b.root) {
+			pages[offset] = p
+		}
+	}
+	// the parents refer to their children by offset, so they must be saved again as well
+	for _, p := range b.changed {
+		for parent := p.Parent(); parent != nil; parent = parent.Parent() {
+			if _, found := pages[parent.Offset()]; found {
+				break
+			}
+			pages[parent.Offset()] = parent
+		}
+	}
+	relocated := map[int64]int64{}
+	for offset, p := range pages {
+		if p.IsEmpty() && p.NotSame(b.root) {
+			b.persistence.Release(offset)
+			continue
+		}
+		relocated[offset] = utils.ReturnOrPanic(func() (int64, error) { return b.persistence.Relocate(offset) })
+	}
+	for offset, newOffset := range relocated {
+		p := pages[offset]
+		p.Children().Relocate(relocated)
+		p.Offset(newOffset)
+		utils.PanicOnError(func() error { return b.persistence.Save(p) })
+		p.Children().Unload()
+	}
+	clear(b.changed)
+	b.rootChanged = true
+	return true
+}
@@ -0,0 +1,111 @@
+package btree
+
+import (
+	"math"
+
+	"github.com/mylux/bsistent/interfaces"
+	"github.com/mylux/bsistent/serialization"
+	"github.com/mylux/bsistent/utils"
+)
+
+type StatsOptions struct {
+	// SampleChildren limits how many children of each page are visited, spread evenly among them.
+	// The figures of the pages left out are estimated from the visited ones. Zero visits every page
+	SampleChildren int
+}
+
+type Stats struct {
+	Items          int64
+	Depth          int
+	Pages          int64
+	PagesPerLevel  []int64
+	Leaves         int64
+	MinFill        float64
+	MaxFill        float64
+	AverageFill    float64
+	PageSize       int64
+	DiskBytes      int64
+	PaddingBytes   int64
+	AllocatedPages int64
+	FreePages      int64
+	Sampled        bool
+}
+
+type statsCollector[DataType any] struct {
+	tree      *Btree[DataType]
+	options   StatsOptions
+	stats     *Stats
+	pages     []float64
+	usedBytes float64
+	fills     float64
+}
+
+func (b *Btree[DataType]) Stats(options ...StatsOptions) (stats *Stats, err error) {
+	defer recoverError(&err)
+	if err = b.checkOpen(); err != nil {
+		return nil, err
+	}
+	c := &statsCollector[DataType]{
+		tree:    b,
+		options: utils.Coalesce(options, StatsOptions{}),
+		stats:   &Stats{MinFill: math.Inf(1), PageSize: b.persistence.PageSize()},
+	}
+	c.visit(b.Root(), 0, 1)
+	s := c.stats
+	for _, p := range c.pages {
+		s.PagesPerLevel = append(s.PagesPerLevel, int64(math.Round(p)))
+		s.Pages += int64(math.Round(p))
+	}
+	s.Depth = len(c.pages)
+	s.Leaves = s.PagesPerLevel[s.Depth-1]
+	s.AverageFill = c.fills / float64(s.Pages)
+	s.PaddingBytes = s.Pages*int64(b.Root().Capacity())*b.itemSize - int64(c.usedBytes)
+	if s.DiskBytes, err = b.persistence.DiskSize(); err != nil {
+		return nil, err
+	}
+	if s.AllocatedPages, err = b.persistence.AllocatedPages(); err != nil {
+		return nil, err
+	}
+	s.FreePages = max(0, s.AllocatedPages-s.Pages)
+	return s, nil
+}
+
+// visit accounts for a page and its children. The weight is the number of pages
+// the visited one stands for when the children are sampled
+func (c *statsCollector[DataType]) visit(page interfaces.Page[DataType], level int, weight float64) {
+	if len(c.pages) <= level {
+		c.pages = append(c.pages, 0)
+	}
+	fill := float64(page.Size()) / float64(page.Capacity())
+	c.pages[level] += weight
+	c.fills += fill * weight
+	c.stats.MinFill = min(c.stats.MinFill, fill)
+	c.stats.MaxFill = max(c.stats.MaxFill, fill)
+	if page.IsLeaf() || !c.tree.isBPlus() {
+		c.stats.Items += int64(math.Round(float64(page.Size()) * weight))
+	}
+	for _, it := range page.Items().ToSlice() {
+		size, _ := (&serialization.Serializer{}).SizeOf(it.Content())
+		c.usedBytes += float64(size) * weight
+	}
+	offsets := page.Children().Offsets()
+	sampled := sampleOffsets(offsets, c.options.SampleChildren)
+	if len(sampled) < len(offsets) {
+		c.stats.Sampled = true
+	}
+	childWeight := weight * float64(len(offsets)) / float64(max(1, len(sampled)))
+	for _, offset := range sampled {
+		c.visit(c.tree.load(offset), level+1, childWeight)
+	}
+}
+
+func sampleOffsets(offsets []int64, limit int) []int64 {
+	if limit <= 0 || len(offsets) <= limit {
+		return offsets
+	}
+	r := make([]int64, limit)
+	for i := range limit {
+		r[i] = offsets[i*len(offsets)/limit]
+	}
+	return r
+}
@@ -0,0 +1,116 @@
+package btree
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/mylux/bsistent/constants"
+	"github.com/mylux/bsistent/interfaces"
+	"github.com/mylux/bsistent/utils"
+)
+
+const ttlTag = "ttl"
+
+// expiryIndex names the tree holding the items that expire, ordered by their expiry
+const expiryIndex = "expiry"
+
+// AddWithTTL adds the item, setting its field tagged with ttl to expire after the given time
+func (b *Btree[DataType]) AddWithTTL(value DataType, ttl time.Duration) error {
+	if b.ttlField < 0 {
+		return fmt.Errorf("%s has no field tagged with %s", b.itemType(), ttlTag)
+	}
+	v := reflect.New(b.itemType()).Elem()
+	v.Set(reflect.ValueOf(value))
+	v.Field(b.ttlField).SetInt(time.Now().Add(ttl).UnixNano())
+	return b.Add(v.Interface().(DataType))
+}
+
+// Sweep deletes the expired items and returns how many were deleted. The items are found in
+// the expiry order, so only the expired ones are visited
+func (b *Btree[DataType]) Sweep() (removed int64, err error) {
+	defer b.recoverChange(&err)
+	if err := b.checkOpen(); err != nil {
+		return 0, err
+	}
+	if b.readOnly {
+		return 0, ErrReadOnly
+	}
+	ix := b.expiryIndex()
+	if ix == nil {
+		return 0, nil
+	}
+	until := indexEntry{Key: expiryKey(time.Now().UnixNano()) + strings.Repeat("f", len(lowestHash))}
+	var ranges [][2]interfaces.Item[DataType]
+	it := ix.tree.Iterate()
+	for it.Next() && it.Value().Key <= until.Key {
+		partial, err := b.primaryItem(it.Value().Primary)
+		if err != nil {
+			return 0, err
+		}
+		page, index, err := b.find(context.Background(), partial)
+		if err != nil {
+			return 0, err
+		}
+		if page != nil && b.expired(page.Item(index).Content()) {
+			ranges = append(ranges, [2]interfaces.Item[DataType]{page.Item(index), page.Item(index)})
+		}
+	}
+	if err = it.Err(); err != nil {
+		return 0, err
+	}
+	if _, err := ix.tree.DeleteRange(indexEntry{Key: lowestHash}, until); err != nil {
+		return 0, err
+	}
+	return b.deleteRanges(ranges)
+}
+
+// expired tells whether the item has a time to live and it is over
+func (b *Btree[DataType]) expired(value DataType) bool {
+	if b.ttlField < 0 {
+		return false
+	}
+	expiry := fieldOf(value, b.ttlField).Int()
+	return expiry != 0 && expiry <= time.Now().UnixNano()
+}
+
+func (b *Btree[DataType]) expiryIndex() *index[DataType] {
+	for _, ix := range b.indexes {
+		if ix.expiry {
+			return ix
+		}
+	}
+	return nil
+}
+
+// skipExpired steps from the item found by a lookup until one that has not expired
+func (b *Btree[DataType]) skipExpired(value DataType, found bool, step func(DataType) (DataType, bool)) (DataType, bool) {
+	for found && b.expired(value) {
+		value, found = step(value)
+	}
+	return value, found
+}
+
+// expiryKey orders the expiry times as strings, all having the same length
+func expiryKey(expiry int64) string {
+	return fmt.Sprintf("%020d", expiry)
+}
+
+// ttlFieldOf returns the field tagged with ttl, which holds the expiry of the item as Unix
+// time in nanoseconds, or -1 when there is none
+func ttlFieldOf(t reflect.Type) (int, error) {
+	if t.Kind() != reflect.Struct {
+		return -1, nil
+	}
+	for i := range t.NumField() {
+		if found, _ := utils.GetFieldTagKey(t.Field(i), constants.BsistentFlags.Tag, ttlTag); found {
+			if t.Field(i).Type.Kind() != reflect.Int64 {
+				return -1, fmt.Errorf("field %s is tagged with %s but is not an int64", t.Field(i).Name, ttlTag)
+			}
+			return i, nil
+		}
+	}
+	return -1, nil
+}
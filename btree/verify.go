@@ -0,0 +1,112 @@
+package btree
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mylux/bsistent/interfaces"
+	"github.com/samber/lo"
+)
+
+func (b *Btree[DataType]) Verify() error {
+	return b.verify(context.Background())
+}
+
+func (b *Btree[DataType]) verify(ctx context.Context) (err error) {
+	defer recoverError(&err)
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	count, _, err := b.verifyPage(ctx, b.Root(), nil, nil)
+	if err != nil {
+		return err
+	}
+	if count != b.Size() {
+		return fmt.Errorf("the tree holds %d items, but its recorded size is %d", count, b.Size())
+	}
+	if b.isBPlus() {
+		return b.verifyLeafChain(ctx, count)
+	}
+	return nil
+}
+
+func (b *Btree[DataType]) verifyItemBounds(page interfaces.Page[DataType], lower interfaces.Item[DataType], upper interfaces.Item[DataType]) error {
+	var previous interfaces.Item[DataType]
+	for _, it := range page.Items().ToSlice() {
+		if previous != nil && compareItems(previous, it) > 0 {
+			return fmt.Errorf("page %d is not sorted: %s comes before %s", page.Offset(), previous, it)
+		}
+		if lower != nil && compareItems(it, lower) < 0 {
+			return fmt.Errorf("page %d: item %s is less than its lower bound %s", page.Offset(), it, lower)
+		}
+		if upper != nil && compareItems(it, upper) > 0 {
+			return fmt.Errorf("page %d: item %s is greater than its upper bound %s", page.Offset(), it, upper)
+		}
+		previous = it
+	}
+	return nil
+}
+
+func (b *Btree[DataType]) verifyLeafChain(ctx context.Context, expected int64) error {
+	var count int64
+	var previous int64
+	leaf, _ := b.FindEdgeItem(b.Root())
+	for leaf != nil {
+		if leaf.Prev() != previous {
+			return fmt.Errorf("leaf %d points back to %d instead of %d", leaf.Offset(), leaf.Prev(), previous)
+		}
+		count += int64(leaf.Size())
+		previous = leaf.Offset()
+		if next := leaf.Next(); next > 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			leaf = b.load(next)
+		} else {
+			leaf = nil
+		}
+	}
+	if count != expected {
+		return fmt.Errorf("the leaf chain holds %d items, but the tree holds %d", count, expected)
+	}
+	return nil
+}
+
+func (b *Btree[DataType]) verifyPage(ctx context.Context, page interfaces.Page[DataType], lower interfaces.Item[DataType], upper interfaces.Item[DataType]) (int64, int, error) {
+	if !b.PageIsValid(page) {
+		return 0, 0, fmt.Errorf("page %d holds %d items and %d children", page.Offset(), page.Size(), page.Children().Size())
+	}
+	if err := b.verifyItemBounds(page, lower, upper); err != nil {
+		return 0, 0, err
+	}
+	if page.IsLeaf() {
+		return int64(page.Size()), 1, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	count := lo.Ternary(b.isBPlus(), int64(0), int64(page.Size()))
+	depth := -1
+	for i, child := range b.LoadPageChildren(page).All() {
+		childLower := lo.Ternary(i > 0, page.Item(i-1), lower)
+		childUpper := lo.Ternary(i < page.Size(), page.Item(i), upper)
+		childCount, childDepth, err := b.verifyPage(ctx, child, childLower, childUpper)
+		if err != nil {
+			return 0, 0, err
+		}
+		if depth >= 0 && childDepth != depth {
+			return 0, 0, fmt.Errorf("children of page %d have different depths", page.Offset())
+		}
+		if recorded := page.Children().Count(i); b.counted && recorded != childCount {
+			return 0, 0, fmt.Errorf("page %d counts %d items under child %d, which holds %d", page.Offset(), recorded, i, childCount)
+		}
+		count += childCount
+		depth = childDepth
+	}
+	return count, depth + 1, nil
+}
+
+func compareItems[DataType any](i interfaces.Item[DataType], j interfaces.Item[DataType]) int {
+	r, _ := i.Compare(j)
+	return r
+}
@@ -0,0 +1,177 @@
+package btree
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/mylux/bsistent/constants"
+	"github.com/mylux/bsistent/interfaces"
+	"github.com/mylux/bsistent/utils"
+)
+
+type VisualizationOptions struct {
+	// MaxDepth is the number of levels written, starting at the root. Zero writes all of them
+	MaxDepth int
+	// KeyLength truncates the keys written for each item. Zero writes the whole keys
+	KeyLength int
+}
+
+type pageStructure struct {
+	Offset    int64            `json:"offset"`
+	Items     int              `json:"items"`
+	Capacity  int              `json:"capacity"`
+	Fill      float64          `json:"fill"`
+	Keys      []string         `json:"keys"`
+	Next      int64            `json:"next,omitempty"`
+	Prev      int64            `json:"prev,omitempty"`
+	Truncated int              `json:"truncatedChildren,omitempty"`
+	Children  []*pageStructure `json:"children,omitempty"`
+}
+
+type treeStructure struct {
+	Layout string         `json:"layout"`
+	Size   int64          `json:"size"`
+	Root   *pageStructure `json:"root"`
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `{`, `\{`, `}`, `\}`, `|`, `\|`, `<`, `\<`, `>`, `\>`)
+
+func (b *Btree[DataType]) WriteDOT(w io.Writer, options ...VisualizationOptions) (err error) {
+	defer recoverError(&err)
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	o := utils.Coalesce(options, VisualizationOptions{})
+	var leaves []interfaces.Page[DataType]
+	written := map[int64]bool{}
+	if _, err := fmt.Fprintln(w, "digraph btree {\n\tnode [shape=record];"); err != nil {
+		return err
+	}
+	err = b.visitPages(b.Root(), 1, o, func(page interfaces.Page[DataType], truncated int) error {
+		keys := b.pageKeys(page, o)
+		for i := range keys {
+			keys[i] = dotEscaper.Replace(keys[i])
+		}
+		label := strings.Join(append([]string{fmt.Sprintf("%d", page.Offset()), fillLabel(page)}, keys...), " | ")
+		if _, err := fmt.Fprintf(w, "\tp%d [label=\"{%s}\"];\n", page.Offset(), label); err != nil {
+			return err
+		}
+		written[page.Offset()] = true
+		if truncated > 0 {
+			if _, err := fmt.Fprintf(w, "\tp%d_more [label=\"%d children not shown\", shape=plaintext];\n\tp%d -> p%d_more;\n", page.Offset(), truncated, page.Offset(), page.Offset()); err != nil {
+				return err
+			}
+		}
+		for _, offset := range page.Children().Offsets() {
+			if truncated == 0 {
+				if _, err := fmt.Fprintf(w, "\tp%d -> p%d;\n", page.Offset(), offset); err != nil {
+					return err
+				}
+			}
+		}
+		if b.isBPlus() && page.IsLeaf() {
+			leaves = append(leaves, page)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, leaf := range leaves {
+		if written[leaf.Next()] {
+			if _, err := fmt.Fprintf(w, "\tp%d -> p%d [style=dashed, constraint=false];\n", leaf.Offset(), leaf.Next()); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = fmt.Fprintln(w, "}")
+	return err
+}
+
+func (b *Btree[DataType]) WriteJSONStructure(w io.Writer, options ...VisualizationOptions) (err error) {
+	defer recoverError(&err)
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	o := utils.Coalesce(options, VisualizationOptions{})
+	structures := map[int64]*pageStructure{}
+	err = b.visitPages(b.Root(), 1, o, func(page interfaces.Page[DataType], truncated int) error {
+		s := &pageStructure{
+			Offset:    page.Offset(),
+			Items:     page.Size(),
+			Capacity:  page.Capacity(),
+			Fill:      float64(page.Size()) / float64(page.Capacity()),
+			Keys:      b.pageKeys(page, o),
+			Next:      page.Next(),
+			Prev:      page.Prev(),
+			Truncated: truncated,
+		}
+		structures[page.Offset()] = s
+		if parent := page.Parent(); parent != nil && structures[parent.Offset()] != nil && page.NotSame(b.Root()) {
+			structures[parent.Offset()].Children = append(structures[parent.Offset()].Children, s)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(&treeStructure{
+		Layout: utils.Ternary(b.isBPlus(), "bplus", "classic"),
+		Size:   b.Size(),
+		Root:   structures[b.Root().Offset()],
+	})
+}
+
+func (b *Btree[DataType]) pageKeys(page interfaces.Page[DataType], o VisualizationOptions) []string {
+	keys := make([]string, page.Size())
+	for i, it := range page.Items().ToSlice() {
+		keys[i] = itemKey(it.Content())
+		if runes := []rune(keys[i]); o.KeyLength > 0 && len(runes) > o.KeyLength {
+			keys[i] = string(runes[:o.KeyLength]) + "…"
+		}
+	}
+	return keys
+}
+
+// visitPages walks the pages depth first, parents before their children.
+// Pages below the depth limit are not loaded and their count is given to the visit of their parent instead
+func (b *Btree[DataType]) visitPages(page interfaces.Page[DataType], depth int, o VisualizationOptions, visit func(interfaces.Page[DataType], int) error) error {
+	if o.MaxDepth > 0 && depth >= o.MaxDepth {
+		return visit(page, page.Children().Size())
+	}
+	if err := visit(page, 0); err != nil {
+		return err
+	}
+	for _, child := range b.LoadPageChildren(page).All() {
+		if err := b.visitPages(child, depth+1, o, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fillLabel[DataType any](page interfaces.Page[DataType]) string {
+	return fmt.Sprintf("%d/%d (%.0f%%)", page.Size(), page.Capacity(), float64(page.Size())/float64(page.Capacity())*100)
+}
+
+func itemKey(content any) string {
+	val := reflect.ValueOf(content)
+	if val.Kind() != reflect.Struct {
+		return fmt.Sprint(content)
+	}
+	keys := []string{}
+	for i := range val.NumField() {
+		if found, _ := utils.GetFieldTagKey(val.Type().Field(i), constants.BsistentFlags.Tag, constants.BsistentFlags.Key); found {
+			keys = append(keys, fmt.Sprint(val.Field(i).Interface()))
+		}
+	}
+	if len(keys) == 0 {
+		return fmt.Sprint(content)
+	}
+	return strings.Join(keys, ",")
+}
@@ -13,6 +13,8 @@ type Cache[DataType any] struct {
 	invalidated map[uint32]bool
 	limit       uint32
 	index       uint32
+	// pool keeps the pages instead, along with the ones of the other trees of a database file
+	pool interfaces.PageCache
 }
 
 type Config[DataType any] struct {
@@ -21,7 +23,9 @@ type Config[DataType any] struct {
 }
 
 func (c *Cache[DataType]) Save(pg interfaces.Page[DataType], updateOnly ...bool) {
-	if c.limit > 0 {
+	if c.pool != nil {
+		c.pool.Save(c, pg.Offset(), pg, len(updateOnly) > 0 && updateOnly[0])
+	} else if c.limit > 0 {
 		offset := pg.Offset()
 		index := c.nextIndex()
 		if locationInPool, exists := c.cache[offset]; exists {
@@ -37,8 +41,22 @@ func (c *Cache[DataType]) Save(pg interfaces.Page[DataType], updateOnly ...bool)
 	}
 }
 
+func (c *Cache[DataType]) Release() {
+	if c.pool != nil {
+		c.pool.Release(c)
+		return
+	}
+	c.limit = 0
+	c.pagePool = nil
+	xmaps.Clear(c.cache)
+	xmaps.Clear(c.invalidated)
+	c.index = 0
+}
+
 func (c *Cache[DataType]) Invalidate(offset int64) {
-	if c.limit > 0 {
+	if c.pool != nil {
+		c.pool.Invalidate(offset)
+	} else if c.limit > 0 {
 		if locationInPool, exists := c.cache[offset]; exists {
 			c.pagePool[locationInPool] = c.pageGen()
 			c.invalidated[locationInPool] = true
@@ -52,6 +70,10 @@ func (c *Cache[DataType]) Invalidate(offset int64) {
 }
 
 func (c *Cache[DataType]) Load(offset int64) interfaces.Page[DataType] {
+	if c.pool != nil {
+		pg, _ := c.pool.Load(offset).(interfaces.Page[DataType])
+		return pg
+	}
 	if c.limit > 0 {
 		if locationInPool, exists := c.cache[offset]; exists {
 			return c.pagePool[locationInPool]
@@ -74,6 +96,12 @@ func New[DataType any](config *Config[DataType]) *Cache[DataType] {
 	}
 }
 
+// Shared keeps the pages in the pool, which the caches of the other trees of a database file
+// share. Releasing it drops its own pages only
+func Shared[DataType any](pool interfaces.PageCache) *Cache[DataType] {
+	return &Cache[DataType]{pool: pool}
+}
+
 func generatePagePool[DataType any](limit uint32, pageGen func() interfaces.Page[DataType]) []interfaces.Page[DataType] {
 	r := make([]interfaces.Page[DataType], limit)
 	for i := range limit {
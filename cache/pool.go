@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"sync"
+)
+
+// Pool keeps the pages of the trees sharing a data file up to a single limit, whatever their
+// type. The slots are taken in turn, as the ones of a Cache are
+type Pool struct {
+	sync.Mutex
+	slots []poolSlot
+	pages map[int64]int
+	index int
+}
+
+type poolSlot struct {
+	owner  any
+	offset int64
+	page   any
+}
+
+func NewPool(limit uint32) *Pool {
+	return &Pool{slots: make([]poolSlot, limit), pages: make(map[int64]int, limit)}
+}
+
+func (p *Pool) Load(offset int64) any {
+	p.Lock()
+	defer p.Unlock()
+	if slot, exists := p.pages[offset]; exists {
+		return p.slots[slot].page
+	}
+	return nil
+}
+
+func (p *Pool) Save(owner any, offset int64, page any, updateOnly bool) {
+	p.Lock()
+	defer p.Unlock()
+	if slot, exists := p.pages[offset]; exists {
+		p.slots[slot] = poolSlot{owner: owner, offset: offset, page: page}
+		return
+	}
+	if updateOnly || len(p.slots) == 0 {
+		return
+	}
+	slot := p.index
+	p.index = (p.index + 1) % len(p.slots)
+	if p.slots[slot].page != nil {
+		delete(p.pages, p.slots[slot].offset)
+	}
+	p.slots[slot] = poolSlot{owner: owner, offset: offset, page: page}
+	p.pages[offset] = slot
+}
+
+func (p *Pool) Invalidate(offset int64) {
+	p.Lock()
+	defer p.Unlock()
+	if slot, exists := p.pages[offset]; exists {
+		p.slots[slot] = poolSlot{}
+		delete(p.pages, offset)
+	}
+}
+
+// Release drops the pages of the owner, leaving the ones of the others
+func (p *Pool) Release(owner any) {
+	p.Lock()
+	defer p.Unlock()
+	for offset, slot := range p.pages {
+		if p.slots[slot].owner == owner {
+			p.slots[slot] = poolSlot{}
+			delete(p.pages, offset)
+		}
+	}
+}
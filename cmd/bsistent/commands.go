@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mylux/bsistent/btree"
+)
+
+var infoCommand = &command{
+	usage: "-schema <schema.json> -file <data file> [-sample n]",
+	flags: func(fs *flag.FlagSet) {
+		fs.Int("sample", 0, "visits only n children of each page and estimates the rest (0 visits all pages)")
+	},
+	run: func(i *invocation) error {
+		b, err := i.open()
+		if err != nil {
+			return err
+		}
+		st, err := b.Stats(btree.StatsOptions{SampleChildren: i.flag("sample").Get().(int)})
+		if err != nil {
+			return err
+		}
+		estimated := ""
+		if st.Sampled {
+			estimated = " (estimated)"
+		}
+		fmt.Fprintf(i.stdout, "file:         %s\n", i.file)
+		fmt.Fprintf(i.stdout, "file size:    %d bytes\n", st.DiskBytes)
+		fmt.Fprintf(i.stdout, "page size:    %d bytes\n", st.PageSize)
+		fmt.Fprintf(i.stdout, "root page:    %d\n", b.Root().Offset())
+		fmt.Fprintf(i.stdout, "size:         %d items\n", b.Size())
+		fmt.Fprintf(i.stdout, "items found:  %d%s\n", st.Items, estimated)
+		fmt.Fprintf(i.stdout, "depth:        %d\n", st.Depth)
+		fmt.Fprintf(i.stdout, "pages:        %d%s, %v per level, %d leaves\n", st.Pages, estimated, st.PagesPerLevel, st.Leaves)
+		fmt.Fprintf(i.stdout, "free pages:   %d of %d allocated\n", st.FreePages, st.AllocatedPages)
+		fmt.Fprintf(i.stdout, "fill factor:  %.2f%% average, %.2f%% min, %.2f%% max\n", st.AverageFill*100, st.MinFill*100, st.MaxFill*100)
+		fmt.Fprintf(i.stdout, "padding:      %d bytes\n", st.PaddingBytes)
+		return nil
+	},
+}
+
+var dumpCommand = &command{
+	usage: "-schema <schema.json> -file <data file> [-format text|dot|json] [-depth n] [-key-length n]",
+	flags: func(fs *flag.FlagSet) {
+		fs.String("format", "text", "output format: text, dot (Graphviz) or json")
+		fs.Int("depth", 0, "number of levels to print in the dot and json formats (0 prints all)")
+		fs.Int("key-length", 0, "truncates the keys printed in the dot and json formats (0 prints whole keys)")
+	},
+	run: func(i *invocation) error {
+		b, err := i.open()
+		if err != nil {
+			return err
+		}
+		options := btree.VisualizationOptions{
+			MaxDepth:  i.flag("depth").Get().(int),
+			KeyLength: i.flag("key-length").Get().(int),
+		}
+		switch format := i.flag("format").Get().(string); format {
+		case "text":
+			_, err = fmt.Fprint(i.stdout, b.String())
+			return err
+		case "dot":
+			return b.WriteDOT(i.stdout, options)
+		case "json":
+			return b.WriteJSONStructure(i.stdout, options)
+		default:
+			return fmt.Errorf("unknown format %q", format)
+		}
+	},
+}
+
+var getCommand = &command{
+	usage: "-schema <schema.json> -file <data file> <JSON key>",
+	run: func(i *invocation) error {
+		if i.flags.NArg() != 1 {
+			return i.usageError()
+		}
+		partial, err := i.schema.decode([]byte(i.flags.Arg(0)))
+		if err != nil {
+			return err
+		}
+		b, err := i.open()
+		if err != nil {
+			return err
+		}
+		found, value := b.Find(partial)
+		if !found {
+			return fmt.Errorf("item %s not found", i.flags.Arg(0))
+		}
+		return writeJSONLine(i, value)
+	},
+}
+
+var scanCommand = &command{
+	usage: "-schema <schema.json> -file <data file> [-from <JSON key>] [-limit n]",
+	flags: func(fs *flag.FlagSet) {
+		fs.String("from", "", "JSON key of the first item to print")
+		fs.Int("limit", 0, "maximum number of items to print (0 prints all)")
+	},
+	run: func(i *invocation) error {
+		b, err := i.open()
+		if err != nil {
+			return err
+		}
+		it := b.Iterate()
+		if from := i.flag("from").Get().(string); from != "" {
+			partial, err := i.schema.decode([]byte(from))
+			if err != nil {
+				return err
+			}
+			it = b.IterateFrom(partial)
+		}
+		limit := i.flag("limit").Get().(int)
+		for n := 0; (limit == 0 || n < limit) && it.Next(); n++ {
+			if err := writeJSONLine(i, it.Value()); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+var verifyCommand = &command{
+	usage: "-schema <schema.json> -file <data file>",
+	run: func(i *invocation) error {
+		b, err := i.open()
+		if err != nil {
+			return err
+		}
+		if err := b.Verify(); err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(i.stdout, "%s: ok, %d items\n", i.file, b.Size())
+		return err
+	},
+}
+
+var compactCommand = &command{
+	usage: "-schema <schema.json> -file <data file> [-out <data file>]",
+	flags: func(fs *flag.FlagSet) {
+		fs.String("out", "", "path of the compacted copy (defaults to replacing the data file)")
+	},
+	run: func(i *invocation) error {
+		out := i.flag("out").Get().(string)
+		target := out
+		if out == "" {
+			target = i.file + ".compact"
+			if err := checkCompactInPlace(i.file); err != nil {
+				return err
+			}
+		}
+		if _, err := os.Stat(i.file); err != nil {
+			return err
+		}
+		// the data file is locked exclusively, so nothing changes it before it is replaced
+		b, err := i.openWith(i.schema.config(i.file))
+		if err != nil {
+			return err
+		}
+		compacted, err := b.CompactTo(target)
+		if err != nil {
+			return err
+		}
+		if err := compacted.Close(); err != nil {
+			return err
+		}
+		if out == "" {
+			i.tree = nil
+			if err := b.Close(); err != nil {
+				return err
+			}
+			return os.Rename(target, i.file)
+		}
+		return nil
+	},
+}
+
+// checkCompactInPlace refuses to replace a data file that has secondary indexes or a change log
+// next to it, which the schema does not describe, so they would not follow the compacted file
+func checkCompactInPlace(file string) error {
+	indexes, err := filepath.Glob(file + ".*.index")
+	if err != nil {
+		return err
+	}
+	if len(indexes) > 0 {
+		return fmt.Errorf("%s has secondary indexes (%s), compact it into another file with -out", file, strings.Join(indexes, ", "))
+	}
+	if _, err := os.Stat(file + ".changes"); err == nil {
+		return fmt.Errorf("%s has a change log, compact it into another file with -out", file)
+	}
+	return nil
+}
+
+var exportCommand = &command{
+	usage: "-schema <schema.json> -file <data file> [-format jsonl|csv]",
+	flags: formatFlag,
+	run: func(i *invocation) error {
+		format, err := i.format()
+		if err != nil {
+			return err
+		}
+		b, err := i.open()
+		if err != nil {
+			return err
+		}
+		return b.Export(i.stdout, format)
+	},
+}
+
+var importCommand = &command{
+	usage: "-schema <schema.json> -file <data file> [-format jsonl|csv] [-reset] < items",
+	flags: func(fs *flag.FlagSet) {
+		formatFlag(fs)
+		fs.Bool("reset", false, "erase the data file before importing")
+	},
+	run: func(i *invocation) error {
+		format, err := i.format()
+		if err != nil {
+			return err
+		}
+		c := i.schema.config(i.file)
+		if i.flag("reset").Get().(bool) {
+			c = c.Reset()
+		}
+		b, err := i.openWith(c)
+		if err != nil {
+			return err
+		}
+		return btree.Import(b, i.stdin, format)
+	},
+}
+
+var formats = map[string]btree.Format{
+	"jsonl": btree.JSONL,
+	"csv":   btree.CSV,
+}
+
+func formatFlag(fs *flag.FlagSet) {
+	fs.String("format", "jsonl", "format of the items: jsonl or csv")
+}
+
+func (i *invocation) format() (btree.Format, error) {
+	name := i.flag("format").Get().(string)
+	if f, ok := formats[name]; ok {
+		return f, nil
+	}
+	return 0, fmt.Errorf("unknown format %q", name)
+}
+
+func writeJSONLine(i *invocation, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(i.stdout, string(data))
+	return err
+}
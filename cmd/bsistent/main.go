@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/mylux/bsistent/btree"
+	"golang.org/x/exp/maps"
+)
+
+type command struct {
+	usage string
+	flags func(*flag.FlagSet)
+	run   func(*invocation) error
+}
+
+type invocation struct {
+	tree   *btree.Btree[any]
+	name   string
+	usage  string
+	schema *schema
+	file   string
+	flags  *flag.FlagSet
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+var commands = map[string]*command{
+	"info":    infoCommand,
+	"dump":    dumpCommand,
+	"get":     getCommand,
+	"scan":    scanCommand,
+	"verify":  verifyCommand,
+	"compact": compactCommand,
+	"export":  exportCommand,
+	"import":  importCommand,
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "bsistent: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer) (err error) {
+	if len(args) == 0 || commands[args[0]] == nil {
+		return fmt.Errorf("usage: bsistent <%s> -schema <schema.json> -file <data file> [options]", commandNames())
+	}
+	name, cmd := args[0], commands[args[0]]
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	schemaPath := fs.String("schema", "", "path of the JSON schema describing the items")
+	file := fs.String("file", "", "path of the data file")
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	inv := &invocation{name: name, usage: cmd.usage, file: *file, flags: fs, stdin: stdin, stdout: stdout}
+	if *schemaPath == "" || *file == "" {
+		return inv.usageError()
+	}
+	if inv.schema, err = loadSchema(*schemaPath); err != nil {
+		return err
+	}
+	defer func() {
+		// the library reports unrecoverable storage errors by panicking
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	err = cmd.run(inv)
+	if inv.tree != nil {
+		err = errors.Join(err, inv.tree.Close())
+	}
+	return err
+}
+
+func commandNames() string {
+	names := maps.Keys(commands)
+	slices.Sort(names)
+	r := names[0]
+	for _, n := range names[1:] {
+		r += "|" + n
+	}
+	return r
+}
+
+func (i *invocation) open() (*btree.Btree[any], error) {
+	if _, err := os.Stat(i.file); err != nil {
+		return nil, err
+	}
+	// inspecting commands only take a shared lock, so they can run side by side
+	return i.openWith(i.schema.config(i.file).ReadOnly())
+}
+
+func (i *invocation) openWith(c *btree.BTConfig[any]) (*btree.Btree[any], error) {
+	var err error
+	i.tree, err = btree.Open(i.file, c)
+	return i.tree, err
+}
+
+func (i *invocation) usageError() error {
+	return fmt.Errorf("usage: bsistent %s %s", i.name, i.usage)
+}
+
+func (i *invocation) flag(name string) flag.Getter {
+	return i.flags.Lookup(name).Value.(flag.Getter)
+}
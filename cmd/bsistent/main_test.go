@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSchema = `{
+	"fields": [
+		{"name": "Id", "type": "string", "key": true, "maxSize": 32},
+		{"name": "Age", "type": "int64"}
+	],
+	"grade": 5,
+	"layout": "bplus"
+}`
+
+func setUpCLI(t *testing.T, n int) (string, string) {
+	dir := t.TempDir()
+	schemaPath := filepath.Join(dir, "schema.json")
+	dataPath := filepath.Join(dir, "data")
+	assert.NoError(t, os.WriteFile(schemaPath, []byte(testSchema), 0666))
+	var items strings.Builder
+	for i := range n {
+		fmt.Fprintf(&items, "{\"Id\":\"id%03d\",\"Age\":%d}\n", (i*7)%n, i)
+	}
+	assert.NoError(t, run([]string{"import", "-schema", schemaPath, "-file", dataPath, "-reset"}, strings.NewReader(items.String()), &bytes.Buffer{}))
+	return schemaPath, dataPath
+}
+
+func runCLI(t *testing.T, args ...string) (string, error) {
+	var out bytes.Buffer
+	err := run(args, strings.NewReader(""), &out)
+	return out.String(), err
+}
+
+func TestParseSchema(t *testing.T) {
+	s, err := parseSchema([]byte(testSchema))
+	assert.NoError(t, err)
+	assert.Equal(t, `bsistent:"key;maxSize:32"`, string(s.itemType.Field(0).Tag))
+	_, err = parseSchema([]byte(`{"fields": [{"name": "id", "type": "string"}]}`))
+	assert.Error(t, err)
+	_, err = parseSchema([]byte(`{"type": "complex128"}`))
+	assert.Error(t, err)
+}
+
+func TestGetAndScan(t *testing.T) {
+	schemaPath, dataPath := setUpCLI(t, 100)
+	out, err := runCLI(t, "get", "-schema", schemaPath, "-file", dataPath, `{"Id":"id007"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"Id\":\"id007\",\"Age\":1}\n", out)
+	_, err = runCLI(t, "get", "-schema", schemaPath, "-file", dataPath, `{"Id":"missing"}`)
+	assert.Error(t, err)
+	out, err = runCLI(t, "scan", "-schema", schemaPath, "-file", dataPath, "-from", `{"Id":"id050"}`, "-limit", "2")
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"Id\":\"id050\",\"Age\":50}\n{\"Id\":\"id051\",\"Age\":93}\n", out)
+}
+
+func TestVerifyAndCompact(t *testing.T) {
+	schemaPath, dataPath := setUpCLI(t, 100)
+	_, err := runCLI(t, "verify", "-schema", schemaPath, "-file", dataPath)
+	assert.NoError(t, err)
+	_, err = runCLI(t, "compact", "-schema", schemaPath, "-file", dataPath)
+	assert.NoError(t, err)
+	out, err := runCLI(t, "export", "-schema", schemaPath, "-file", dataPath)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, strings.Count(out, "\n"))
+	// the files following the data file would be left behind by replacing it
+	for _, follower := range []string{dataPath + ".email.index", dataPath + ".changes"} {
+		assert.NoError(t, os.WriteFile(follower, nil, 0666))
+		_, err = runCLI(t, "compact", "-schema", schemaPath, "-file", dataPath)
+		assert.Error(t, err)
+		compacted := filepath.Join(t.TempDir(), "compacted")
+		_, err = runCLI(t, "compact", "-schema", schemaPath, "-file", dataPath, "-out", compacted)
+		assert.NoError(t, err)
+		out, err = runCLI(t, "export", "-schema", schemaPath, "-file", compacted)
+		assert.NoError(t, err)
+		assert.Equal(t, 100, strings.Count(out, "\n"))
+		assert.NoError(t, os.Remove(follower))
+	}
+	_, err = runCLI(t, "info", "-schema", schemaPath, "-file", filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/mylux/bsistent/btree"
+	"github.com/mylux/bsistent/constants"
+)
+
+type schemaField struct {
+	Name    string        `json:"name"`
+	Type    string        `json:"type"`
+	Key     bool          `json:"key"`
+	MaxSize int           `json:"maxSize"`
+	Fields  []schemaField `json:"fields"`
+}
+
+type schema struct {
+	Type            string        `json:"type"`
+	Fields          []schemaField `json:"fields"`
+	Grade           int           `json:"grade"`
+	ItemSize        int64         `json:"itemSize"`
+	Layout          string        `json:"layout"`
+	CacheSize       uint32        `json:"cacheSize"`
+	OrderStatistics bool          `json:"orderStatistics"`
+	itemType        reflect.Type
+}
+
+var scalarTypes = map[string]reflect.Type{
+	"int":     reflect.TypeFor[int](),
+	"int8":    reflect.TypeFor[int8](),
+	"int16":   reflect.TypeFor[int16](),
+	"int32":   reflect.TypeFor[int32](),
+	"int64":   reflect.TypeFor[int64](),
+	"uint":    reflect.TypeFor[uint](),
+	"uint8":   reflect.TypeFor[uint8](),
+	"uint16":  reflect.TypeFor[uint16](),
+	"uint32":  reflect.TypeFor[uint32](),
+	"uint64":  reflect.TypeFor[uint64](),
+	"float32": reflect.TypeFor[float32](),
+	"float64": reflect.TypeFor[float64](),
+	"bool":    reflect.TypeFor[bool](),
+	"string":  reflect.TypeFor[string](),
+}
+
+var layouts = map[string]btree.Layout{
+	"":        btree.Classic,
+	"classic": btree.Classic,
+	"bplus":   btree.BPlus,
+}
+
+func loadSchema(path string) (*schema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseSchema(data)
+}
+
+func parseSchema(data []byte) (*schema, error) {
+	var s schema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	t, err := resolveType(s.Type, s.Fields)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	if _, ok := layouts[s.Layout]; !ok {
+		return nil, fmt.Errorf("invalid schema: unknown layout %q", s.Layout)
+	}
+	s.itemType = t
+	return &s, nil
+}
+
+func resolveType(name string, fields []schemaField) (reflect.Type, error) {
+	if len(fields) > 0 {
+		return structType(fields)
+	}
+	if elem, found := strings.CutPrefix(name, "[]"); found {
+		t, err := resolveType(elem, nil)
+		if err != nil {
+			return nil, err
+		}
+		return reflect.SliceOf(t), nil
+	}
+	if t, ok := scalarTypes[name]; ok {
+		return t, nil
+	}
+	return nil, fmt.Errorf("unsupported type %q", name)
+}
+
+func structType(fields []schemaField) (reflect.Type, error) {
+	structFields := make([]reflect.StructField, len(fields))
+	for i, f := range fields {
+		if f.Name == "" || !unicode.IsUpper([]rune(f.Name)[0]) {
+			return nil, fmt.Errorf("field name %q must start with an upper case letter", f.Name)
+		}
+		t, err := resolveType(f.Type, f.Fields)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.Name, err)
+		}
+		structFields[i] = reflect.StructField{Name: f.Name, Type: t, Tag: f.tag()}
+	}
+	return reflect.StructOf(structFields), nil
+}
+
+func (f schemaField) tag() reflect.StructTag {
+	parts := []string{}
+	if f.Key {
+		parts = append(parts, constants.BsistentFlags.Key)
+	}
+	if f.MaxSize > 0 {
+		parts = append(parts, fmt.Sprintf("%s:%d", constants.BsistentFlags.MaxSize, f.MaxSize))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return reflect.StructTag(fmt.Sprintf(`%s:"%s"`, constants.BsistentFlags.Tag, strings.Join(parts, ";")))
+}
+
+func (s *schema) config(path string) *btree.BTConfig[any] {
+	c := btree.Configuration[any]().
+		StoragePath(path).
+		ItemShape(reflect.Zero(s.itemType).Interface()).
+		Layout(layouts[s.Layout]).
+		CacheSize(s.CacheSize)
+	if s.Grade > 0 {
+		c = c.Grade(s.Grade)
+	}
+	if s.ItemSize > 0 {
+		c = c.ItemSize(s.ItemSize)
+	}
+	if s.OrderStatistics {
+		c = c.OrderStatistics()
+	}
+	return c
+}
+
+func (s *schema) decode(data []byte) (any, error) {
+	v := reflect.New(s.itemType)
+	if err := json.Unmarshal(data, v.Interface()); err != nil {
+		return nil, err
+	}
+	return v.Elem().Interface(), nil
+}
@@ -1,5 +1,7 @@
 package constants
 
+import "errors"
+
 const PrintPrefix = "|-- "
 const PrintSpacing = "    "
 
@@ -14,3 +16,30 @@ var BsistentFlags bsistentFlags = bsistentFlags{
 	Key:     "key",
 	MaxSize: "maxSize",
 }
+
+var ErrAlreadyOpen = errors.New("data file is already open")
+var ErrClosed = errors.New("btree is closed")
+var ErrDuplicate = errors.New("duplicate value in unique index")
+var ErrEncryption = errors.New("data file cannot be decrypted with the given key")
+var ErrLayout = errors.New("data file has another page layout")
+var ErrLocked = errors.New("data file is locked by another process")
+var ErrNotCounted = errors.New("order statistics are not enabled")
+var ErrNotFound = errors.New("item not found")
+var ErrOrdering = errors.New("data file is ordered differently")
+var ErrReadOnly = errors.New("btree is read-only")
+
+// the metrics reported to an Observer, counters unless they are measured in seconds
+const (
+	MetricAdd          = "add.seconds"
+	MetricFind         = "find.seconds"
+	MetricDelete       = "delete.seconds"
+	MetricPageReads    = "page.reads"
+	MetricPageWrites   = "page.writes"
+	MetricBytesWritten = "bytes.written"
+	MetricSplits       = "splits"
+	MetricMerges       = "merges"
+	MetricRotations    = "rotations"
+	MetricCacheHits    = "cache.hits"
+	MetricCacheMisses  = "cache.misses"
+	MetricSync         = "fsync.seconds"
+)
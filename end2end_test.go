@@ -1,13 +1,24 @@
 package main_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"math/rand"
+	"os"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/mylux/bsistent/btree"
 	"github.com/mylux/bsistent/interfaces"
+	"github.com/mylux/bsistent/metrics"
 	"github.com/mylux/bsistent/utils"
 	"github.com/samber/lo"
 	"github.com/stretchr/testify/assert"
@@ -356,3 +367,1785 @@ func TestDeletePreset(t *testing.T) {
 		}
 	}
 }
+
+func iterateAll[T any](it *btree.Iterator[T]) []T {
+	r := []T{}
+	for it.Next() {
+		r = append(r, it.Value())
+	}
+	return r
+}
+
+func setUpTreeOfIntBPlus(numbers []int64) *btree.Btree[int64] {
+	config := btree.Configuration[int64]().Grade(5).ItemSize(8).CacheSize(uint32(cacheSize)).StoragePath("/tmp/unit-test-btree").Layout(btree.BPlus)
+	return setUpTreeOfPredefinedInt(numbers, config)
+}
+
+func TestIterate(t *testing.T) {
+	numbers := generateUniqueInts(treeSize)
+	bt := setUpTreeOfPredefinedInt(numbers, btree.Configuration[int64]().Grade(5).ItemSize(8).CacheSize(uint32(cacheSize)).StoragePath("/tmp/unit-test-btree"))
+	sorted := slices.Clone(numbers)
+	slices.Sort(sorted)
+	assert.Equal(t, sorted, iterateAll(bt.Iterate()))
+	assert.Equal(t, sorted[treeSize/2:], iterateAll(bt.IterateFrom(sorted[treeSize/2])))
+	assert.Equal(t, sorted[treeSize/2+1:], iterateAll(bt.IterateFrom(sorted[treeSize/2]+1)))
+}
+
+func TestBPlusNewTree(t *testing.T) {
+	numbers := generateUniqueInts(treeSize)
+	bt := setUpTreeOfIntBPlus(numbers)
+	assert.Equal(t, treeSize, bt.Size())
+	sorted := slices.Clone(numbers)
+	slices.Sort(sorted)
+	assert.Equal(t, sorted, iterateAll(bt.Iterate()))
+	assert.Equal(t, sorted[treeSize/3:], iterateAll(bt.IterateFrom(sorted[treeSize/3])))
+	for _, number := range numbers {
+		found, value := bt.Find(number)
+		assert.True(t, found)
+		assert.Equal(t, number, value)
+	}
+	found, _ := bt.Find(-1)
+	assert.False(t, found)
+}
+
+func TestBPlusDeleteMany(t *testing.T) {
+	numbers := generateUniqueInts(treeSize)
+	bt := setUpTreeOfIntBPlus(numbers)
+	remaining := slices.Clone(numbers)
+	slices.Sort(remaining)
+	for i, number := range lo.Shuffle(slices.Clone(numbers)) {
+		assert.NoError(t, bt.Delete(number))
+		assert.Equal(t, treeSize-int64(i)-1, bt.Size())
+		found, _ := bt.Find(number)
+		assert.False(t, found)
+		remaining = slices.DeleteFunc(remaining, func(n int64) bool { return n == number })
+		if !assert.Equal(t, remaining, iterateAll(bt.Iterate())) {
+			break
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	bt := setUpTreeOfInt(treeSize, true)
+	assert.NoError(t, bt.Verify())
+	numbers := generateUniqueInts(treeSize)
+	bt = setUpTreeOfIntBPlus(numbers)
+	assert.NoError(t, bt.Verify())
+	// the tree stays valid through the merges and rotations of the deletions
+	for _, number := range lo.Shuffle(slices.Clone(numbers))[:treeSize/2] {
+		assert.NoError(t, bt.Delete(number))
+		if !assert.NoError(t, bt.Verify()) {
+			break
+		}
+	}
+}
+
+func TestBPlusLoadFromDisk(t *testing.T) {
+	numbers := generateUniqueInts(treeSize)
+	setUpTreeOfIntBPlus(numbers)
+	bt := btree.Configuration[int64]().Grade(5).ItemSize(8).CacheSize(uint32(cacheSize)).StoragePath("/tmp/unit-test-btree").Layout(btree.BPlus).Make()
+	sorted := slices.Clone(numbers)
+	slices.Sort(sorted)
+	assert.Equal(t, treeSize, bt.Size())
+	assert.Equal(t, sorted, iterateAll(bt.Iterate()))
+}
+
+func TestBulkLoad(t *testing.T) {
+	for _, layout := range []btree.Layout{btree.Classic, btree.BPlus} {
+		numbers := generateUniqueInts(treeSize)
+		bt := btree.Configuration[int64]().Grade(5).ItemSize(8).CacheSize(uint32(cacheSize)).StoragePath("/tmp/unit-test-btree").Layout(layout).Reset().Make()
+		bt.BulkLoad(numbers[:treeSize/2]...)
+		assert.NoError(t, bt.Verify())
+		bt.BulkLoad(numbers[treeSize/2:]...)
+		assert.NoError(t, bt.Verify())
+		sorted := slices.Clone(numbers)
+		slices.Sort(sorted)
+		assert.Equal(t, treeSize, bt.Size())
+		assert.Equal(t, sorted, iterateAll(bt.Iterate()))
+		reloaded := btree.Configuration[int64]().Grade(5).ItemSize(8).CacheSize(uint32(cacheSize)).StoragePath("/tmp/unit-test-btree").Layout(layout).Make()
+		assert.Equal(t, sorted, iterateAll(reloaded.Iterate()))
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	for _, format := range []btree.Format{btree.JSONL, btree.CSV} {
+		var exported bytes.Buffer
+		bt := setUpTreeOfStruct(treeSize, true)
+		assert.NoError(t, bt.Export(&exported, format))
+		imported := btree.Configuration[treeitem]().Grade(5).ItemShape(treeitem{}).StoragePath("/tmp/unit-test-btree-import").Reset().Make()
+		assert.NoError(t, btree.Import(imported, &exported, format))
+		assert.NoError(t, imported.Verify())
+		assert.Equal(t, iterateAll(bt.Iterate()), iterateAll(imported.Iterate()))
+	}
+}
+
+func TestImportBadLines(t *testing.T) {
+	bt := btree.Configuration[treeitem]().Grade(5).ItemShape(treeitem{}).StoragePath("/tmp/unit-test-btree-import").Reset().Make()
+	oversized := fmt.Sprintf("{\"Id\":\"%s\"}", strings.Repeat("x", 1<<20))
+	err := btree.Import(bt, strings.NewReader("{\"Id\":\"a\",\"SomethingMore\":1}\n{\"Id\":\n{\"SomethingMore\":3}\n"+oversized+"\n{\"Id\":\"b\",\"SomethingMore\":2}\n"+oversized), btree.JSONL)
+	var importError *btree.ImportError
+	assert.ErrorAs(t, err, &importError)
+	assert.Equal(t, []int{2, 3, 4, 6}, lo.Map(importError.Lines, func(e btree.LineError, _ int) int { return e.Line }))
+	assert.Equal(t, int64(2), bt.Size())
+
+	err = btree.Import(bt, strings.NewReader("SomethingMore,Id\n4,c\nfive,d\n6\n"), btree.CSV)
+	assert.ErrorAs(t, err, &importError)
+	assert.Equal(t, []int{3, 4}, lo.Map(importError.Lines, func(e btree.LineError, _ int) int { return e.Line }))
+	assert.Equal(t, int64(3), bt.Size())
+
+	assert.Error(t, btree.Import(bt, strings.NewReader("SomethingMore\n4\n"), btree.CSV))
+}
+
+func TestVisualization(t *testing.T) {
+	var dot, structure bytes.Buffer
+	bt := setUpTreeOfIntBPlus(generateUniqueInts(treeSize))
+	assert.NoError(t, bt.WriteDOT(&dot))
+	assert.True(t, strings.HasPrefix(dot.String(), "digraph btree {"))
+	pages := strings.Count(dot.String(), "[label=")
+	assert.Equal(t, pages-1, strings.Count(dot.String(), "->")-strings.Count(dot.String(), "style=dashed"))
+
+	assert.NoError(t, bt.WriteJSONStructure(&structure, btree.VisualizationOptions{MaxDepth: 1}))
+	var root struct {
+		Size int64
+		Root struct {
+			Items             int
+			Children          []any
+			TruncatedChildren int
+		}
+	}
+	assert.NoError(t, json.Unmarshal(structure.Bytes(), &root))
+	assert.Equal(t, treeSize, root.Size)
+	assert.Empty(t, root.Root.Children)
+	assert.Equal(t, root.Root.Items+1, root.Root.TruncatedChildren)
+}
+
+func TestStats(t *testing.T) {
+	bt := setUpTreeOfInt(treeSize, true)
+	stats, err := bt.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, treeSize, stats.Items)
+	assert.False(t, stats.Sampled)
+	assert.Equal(t, int64(1), stats.PagesPerLevel[0])
+	assert.Equal(t, stats.Leaves, stats.PagesPerLevel[stats.Depth-1])
+	assert.Equal(t, lo.Sum(stats.PagesPerLevel), stats.Pages)
+	assert.LessOrEqual(t, stats.MinFill, stats.AverageFill)
+	assert.LessOrEqual(t, stats.AverageFill, stats.MaxFill)
+	assert.GreaterOrEqual(t, stats.DiskBytes, stats.Pages*stats.PageSize)
+
+	sampled, err := bt.Stats(btree.StatsOptions{SampleChildren: 2})
+	assert.NoError(t, err)
+	assert.True(t, sampled.Sampled)
+	assert.Equal(t, stats.Depth, sampled.Depth)
+	assert.InDelta(t, treeSize, sampled.Items, float64(treeSize)/2)
+}
+
+func TestOpenClose(t *testing.T) {
+	config := btree.Configuration[int64]().Grade(5).ItemSize(8).CacheSize(uint32(cacheSize)).Reset()
+	bt, err := btree.Open("/tmp/unit-test-btree-open", config)
+	assert.NoError(t, err)
+	bt.BulkLoad(generateUniqueInts(treeSize)...)
+	bt.Add(6666)
+
+	_, err = btree.Open("/tmp/unit-test-btree-open", config)
+	assert.ErrorIs(t, err, btree.ErrAlreadyOpen)
+	assert.Panics(t, func() { config.StoragePath("/tmp/unit-test-btree-open").Make() })
+
+	assert.NoError(t, bt.Close())
+	assert.ErrorIs(t, bt.Close(), btree.ErrClosed)
+	assert.ErrorIs(t, bt.Add(7777), btree.ErrClosed)
+	assert.ErrorIs(t, bt.Delete(6666), btree.ErrClosed)
+	assert.ErrorIs(t, bt.BulkLoad(7778, 7779), btree.ErrClosed)
+	_, err = bt.DeleteRange(0, 10000)
+	assert.ErrorIs(t, err, btree.ErrClosed)
+	found, _ := bt.Find(6666)
+	assert.False(t, found)
+	it := bt.Iterate()
+	assert.False(t, it.Next())
+	assert.ErrorIs(t, it.Err(), btree.ErrClosed)
+
+	reopened, err := btree.Open("/tmp/unit-test-btree-open", btree.Configuration[int64]().Grade(5).ItemSize(8))
+	assert.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, treeSize+1, reopened.Size())
+	found, _ = reopened.Find(6666)
+	assert.True(t, found)
+	assert.NoError(t, reopened.Verify())
+}
+
+func TestReadOnly(t *testing.T) {
+	path := "/tmp/unit-test-btree-readonly"
+	writer, err := btree.Open(path, btree.Configuration[int64]().Grade(5).ItemSize(8).Reset())
+	assert.NoError(t, err)
+	assert.NoError(t, writer.BulkLoad(generateUniqueInts(treeSize)...))
+	assert.NoError(t, writer.Close())
+
+	config := btree.Configuration[int64]().Grade(5).ItemSize(8).ReadOnly()
+	reader := config.StoragePath(path).Make()
+	other := config.Make()
+	defer other.Close()
+	assert.Equal(t, treeSize, reader.Size())
+	assert.Equal(t, iterateAll(reader.Iterate()), iterateAll(other.Iterate()))
+	assert.ErrorIs(t, reader.Add(6666), btree.ErrReadOnly)
+	assert.ErrorIs(t, reader.Delete(reader.Root().Item(0).Content()), btree.ErrReadOnly)
+	assert.ErrorIs(t, reader.BulkLoad(6666), btree.ErrReadOnly)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, treeSize, other.Size())
+
+	_, err = btree.Open("/tmp/unit-test-btree-missing", btree.Configuration[int64]().ReadOnly())
+	assert.Error(t, err)
+	_, err = btree.Open(path, btree.Configuration[int64]().ReadOnly().Reset())
+	assert.Error(t, err)
+}
+
+func TestReopenAcrossChanges(t *testing.T) {
+	for _, layout := range []btree.Layout{btree.Classic, btree.BPlus} {
+		for _, cache := range []uint32{0, uint32(cacheSize)} {
+			path := "/tmp/unit-test-btree-reopen"
+			config := func() *btree.BTConfig[int64] {
+				return btree.Configuration[int64]().Grade(5).ItemSize(8).CacheSize(cache).Layout(layout)
+			}
+			bt, err := btree.Open(path, config().Reset())
+			assert.NoError(t, err)
+			assert.NoError(t, bt.Close())
+
+			numbers := generateUniqueInts(treeSize)
+			expected := map[int64]bool{}
+			for round, start := 0, 0; start < len(numbers); round, start = round+1, start+50 {
+				bt, err = btree.Open(path, config())
+				assert.NoError(t, err)
+				for _, n := range numbers[start:min(start+50, len(numbers))] {
+					assert.NoError(t, bt.Add(n))
+					expected[n] = true
+				}
+				if round%2 == 1 {
+					for _, n := range lo.Keys(expected)[:20] {
+						assert.NoError(t, bt.Delete(n))
+						delete(expected, n)
+					}
+				}
+				assert.NoError(t, bt.Close())
+
+				bt, err = btree.Open(path, config())
+				assert.NoError(t, err)
+				assert.NoError(t, bt.Verify(), "layout %d, cache %d, round %d", layout, cache, round)
+				keys := lo.Keys(expected)
+				slices.Sort(keys)
+				assert.Equal(t, keys, iterateAll(bt.Iterate()))
+				assert.NoError(t, bt.Close())
+			}
+		}
+	}
+}
+
+func TestDurability(t *testing.T) {
+	path := "/tmp/unit-test-btree-durability"
+	for _, durability := range []btree.Durability{btree.DurabilityNone, btree.DurabilityOnCommit, btree.DurabilityPeriodic(time.Millisecond)} {
+		bt, err := btree.Open(path, btree.Configuration[int64]().Grade(5).ItemSize(8).Durability(durability).Reset())
+		assert.NoError(t, err)
+		numbers := generateUniqueInts(100)
+		for _, n := range numbers {
+			assert.NoError(t, bt.Add(n))
+		}
+		assert.NoError(t, bt.Delete(numbers[0]))
+		time.Sleep(5 * time.Millisecond)
+		assert.NoError(t, bt.Sync())
+		assert.NoError(t, bt.Close())
+		assert.ErrorIs(t, bt.Sync(), btree.ErrClosed)
+
+		reopened, err := btree.Open(path, btree.Configuration[int64]().Grade(5).ItemSize(8))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(numbers)-1), reopened.Size())
+		assert.NoError(t, reopened.Verify())
+		assert.NoError(t, reopened.Close())
+	}
+	_, err := btree.Open(path, btree.Configuration[int64]().Durability(btree.DurabilityPeriodic(0)))
+	assert.Error(t, err)
+}
+
+func TestSnapshot(t *testing.T) {
+	path := "/tmp/unit-test-btree-snapshot"
+	config := func() *btree.BTConfig[int64] {
+		return btree.Configuration[int64]().Grade(5).ItemSize(8).CacheSize(uint32(cacheSize)).CopyOnWrite()
+	}
+	bt, err := btree.Open(path, config().Reset())
+	assert.NoError(t, err)
+	numbers := generateUniqueInts(treeSize)
+	for _, n := range numbers {
+		assert.NoError(t, bt.Add(n))
+	}
+	expected := slices.Clone(numbers)
+	slices.Sort(expected)
+
+	snapshot, err := bt.Snapshot()
+	assert.NoError(t, err)
+	read := make(chan []int64)
+	go func() { read <- iterateAll(snapshot.Iterate()) }()
+	for _, n := range numbers[:treeSize/2] {
+		assert.NoError(t, bt.Delete(n))
+	}
+	for n := range int64(100) {
+		assert.NoError(t, bt.Add(-n-1))
+	}
+	assert.Equal(t, expected, <-read)
+	assert.Equal(t, treeSize, snapshot.Size())
+	found, _ := snapshot.Find(numbers[0])
+	assert.True(t, found)
+	assert.ErrorIs(t, snapshot.Add(1), btree.ErrReadOnly)
+	assert.NoError(t, snapshot.Verify())
+	assert.NoError(t, bt.Verify())
+	assert.Equal(t, treeSize/2+100, bt.Size())
+
+	// pages are only reused once no snapshot reaches them
+	assert.NoError(t, snapshot.Close())
+	before, err := bt.Stats()
+	assert.NoError(t, err)
+	for n := range int64(100) {
+		assert.NoError(t, bt.Delete(-n-1))
+		assert.NoError(t, bt.Add(-n-1))
+	}
+	after, err := bt.Stats()
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, after.AllocatedPages, before.AllocatedPages+1)
+
+	// the tree stays readable by snapshots opened before it is closed
+	snapshot, err = bt.Snapshot()
+	assert.NoError(t, err)
+	assert.NoError(t, bt.Close())
+	assert.Equal(t, treeSize/2+100, snapshot.Size())
+	assert.NoError(t, snapshot.Verify())
+	assert.NoError(t, snapshot.Close())
+
+	reopened, err := btree.Open(path, config())
+	assert.NoError(t, err)
+	assert.NoError(t, reopened.Verify())
+	assert.Equal(t, treeSize/2+100, reopened.Size())
+	// the pages left behind before it was closed are reused as well
+	before, err = reopened.Stats()
+	assert.NoError(t, err)
+	assert.Positive(t, before.FreePages)
+	for n := range int64(100) {
+		assert.NoError(t, reopened.Delete(-n-1))
+		assert.NoError(t, reopened.Add(-n-1))
+	}
+	after, err = reopened.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, before.AllocatedPages, after.AllocatedPages)
+	assert.NoError(t, reopened.Verify())
+	assert.NoError(t, reopened.Close())
+	reopened, err = btree.Open(path, config())
+	assert.NoError(t, err)
+	assert.NoError(t, reopened.Verify())
+	assert.Equal(t, treeSize/2+100, reopened.Size())
+	assert.NoError(t, reopened.Close())
+
+	_, err = setUpTreeOfInt(0).Snapshot()
+	assert.Error(t, err)
+	_, err = btree.Open(path, config().Layout(btree.BPlus))
+	assert.Error(t, err)
+}
+
+func TestBackupRestore(t *testing.T) {
+	for _, copyOnWrite := range []bool{false, true} {
+		config := btree.Configuration[int64]().Grade(5).ItemSize(8)
+		if copyOnWrite {
+			config.CopyOnWrite()
+		}
+		bt, err := btree.Open("/tmp/unit-test-btree-backup", config.Reset())
+		assert.NoError(t, err)
+		config.Reset()
+		numbers := generateUniqueInts(treeSize)
+		assert.NoError(t, bt.BulkLoad(numbers...))
+		for _, n := range numbers[:treeSize/2] {
+			assert.NoError(t, bt.Delete(n))
+		}
+		expected := iterateAll(bt.Iterate())
+
+		var backup, compacted bytes.Buffer
+		assert.NoError(t, bt.Backup(&backup))
+		assert.NoError(t, bt.Backup(&compacted, btree.BackupOptions{Compact: true}))
+		assert.Less(t, compacted.Len(), backup.Len())
+		assert.NoError(t, bt.BackupTo("/tmp/unit-test-btree-backup-copy"))
+		assert.Error(t, bt.BackupTo("/tmp/unit-test-btree-backup"))
+
+		for _, b := range [][]byte{backup.Bytes(), compacted.Bytes()} {
+			assert.NoError(t, btree.Restore(bytes.NewReader(b), "/tmp/unit-test-btree-restored"))
+			restored, err := btree.Open("/tmp/unit-test-btree-restored", config)
+			assert.NoError(t, err)
+			assert.NoError(t, restored.Verify())
+			assert.Equal(t, expected, iterateAll(restored.Iterate()))
+			assert.ErrorIs(t, btree.Restore(bytes.NewReader(b), "/tmp/unit-test-btree-restored"), btree.ErrAlreadyOpen)
+			assert.NoError(t, restored.Close())
+		}
+		copied, err := btree.Open("/tmp/unit-test-btree-backup-copy", config)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, iterateAll(copied.Iterate()))
+		assert.NoError(t, copied.Close())
+
+		corrupted := slices.Clone(backup.Bytes())
+		corrupted[len(corrupted)/2]++
+		assert.Error(t, btree.Restore(bytes.NewReader(corrupted), "/tmp/unit-test-btree-restored"))
+		assert.Error(t, btree.Restore(bytes.NewReader(backup.Bytes()[:backup.Len()-10]), "/tmp/unit-test-btree-restored"))
+		assert.Error(t, btree.Restore(strings.NewReader("not a backup"), "/tmp/unit-test-btree-restored"))
+		restored, err := btree.Open("/tmp/unit-test-btree-restored", config)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(expected)), restored.Size())
+		assert.NoError(t, restored.Close())
+		assert.NoError(t, bt.Close())
+	}
+}
+
+func TestChangeFeed(t *testing.T) {
+	path := "/tmp/unit-test-btree-changes"
+	config := func() *btree.BTConfig[treeitem] {
+		return btree.Configuration[treeitem]().Grade(5).ItemShape(treeitem{}).ChangeLog()
+	}
+	bt, err := btree.Open(path, config().Reset())
+	assert.NoError(t, err)
+	var seen []btree.Change[treeitem]
+	cancel := bt.OnChange(func(c btree.Change[treeitem]) { seen = append(seen, c) })
+	assert.NoError(t, bt.Add(treeitem{Id: "a", SomethingMore: 1}))
+	assert.NoError(t, bt.BulkLoad(treeitem{Id: "c", SomethingMore: 3}, treeitem{Id: "b", SomethingMore: 2}))
+	assert.NoError(t, bt.Delete(treeitem{Id: "a"}))
+	assert.NoError(t, bt.Delete(treeitem{Id: "missing"}))
+	cancel()
+	assert.NoError(t, bt.Add(treeitem{Id: "d", SomethingMore: 4}))
+	assert.Equal(t, []btree.Change[treeitem]{
+		{Seq: 1, Op: btree.Inserted, New: treeitem{Id: "a", SomethingMore: 1}},
+		{Seq: 2, Op: btree.Inserted, New: treeitem{Id: "b", SomethingMore: 2}},
+		{Seq: 3, Op: btree.Inserted, New: treeitem{Id: "c", SomethingMore: 3}},
+		{Seq: 4, Op: btree.Deleted, Old: treeitem{Id: "a", SomethingMore: 1}},
+	}, seen)
+	assert.NoError(t, bt.Close())
+
+	// a line cut by a crash is dropped when the log is opened again
+	log, err := os.OpenFile(path+".changes", os.O_APPEND|os.O_WRONLY, 0)
+	assert.NoError(t, err)
+	_, err = log.WriteString(`{"seq":6,"op":"ins`)
+	assert.NoError(t, err)
+	assert.NoError(t, log.Close())
+
+	bt, err = btree.Open(path, config())
+	assert.NoError(t, err)
+	assert.NoError(t, bt.Add(treeitem{Id: "e", SomethingMore: 5}))
+	it, err := bt.Changes(3)
+	assert.NoError(t, err)
+	var resumed []btree.Change[treeitem]
+	for it.Next() {
+		resumed = append(resumed, it.Value())
+	}
+	assert.NoError(t, it.Err())
+	assert.NoError(t, it.Close())
+	assert.Equal(t, []btree.Change[treeitem]{
+		{Seq: 4, Op: btree.Deleted, Old: treeitem{Id: "a", SomethingMore: 1}},
+		{Seq: 5, Op: btree.Inserted, New: treeitem{Id: "d", SomethingMore: 4}},
+		{Seq: 6, Op: btree.Inserted, New: treeitem{Id: "e", SomethingMore: 5}},
+	}, resumed)
+	assert.NoError(t, bt.Close())
+
+	_, err = setUpTreeOfInt(0).Changes(0)
+	assert.Error(t, err)
+}
+
+func TestChangeLogReconciled(t *testing.T) {
+	path := "/tmp/unit-test-btree-changes-reconciled"
+	config := func() *btree.BTConfig[treeitem] {
+		return btree.Configuration[treeitem]().Grade(5).ItemShape(treeitem{}).ChangeLog()
+	}
+	bt, err := btree.Open(path, config().Reset())
+	assert.NoError(t, err)
+	for i := range 20 {
+		assert.NoError(t, bt.Add(treeitem{Id: fmt.Sprintf("item-%02d", i), SomethingMore: int64(i)}))
+	}
+	assert.NoError(t, bt.Update(treeitem{Id: "item-05", SomethingMore: 50}))
+	_, err = bt.DeleteRange(treeitem{Id: "item-10"}, treeitem{Id: "item-12"})
+	assert.NoError(t, err)
+	assert.NoError(t, bt.Close())
+
+	// the changes are logged before the tree saves them, so a crash in between leaves them at
+	// the end of the log, and they are dropped when the tree is opened again
+	log, err := os.OpenFile(path+".changes", os.O_APPEND|os.O_WRONLY, 0)
+	assert.NoError(t, err)
+	for _, line := range []string{
+		`{"seq":25,"op":"inserted","new":{"Id":"item-99","SomethingMore":99}}`,
+		`{"seq":26,"op":"updated","old":{"Id":"item-06","SomethingMore":6},"new":{"Id":"item-06","SomethingMore":60}}`,
+		`{"seq":27,"op":"deleted","old":{"Id":"item-07","SomethingMore":7}}`,
+	} {
+		_, err = log.WriteString(line + "\n")
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, log.Close())
+
+	bt, err = btree.Open(path, config())
+	assert.NoError(t, err)
+	assert.NoError(t, bt.Add(treeitem{Id: "item-20", SomethingMore: 20}))
+	it, err := bt.Changes(20)
+	assert.NoError(t, err)
+	var logged []btree.Change[treeitem]
+	for it.Next() {
+		logged = append(logged, it.Value())
+	}
+	assert.NoError(t, it.Err())
+	assert.NoError(t, it.Close())
+	assert.Equal(t, []btree.Change[treeitem]{
+		{Seq: 21, Op: btree.Updated, Old: treeitem{Id: "item-05", SomethingMore: 5}, New: treeitem{Id: "item-05", SomethingMore: 50}},
+		{Seq: 22, Op: btree.Deleted, Old: treeitem{Id: "item-10", SomethingMore: 10}},
+		{Seq: 23, Op: btree.Deleted, Old: treeitem{Id: "item-11", SomethingMore: 11}},
+		{Seq: 24, Op: btree.Deleted, Old: treeitem{Id: "item-12", SomethingMore: 12}},
+		{Seq: 25, Op: btree.Inserted, New: treeitem{Id: "item-20", SomethingMore: 20}},
+	}, logged)
+	assert.NoError(t, bt.Close())
+}
+
+type user struct {
+	Id    string `bsistent:"key;maxSize:32"`
+	Email string `bsistent:"index:email;unique;maxSize:64"`
+	Team  int64  `bsistent:"index"`
+}
+
+func TestSecondaryIndex(t *testing.T) {
+	path := "/tmp/unit-test-btree-index"
+	config := func() *btree.BTConfig[user] {
+		return btree.Configuration[user]().Grade(5).ItemShape(user{})
+	}
+	bt, err := btree.Open(path, config().Reset())
+	assert.NoError(t, err)
+	users := make([]user, 60)
+	for i := range users {
+		users[i] = user{Id: fmt.Sprintf("u%02d", i), Email: fmt.Sprintf("u%02d@example.com", i), Team: int64(i % 4)}
+	}
+	assert.NoError(t, bt.BulkLoad(users[:30]...))
+	for _, u := range users[30:] {
+		assert.NoError(t, bt.Add(u))
+	}
+	found, err := bt.FindBy("email", "u42@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []user{users[42]}, found)
+	found, err = bt.FindBy("Team", 3)
+	assert.NoError(t, err)
+	assert.Len(t, found, 15)
+
+	assert.ErrorIs(t, bt.Add(user{Id: "other", Email: "u01@example.com"}), btree.ErrDuplicate)
+	assert.ErrorIs(t, bt.BulkLoad(user{Id: "x1", Email: "x@example.com"}, user{Id: "x2", Email: "x@example.com"}), btree.ErrDuplicate)
+	assert.ErrorIs(t, bt.Update(user{Id: "u05", Email: "u06@example.com"}), btree.ErrDuplicate)
+	assert.ErrorIs(t, bt.Update(user{Id: "missing", Email: "m@example.com"}), btree.ErrNotFound)
+
+	assert.NoError(t, bt.Update(user{Id: "u05", Email: "new@example.com", Team: 9}))
+	found, _ = bt.FindBy("email", "u05@example.com")
+	assert.Empty(t, found)
+	found, _ = bt.FindBy("email", "new@example.com")
+	assert.Equal(t, []user{{Id: "u05", Email: "new@example.com", Team: 9}}, found)
+	found, _ = bt.FindBy("Team", 1)
+	assert.Len(t, found, 14)
+
+	assert.NoError(t, bt.Delete(user{Id: "u42"}))
+	found, _ = bt.FindBy("email", "u42@example.com")
+	assert.Empty(t, found)
+	assert.NoError(t, bt.Add(user{Id: "u99", Email: "u42@example.com"}))
+	_, err = bt.FindBy("missing", 1)
+	assert.Error(t, err)
+	_, err = bt.FindBy("Team", "text")
+	assert.Error(t, err)
+	assert.NoError(t, bt.Close())
+
+	// a lost index is rebuilt from the items when the tree is opened again
+	assert.NoError(t, os.Remove(path+".Team.index"))
+	bt, err = btree.Open(path, config())
+	assert.NoError(t, err)
+	found, _ = bt.FindBy("Team", 2)
+	assert.Len(t, found, 14)
+	assert.NoError(t, bt.Close())
+
+	bt, err = btree.Open(path, config().ReadOnly())
+	assert.NoError(t, err)
+	found, _ = bt.FindBy("email", "u42@example.com")
+	assert.Equal(t, []user{{Id: "u99", Email: "u42@example.com"}}, found)
+	assert.ErrorIs(t, bt.Update(users[0]), btree.ErrReadOnly)
+	assert.NoError(t, bt.Close())
+
+	// the items are found again by all their key fields
+	roles := btree.Configuration[role]().Grade(5).ItemShape(role{}).StoragePath(path).Reset().Make()
+	assert.NoError(t, roles.BulkLoad(role{"red", "ann", "lead"}, role{"red", "bob", "dev"}, role{"blue", "ann", "dev"}))
+	byRole, err := roles.FindBy("Role", "dev")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []role{{"red", "bob", "dev"}, {"blue", "ann", "dev"}}, byRole)
+	assert.NoError(t, roles.Close())
+}
+
+type role struct {
+	Team string `bsistent:"key;maxSize:16"`
+	Name string `bsistent:"key;maxSize:16"`
+	Role string `bsistent:"index;maxSize:16"`
+}
+
+type member struct {
+	Team string `bsistent:"key;maxSize:16"`
+	Name string `bsistent:"key;maxSize:16"`
+}
+
+func TestPrefix(t *testing.T) {
+	for _, layout := range []btree.Layout{btree.Classic, btree.BPlus} {
+		bt := btree.Configuration[treeitem]().Grade(5).ItemShape(treeitem{}).Layout(layout).StoragePath("/tmp/unit-test-btree-prefix").Reset().Make()
+		var all []treeitem
+		for i := range 300 {
+			id := fmt.Sprintf("t%d/p%d/%d", i%3, i%7, rand.Intn(100000))
+			if found, _ := bt.Find(treeitem{Id: id}); !found {
+				assert.NoError(t, bt.Add(treeitem{Id: id, SomethingMore: int64(i)}))
+				all = append(all, treeitem{Id: id, SomethingMore: int64(i)})
+			}
+		}
+		for _, prefix := range []string{"t1/p3/", "t2/", "t0/p6/1", "t3/", "t1/p3/x"} {
+			var expected []string
+			for _, item := range all {
+				if strings.HasPrefix(item.Id, prefix) {
+					expected = append(expected, item.Id)
+				}
+			}
+			var got []string
+			for it := bt.Prefix(treeitem{Id: prefix}); it.Next(); {
+				got = append(got, it.Value().Id)
+			}
+			assert.ElementsMatch(t, expected, got, prefix)
+		}
+		assert.Len(t, iterateAll(bt.Prefix(treeitem{})), len(all))
+		assert.NoError(t, bt.Close())
+	}
+
+	members := btree.Configuration[member]().Grade(5).ItemShape(member{}).StoragePath("/tmp/unit-test-btree-prefix").Reset().Make()
+	for _, m := range []member{{"red", "ann"}, {"blue", "bob"}, {"red", "abe"}, {"redder", "amy"}, {"red", "carl"}} {
+		assert.NoError(t, members.Add(m))
+	}
+	assert.ElementsMatch(t, []member{{"red", "ann"}, {"red", "abe"}, {"red", "carl"}, {"redder", "amy"}}, iterateAll(members.Prefix(member{Team: "red"})))
+	// the leading fields must be equal, only the last one set is matched as a prefix
+	assert.ElementsMatch(t, []member{{"red", "ann"}, {"red", "abe"}}, iterateAll(members.Prefix(member{Team: "red", Name: "a"})))
+	assert.NoError(t, members.Close())
+}
+
+func TestOrderStatistics(t *testing.T) {
+	for _, layout := range []btree.Layout{btree.Classic, btree.BPlus} {
+		for _, cache := range []uint32{0, 40} {
+			config := func() *btree.BTConfig[int64] {
+				c := btree.Configuration[int64]().Grade(5).ItemSize(8).CacheSize(cache).Layout(layout).OrderStatistics()
+				if layout == btree.Classic && cache > 0 {
+					c = c.CopyOnWrite()
+				}
+				return c
+			}
+			bt, err := btree.Open("/tmp/unit-test-btree-order", config().Reset())
+			assert.NoError(t, err)
+			numbers := generateUniqueInts(treeSize)
+			assert.NoError(t, bt.BulkLoad(numbers[:treeSize/2]...))
+			for _, n := range numbers[treeSize/2:] {
+				assert.NoError(t, bt.Add(n))
+			}
+			for _, n := range numbers[:treeSize/5] {
+				assert.NoError(t, bt.Delete(n))
+			}
+			assert.NoError(t, bt.Close())
+
+			bt, err = btree.Open("/tmp/unit-test-btree-order", config())
+			assert.NoError(t, err)
+			assert.NoError(t, bt.Verify())
+			sorted := slices.Clone(numbers[treeSize/5:])
+			slices.Sort(sorted)
+			for i, n := range sorted {
+				rank, err := bt.Rank(n)
+				assert.NoError(t, err)
+				assert.Equal(t, int64(i), rank)
+				at, err := bt.At(int64(i))
+				assert.NoError(t, err)
+				assert.Equal(t, n, at)
+			}
+			rank, _ := bt.Rank(sorted[10] + 1)
+			assert.Equal(t, int64(11), rank)
+			count, err := bt.CountRange(sorted[20], sorted[119])
+			assert.NoError(t, err)
+			assert.Equal(t, int64(100), count)
+			count, _ = bt.CountRange(numbers[0], numbers[0])
+			assert.Zero(t, count)
+			_, err = bt.At(int64(len(sorted)))
+			assert.ErrorIs(t, err, btree.ErrNotFound)
+			assert.NoError(t, bt.Close())
+		}
+	}
+	_, err := setUpTreeOfInt(0).Rank(1)
+	assert.ErrorIs(t, err, btree.ErrNotCounted)
+}
+
+func TestLeafLinksStored(t *testing.T) {
+	pageSizes := map[btree.Layout]int64{}
+	for _, layout := range []btree.Layout{btree.Classic, btree.BPlus} {
+		path := fmt.Sprintf("/tmp/unit-test-btree-links-%d", layout)
+		bt, err := btree.Open(path, btree.Configuration[int64]().Grade(5).ItemSize(8).Layout(layout).Reset())
+		assert.NoError(t, err)
+		for n := range int64(100) {
+			assert.NoError(t, bt.Add(n+1))
+		}
+		stats, err := bt.Stats()
+		assert.NoError(t, err)
+		pageSizes[layout] = stats.PageSize
+		assert.NoError(t, bt.Close())
+		bt, err = btree.Open(path, btree.Configuration[int64]().Grade(5).ItemSize(8).Layout(layout))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(100), bt.Size())
+		assert.NoError(t, bt.Verify())
+		assert.NoError(t, bt.Close())
+	}
+	// only the pages of the B+ layout hold the links between the leaves
+	assert.Less(t, pageSizes[btree.Classic], pageSizes[btree.BPlus])
+}
+
+func TestOrderStatisticsRecorded(t *testing.T) {
+	path := "/tmp/unit-test-btree-order-recorded"
+	for _, counted := range []bool{false, true} {
+		config := func(counted bool) *btree.BTConfig[int64] {
+			c := btree.Configuration[int64]().Grade(5).ItemSize(8)
+			if counted {
+				c = c.OrderStatistics()
+			}
+			return c
+		}
+		bt, err := btree.Open(path, config(counted).Reset())
+		assert.NoError(t, err)
+		for _, n := range []int64{1, 2, 3} {
+			assert.NoError(t, bt.Add(n))
+		}
+		assert.NoError(t, bt.Close())
+		// the subtree counts are recorded in the data file, which is left as it was
+		_, err = btree.Open(path, config(!counted))
+		assert.ErrorIs(t, err, btree.ErrLayout)
+		bt, err = btree.Open(path, config(counted))
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{1, 2, 3}, iterateAll(bt.Iterate()))
+		assert.NoError(t, bt.Verify())
+		assert.NoError(t, bt.Close())
+	}
+}
+
+func TestNeighbourLookups(t *testing.T) {
+	for _, layout := range []btree.Layout{btree.Classic, btree.BPlus} {
+		bt := btree.Configuration[int64]().Grade(5).ItemSize(8).Layout(layout).StoragePath("/tmp/unit-test-btree-lookup").Reset().Make()
+		_, found := bt.Min()
+		assert.False(t, found)
+		numbers := make([]int64, 0, treeSize)
+		for _, n := range generateUniqueInts(treeSize) {
+			// even numbers only, so the odd ones fall between two items
+			numbers = append(numbers, n*2)
+		}
+		assert.NoError(t, bt.BulkLoad(numbers...))
+		slices.Sort(numbers)
+		first, last := numbers[0], numbers[len(numbers)-1]
+		lowest, _ := bt.Min()
+		highest, _ := bt.Max()
+		assert.Equal(t, first, lowest)
+		assert.Equal(t, last, highest)
+		for i, n := range numbers {
+			v, _ := bt.Floor(n)
+			assert.Equal(t, n, v)
+			v, _ = bt.Floor(n + 1)
+			assert.Equal(t, n, v)
+			v, _ = bt.Ceil(n - 1)
+			assert.Equal(t, n, v)
+			if i > 0 {
+				v, _ = bt.Prev(n)
+				assert.Equal(t, numbers[i-1], v)
+			}
+			if i < len(numbers)-1 {
+				v, _ = bt.Next(n)
+				assert.Equal(t, numbers[i+1], v)
+			}
+		}
+		_, found = bt.Prev(first)
+		assert.False(t, found)
+		_, found = bt.Floor(first - 1)
+		assert.False(t, found)
+		_, found = bt.Next(last)
+		assert.False(t, found)
+		_, found = bt.Ceil(last + 1)
+		assert.False(t, found)
+		assert.NoError(t, bt.Close())
+	}
+}
+
+func caseInsensitive(a treeitem, b treeitem) int {
+	return strings.Compare(strings.ToLower(a.Id), strings.ToLower(b.Id))
+}
+
+func TestComparator(t *testing.T) {
+	path := "/tmp/unit-test-btree-comparator"
+	for _, layout := range []btree.Layout{btree.Classic, btree.BPlus} {
+		config := func() *btree.BTConfig[treeitem] {
+			return btree.Configuration[treeitem]().Grade(5).ItemShape(treeitem{}).Layout(layout).Compare(caseInsensitive)
+		}
+		bt, err := btree.Open(path, config().Reset())
+		assert.NoError(t, err)
+		for _, id := range []string{"delta", "Alpha", "charlie", "Echo", "bravo"} {
+			assert.NoError(t, bt.Add(treeitem{Id: id}))
+		}
+		for i := range 100 {
+			assert.NoError(t, bt.Add(treeitem{Id: fmt.Sprintf("Z%03d", 99-i)}))
+		}
+		assert.NoError(t, bt.Verify())
+		ids := lo.Map(iterateAll(bt.Iterate())[:5], func(it treeitem, _ int) string { return it.Id })
+		assert.Equal(t, []string{"Alpha", "bravo", "charlie", "delta", "Echo"}, ids)
+		found, item := bt.Find(treeitem{Id: "ECHO"})
+		assert.True(t, found)
+		assert.Equal(t, "Echo", item.Id)
+		assert.Len(t, iterateAll(bt.Prefix(treeitem{Id: "Z01"})), 10)
+		assert.NoError(t, bt.Close())
+
+		// the ordering is recorded in the data file
+		_, err = btree.Open(path, btree.Configuration[treeitem]().Grade(5).ItemShape(treeitem{}).Layout(layout))
+		assert.ErrorIs(t, err, btree.ErrOrdering)
+		_, err = btree.Open(path, config().Compare(caseInsensitive, "another"))
+		assert.ErrorIs(t, err, btree.ErrOrdering)
+		// and so is the layout, with the default ordering as well
+		_, err = btree.Open(path, config().Layout(utils.Ternary(layout == btree.BPlus, btree.Classic, btree.BPlus)))
+		assert.ErrorIs(t, err, btree.ErrLayout)
+		plain := btree.Configuration[treeitem]().Grade(5).ItemShape(treeitem{}).Layout(layout)
+		bt, err = btree.Open(path+".plain", plain.Reset())
+		assert.NoError(t, err)
+		assert.NoError(t, bt.Close())
+		_, err = btree.Open(path+".plain", btree.Configuration[treeitem]().Grade(5).ItemShape(treeitem{}).Layout(utils.Ternary(layout == btree.BPlus, btree.Classic, btree.BPlus)))
+		assert.ErrorIs(t, err, btree.ErrLayout)
+		bt, err = btree.Open(path, config())
+		assert.NoError(t, err)
+		assert.NoError(t, bt.BackupTo(path+".backup"))
+		assert.NoError(t, bt.Close())
+		bt, err = btree.Open(path+".backup", config())
+		assert.NoError(t, err)
+		assert.Equal(t, int64(105), bt.Size())
+		assert.NoError(t, bt.Verify())
+		assert.NoError(t, bt.Close())
+	}
+
+	greater := func(a, b int64) bool { return a > b }
+	// an anonymous function changes its name along with the code around it, so it must be named
+	_, err := btree.Open(path, btree.Configuration[int64]().Grade(5).ItemSize(8).Less(greater).Reset())
+	assert.Error(t, err)
+	descending, err := btree.Open(path, btree.Configuration[int64]().Grade(5).ItemSize(8).Less(greater, "descending").Reset())
+	assert.NoError(t, err)
+	assert.NoError(t, descending.BulkLoad(3, 1, 2))
+	assert.Equal(t, []int64{3, 2, 1}, iterateAll(descending.Iterate()))
+	assert.NoError(t, descending.Close())
+}
+
+func TestDeleteRange(t *testing.T) {
+	for _, layout := range []btree.Layout{btree.Classic, btree.BPlus} {
+		for _, counted := range []bool{false, true} {
+			config := func() *btree.BTConfig[int64] {
+				c := btree.Configuration[int64]().Grade(5).ItemSize(8).CacheSize(uint32(cacheSize)).Layout(layout)
+				if counted {
+					c = c.OrderStatistics()
+				}
+				return c
+			}
+			bt, err := btree.Open("/tmp/unit-test-btree-range", config().Reset())
+			assert.NoError(t, err)
+			numbers := generateUniqueInts(treeSize)
+			assert.NoError(t, bt.BulkLoad(numbers...))
+			left := map[int64]bool{}
+			for _, n := range numbers {
+				left[n] = true
+			}
+			for range 10 {
+				from := rand.Int63n(treeSize * 10)
+				to := from + rand.Int63n(treeSize*2)
+				var expected int64
+				for n := range left {
+					if n >= from && n <= to {
+						expected++
+						delete(left, n)
+					}
+				}
+				removed, err := bt.DeleteRange(from, to)
+				assert.NoError(t, err)
+				assert.Equal(t, expected, removed)
+				assert.NoError(t, bt.Verify())
+			}
+			removed, _ := bt.DeleteRange(treeSize*10, 0)
+			assert.Zero(t, removed)
+			assert.NoError(t, bt.Close())
+
+			bt, err = btree.Open("/tmp/unit-test-btree-range", config())
+			assert.NoError(t, err)
+			assert.NoError(t, bt.Verify())
+			assert.Equal(t, int64(len(left)), bt.Size())
+			assert.Len(t, iterateAll(bt.Iterate()), len(left))
+			if counted {
+				count, _ := bt.CountRange(0, treeSize*10)
+				assert.Equal(t, int64(len(left)), count)
+			}
+			removed, err = bt.DeleteRange(0, treeSize*10)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(len(left)), removed)
+			assert.NoError(t, bt.Close())
+
+			bt, err = btree.Open("/tmp/unit-test-btree-range", config())
+			assert.NoError(t, err)
+			assert.True(t, bt.IsEmpty())
+			assert.Empty(t, iterateAll(bt.Iterate()))
+			assert.NoError(t, bt.Close())
+		}
+	}
+
+	bt := btree.Configuration[treeitem]().Grade(5).ItemShape(treeitem{}).StoragePath("/tmp/unit-test-btree-range").Reset().Make()
+	var deleted []string
+	bt.OnChange(func(c btree.Change[treeitem]) {
+		if c.Op == btree.Deleted {
+			deleted = append(deleted, c.Old.Id)
+		}
+	})
+	var expected, kept []string
+	for i := range 300 {
+		id := fmt.Sprintf("t%d/%d", i%3, i)
+		assert.NoError(t, bt.Add(treeitem{Id: id}))
+		if strings.HasPrefix(id, "t1/") {
+			expected = append(expected, id)
+		} else {
+			kept = append(kept, id)
+		}
+	}
+	removed, err := bt.DeletePrefix(treeitem{Id: "t1/"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(expected)), removed)
+	assert.ElementsMatch(t, expected, deleted)
+	assert.NoError(t, bt.Verify())
+	assert.ElementsMatch(t, kept, lo.Map(iterateAll(bt.Iterate()), func(it treeitem, _ int) string { return it.Id }))
+	assert.NoError(t, bt.Close())
+
+	users := btree.Configuration[user]().Grade(5).ItemShape(user{}).StoragePath("/tmp/unit-test-btree-range").Reset().Make()
+	for i := range 40 {
+		assert.NoError(t, users.Add(user{Id: fmt.Sprintf("u%02d", i), Email: fmt.Sprintf("u%02d@example.com", i)}))
+	}
+	removed, err = users.DeleteRange(user{Id: "u10"}, user{Id: "u19"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), removed)
+	found, _ := users.FindBy("email", "u15@example.com")
+	assert.Empty(t, found)
+	// the index entries of the removed items are gone, so their values can be taken again
+	assert.NoError(t, users.Add(user{Id: "u99", Email: "u15@example.com"}))
+	assert.NoError(t, users.Close())
+}
+
+type session struct {
+	Id      string `bsistent:"key;maxSize:32"`
+	User    string `bsistent:"index;maxSize:32"`
+	Expires int64  `bsistent:"ttl"`
+}
+
+func TestDeleteRangeUnloaded(t *testing.T) {
+	path := "/tmp/unit-test-btree-range-unloaded"
+	r := &recorder{counters: map[string]int64{}, observations: map[string]int{}}
+	config := func() *btree.BTConfig[int64] {
+		return btree.Configuration[int64]().Grade(5).ItemSize(8).CopyOnWrite().OrderStatistics().Metrics(r)
+	}
+	bt, err := btree.Open(path, config().Reset())
+	assert.NoError(t, err)
+	numbers := make([]int64, 2000)
+	for i := range numbers {
+		numbers[i] = int64(i + 1)
+	}
+	assert.NoError(t, bt.BulkLoad(numbers...))
+	stats, err := bt.Stats()
+	assert.NoError(t, err)
+	// with nothing following the items, the subtrees in the range are dropped without being read
+	reads := r.counters["page.reads"]
+	removed, err := bt.DeleteRange(101, 1900)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1800), removed)
+	assert.Less(t, r.counters["page.reads"]-reads, stats.AllocatedPages/10)
+	assert.Equal(t, int64(200), bt.Size())
+	assert.NoError(t, bt.Verify())
+	// the items are read when the subscribers take them
+	var seen []int64
+	bt.OnChange(func(c btree.Change[int64]) { seen = append(seen, c.Old) })
+	removed, err = bt.DeleteRange(1, 50)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(50), removed)
+	assert.Equal(t, numbers[:50], seen)
+	assert.NoError(t, bt.Close())
+
+	// the pages left behind are reused once the data file is opened again
+	bt, err = btree.Open(path, config())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(150), bt.Size())
+	assert.NoError(t, bt.Verify())
+	assert.NoError(t, bt.Add(5000))
+	stats, err = bt.Stats()
+	assert.NoError(t, err)
+	assert.Greater(t, stats.FreePages, stats.AllocatedPages/2)
+	assert.NoError(t, bt.Close())
+}
+
+func TestTTL(t *testing.T) {
+	for _, layout := range []btree.Layout{btree.Classic, btree.BPlus} {
+		config := func() *btree.BTConfig[session] {
+			return btree.Configuration[session]().Grade(5).ItemShape(session{}).Layout(layout)
+		}
+		bt, err := btree.Open("/tmp/unit-test-btree-ttl", config().Reset())
+		assert.NoError(t, err)
+		past := time.Now().Add(-time.Hour).UnixNano()
+		var live []string
+		for i := range 200 {
+			s := session{Id: fmt.Sprintf("s%03d", i), User: fmt.Sprintf("user%d", i%5)}
+			switch i % 3 {
+			case 0:
+				s.Expires = past
+			case 1:
+				live = append(live, s.Id)
+				assert.NoError(t, bt.AddWithTTL(s, time.Hour))
+				continue
+			default:
+				live = append(live, s.Id)
+			}
+			assert.NoError(t, bt.Add(s))
+		}
+		found, _ := bt.Find(session{Id: "s000"})
+		assert.False(t, found)
+		found, _ = bt.Find(session{Id: "s001"})
+		assert.True(t, found)
+		ids := func() []string {
+			return lo.Map(iterateAll(bt.Iterate()), func(s session, _ int) string { return s.Id })
+		}
+		assert.Equal(t, live, ids())
+		first, _ := bt.Min()
+		assert.Equal(t, "s001", first.Id)
+		last, _ := bt.Max()
+		assert.Equal(t, "s199", last.Id)
+		next, _ := bt.Next(session{Id: "s002"})
+		assert.Equal(t, "s004", next.Id)
+		byUser, _ := bt.FindBy("User", "user0")
+		assert.Len(t, byUser, 26)
+		assert.ErrorIs(t, bt.Update(session{Id: "s003"}), btree.ErrNotFound)
+		assert.Equal(t, int64(200), bt.Size())
+		assert.NoError(t, bt.Close())
+
+		bt, err = btree.Open("/tmp/unit-test-btree-ttl", config())
+		assert.NoError(t, err)
+		swept, err := bt.Sweep()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(67), swept)
+		assert.Equal(t, int64(len(live)), bt.Size())
+		assert.Equal(t, live, ids())
+		assert.NoError(t, bt.Verify())
+		// updating the expiry moves the item in the expiry order
+		assert.NoError(t, bt.Update(session{Id: "s001", Expires: past}))
+		assert.NoError(t, bt.Update(session{Id: "s002", Expires: time.Now().Add(-time.Second).UnixNano()}))
+		swept, _ = bt.Sweep()
+		assert.Equal(t, int64(2), swept)
+		swept, _ = bt.Sweep()
+		assert.Zero(t, swept)
+		assert.Equal(t, live[2:], ids())
+		assert.NoError(t, bt.Close())
+	}
+
+	plain := btree.Configuration[treeitem]().Grade(5).ItemShape(treeitem{}).StoragePath("/tmp/unit-test-btree-ttl").Reset().Make()
+	assert.Error(t, plain.AddWithTTL(treeitem{Id: "x"}, time.Minute))
+	swept, err := plain.Sweep()
+	assert.NoError(t, err)
+	assert.Zero(t, swept)
+	assert.NoError(t, plain.Close())
+}
+
+func TestTTLOrderStatistics(t *testing.T) {
+	bt, err := btree.Open("/tmp/unit-test-btree-ttl-counted", btree.Configuration[session]().Grade(5).ItemShape(session{}).OrderStatistics().Reset())
+	assert.NoError(t, err)
+	past := time.Now().Add(-time.Hour).UnixNano()
+	for i := range 30 {
+		s := session{Id: fmt.Sprintf("s%03d", i)}
+		if i%3 == 0 {
+			s.Expires = past
+		}
+		assert.NoError(t, bt.Add(s))
+	}
+	// the expired items are counted until they are swept, though the lookups pass over them
+	found, _ := bt.Find(session{Id: "s000"})
+	assert.False(t, found)
+	first, err := bt.At(0)
+	assert.NoError(t, err)
+	assert.Equal(t, "s000", first.Id)
+	rank, err := bt.Rank(session{Id: "s010"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), rank)
+	count, err := bt.CountRange(session{Id: "s000"}, session{Id: "s029"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(30), count)
+	assert.Equal(t, int64(30), bt.Size())
+
+	swept, err := bt.Sweep()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), swept)
+	first, err = bt.At(0)
+	assert.NoError(t, err)
+	assert.Equal(t, "s001", first.Id)
+	rank, err = bt.Rank(session{Id: "s010"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), rank)
+	count, err = bt.CountRange(session{Id: "s000"}, session{Id: "s029"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20), count)
+	assert.Equal(t, int64(20), bt.Size())
+	assert.NoError(t, bt.Close())
+}
+
+func TestDB(t *testing.T) {
+	path := "/tmp/unit-test-btree-db"
+	os.Remove(path)
+	db, err := btree.OpenDB(path)
+	assert.NoError(t, err)
+	usersConfig := btree.Configuration[user]().Grade(5).ItemShape(user{})
+	numbersConfig := func() *btree.BTConfig[int64] {
+		return btree.Configuration[int64]().Grade(7).ItemSize(8).Layout(btree.BPlus).OrderStatistics().CacheSize(20)
+	}
+	users, err := btree.Tree(db, "users", usersConfig)
+	assert.NoError(t, err)
+	numbers, err := btree.Tree(db, "numbers", numbersConfig())
+	assert.NoError(t, err)
+	versions, err := btree.Tree(db, "versions", btree.Configuration[int64]().Grade(5).ItemSize(8).CopyOnWrite())
+	assert.NoError(t, err)
+	_, err = btree.Tree(db, "users", usersConfig)
+	assert.ErrorIs(t, err, btree.ErrAlreadyOpen)
+
+	ints := generateUniqueInts(treeSize)
+	for i, n := range ints {
+		// the trees grow at the same time, so their pages are mixed in the file
+		assert.NoError(t, numbers.Add(n))
+		assert.NoError(t, versions.Add(n))
+		if i < 60 {
+			assert.NoError(t, users.Add(user{Id: fmt.Sprintf("u%02d", i), Email: fmt.Sprintf("u%02d@example.com", i), Team: int64(i % 4)}))
+		}
+	}
+	snapshot, err := versions.Snapshot()
+	assert.NoError(t, err)
+	for _, n := range ints[:treeSize/2] {
+		assert.NoError(t, versions.Delete(n))
+	}
+	assert.Equal(t, int64(treeSize), snapshot.Size())
+	assert.NoError(t, snapshot.Close())
+	assert.NoError(t, users.Close())
+	assert.NoError(t, db.Close())
+	assert.ErrorIs(t, numbers.Close(), btree.ErrClosed)
+
+	_, err = btree.Open(path, btree.Configuration[int64]().ItemSize(8))
+	assert.Error(t, err)
+
+	db, err = btree.OpenDB(path)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"numbers", "users", "users.Team.index", "users.email.index", "versions"}, db.Trees())
+	numbers, err = btree.Tree(db, "numbers", numbersConfig())
+	assert.NoError(t, err)
+	assert.NoError(t, numbers.Verify())
+	slices.Sort(ints)
+	assert.Equal(t, ints, iterateAll(numbers.Iterate()))
+	position, _ := numbers.At(10)
+	assert.Equal(t, ints[10], position)
+	users, err = btree.Tree(db, "users", usersConfig)
+	assert.NoError(t, err)
+	found, _ := users.FindBy("email", "u42@example.com")
+	assert.Len(t, found, 1)
+	found, _ = users.FindBy("Team", 3)
+	assert.Len(t, found, 15)
+	versions, err = btree.Tree(db, "versions", btree.Configuration[int64]().Grade(5).ItemSize(8).CopyOnWrite())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(treeSize/2), versions.Size())
+	_, err = btree.Tree(db, "other", btree.Configuration[int64]().Grade(9).ItemSize(8))
+	assert.NoError(t, err)
+	assert.NoError(t, versions.Close())
+	_, err = btree.Tree(db, "versions", btree.Configuration[int64]().Grade(9).ItemSize(8))
+	assert.Error(t, err)
+
+	// a tree of a database is backed up into a data file of its own
+	assert.NoError(t, numbers.BackupTo("/tmp/unit-test-btree-db-numbers"))
+	assert.NoError(t, db.Close())
+	copied, err := btree.Open("/tmp/unit-test-btree-db-numbers", numbersConfig())
+	assert.NoError(t, err)
+	assert.Equal(t, ints, iterateAll(copied.Iterate()))
+	assert.NoError(t, copied.Close())
+
+	// resetting a tree leaves the others as they are
+	db, err = btree.OpenDB(path)
+	assert.NoError(t, err)
+	numbers, err = btree.Tree(db, "numbers", numbersConfig().Reset())
+	assert.NoError(t, err)
+	assert.True(t, numbers.IsEmpty())
+	assert.NoError(t, numbers.Add(1))
+	assert.NoError(t, db.Close())
+
+	db, err = btree.OpenDB(path, btree.DBOptions{ReadOnly: true})
+	assert.NoError(t, err)
+	numbers, err = btree.Tree(db, "numbers", numbersConfig())
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1}, iterateAll(numbers.Iterate()))
+	assert.ErrorIs(t, numbers.Add(2), btree.ErrReadOnly)
+	users, err = btree.Tree(db, "users", usersConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(60), users.Size())
+	_, err = btree.Tree(db, "missing", numbersConfig())
+	assert.ErrorIs(t, err, btree.ErrNotFound)
+	assert.NoError(t, db.Close())
+
+	_, err = btree.OpenDB("/tmp/unit-test-btree-db-numbers")
+	assert.Error(t, err)
+}
+
+func TestDBTransactions(t *testing.T) {
+	path := "/tmp/unit-test-btree-db-transactions"
+	os.Remove(path)
+	os.Remove(path + ".journal")
+	r := &recorder{counters: map[string]int64{}, observations: map[string]int{}}
+	usersConfig := btree.Configuration[user]().Grade(5).ItemShape(user{})
+	numbersConfig := func() *btree.BTConfig[int64] {
+		return btree.Configuration[int64]().Grade(7).ItemSize(8).Metrics(r)
+	}
+	db, err := btree.OpenDB(path, btree.DBOptions{CacheSize: 64})
+	assert.NoError(t, err)
+	users, err := btree.Tree(db, "users", usersConfig)
+	assert.NoError(t, err)
+	numbers, err := btree.Tree(db, "numbers", numbersConfig())
+	assert.NoError(t, err)
+	versions, err := btree.Tree(db, "versions", btree.Configuration[int64]().Grade(5).ItemSize(8).CopyOnWrite())
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Update(func() error {
+		for i := range 40 {
+			if err := users.Add(user{Id: fmt.Sprintf("u%02d", i), Email: fmt.Sprintf("u%02d@example.com", i), Team: int64(i % 4)}); err != nil {
+				return err
+			}
+			if err := numbers.Add(int64(i + 1)); err != nil {
+				return err
+			}
+			if err := versions.Add(int64(i + 1)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	journal, err := os.Stat(path + ".journal")
+	assert.NoError(t, err)
+	assert.Zero(t, journal.Size())
+	// the pages are read from the cache the trees share
+	for i := range 40 {
+		found, _ := numbers.Find(int64(i + 1))
+		assert.True(t, found)
+	}
+	assert.Positive(t, r.counters["cache.hits"])
+
+	// a change that fails leaves every tree as it was before it
+	failure := errors.New("failure")
+	assert.ErrorIs(t, db.Update(func() error {
+		for i := 41; i <= 100; i++ {
+			assert.NoError(t, numbers.Add(int64(i)))
+			assert.NoError(t, versions.Add(int64(i)))
+		}
+		for i := range 20 {
+			assert.NoError(t, users.Delete(user{Id: fmt.Sprintf("u%02d", i)}))
+		}
+		assert.NoError(t, users.Add(user{Id: "new", Email: "new@example.com", Team: 3}))
+		_, err := btree.Tree(db, "other", numbersConfig())
+		assert.Error(t, err)
+		_, err = versions.Snapshot()
+		assert.Error(t, err)
+		return failure
+	}), failure)
+	assert.Panics(t, func() {
+		db.Update(func() error {
+			assert.NoError(t, numbers.Add(1000))
+			panic("failure")
+		})
+	})
+	for _, bt := range []*btree.Btree[int64]{numbers, versions} {
+		assert.Equal(t, int64(40), bt.Size())
+		assert.NoError(t, bt.Verify())
+		found, _ := bt.Find(50)
+		assert.False(t, found)
+	}
+	assert.Equal(t, int64(40), users.Size())
+	assert.NoError(t, users.Verify())
+	found, _ := users.FindBy("email", "u05@example.com")
+	assert.Len(t, found, 1)
+	found, _ = users.FindBy("email", "new@example.com")
+	assert.Empty(t, found)
+	found, _ = users.FindBy("Team", 3)
+	assert.Len(t, found, 10)
+
+	// the trees go on after a rollback
+	assert.NoError(t, db.Update(func() error {
+		return numbers.Add(41)
+	}))
+	assert.NoError(t, users.Add(user{Id: "u40", Email: "u40@example.com", Team: 0}))
+	assert.NoError(t, db.Close())
+
+	db, err = btree.OpenDB(path, btree.DBOptions{ReadOnly: true})
+	assert.NoError(t, err)
+	numbers, err = btree.Tree(db, "numbers", numbersConfig())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(41), numbers.Size())
+	assert.NoError(t, numbers.Verify())
+	versions, err = btree.Tree(db, "versions", btree.Configuration[int64]().Grade(5).ItemSize(8).CopyOnWrite())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(40), versions.Size())
+	users, err = btree.Tree(db, "users", usersConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(41), users.Size())
+	found, _ = users.FindBy("Team", 0)
+	assert.Len(t, found, 11)
+	assert.ErrorIs(t, db.Update(func() error { return nil }), btree.ErrReadOnly)
+	assert.NoError(t, db.Close())
+}
+
+func TestDBTransactionChanges(t *testing.T) {
+	path := "/tmp/unit-test-btree-db-transaction-changes"
+	os.Remove(path)
+	os.Remove(path + ".journal")
+	config := func() *btree.BTConfig[int64] {
+		return btree.Configuration[int64]().Grade(5).ItemSize(8).ChangeLog().Reset()
+	}
+	db, err := btree.OpenDB(path)
+	assert.NoError(t, err)
+	numbers, err := btree.Tree(db, "numbers", config())
+	assert.NoError(t, err)
+	var seen []btree.Change[int64]
+	numbers.OnChange(func(c btree.Change[int64]) { seen = append(seen, c) })
+	logged := func() []btree.Change[int64] {
+		it, err := numbers.Changes(0)
+		assert.NoError(t, err)
+		defer it.Close()
+		var changes []btree.Change[int64]
+		for it.Next() {
+			changes = append(changes, it.Value())
+		}
+		assert.NoError(t, it.Err())
+		return changes
+	}
+	assert.NoError(t, numbers.Add(1))
+
+	// the changes of a transaction rolled back are neither logged nor handed to the subscribers
+	failure := errors.New("failure")
+	assert.ErrorIs(t, db.Update(func() error {
+		for n := int64(2); n <= 11; n++ {
+			assert.NoError(t, numbers.Add(n))
+		}
+		assert.Len(t, seen, 1)
+		return failure
+	}), failure)
+	assert.Equal(t, int64(1), numbers.Size())
+	expected := []btree.Change[int64]{{Seq: 1, Op: btree.Inserted, New: 1}}
+	assert.Equal(t, expected, seen)
+	assert.Equal(t, expected, logged())
+
+	// the ones of a transaction committed are, once it commits
+	assert.NoError(t, db.Update(func() error {
+		assert.NoError(t, numbers.Add(20))
+		assert.NoError(t, numbers.Delete(1))
+		assert.Len(t, seen, 1)
+		return nil
+	}))
+	expected = append(expected, btree.Change[int64]{Seq: 2, Op: btree.Inserted, New: 20}, btree.Change[int64]{Seq: 3, Op: btree.Deleted, Old: 1})
+	assert.Equal(t, expected, seen)
+	assert.Equal(t, expected, logged())
+	assert.NoError(t, numbers.Add(30))
+	assert.Equal(t, uint64(4), seen[len(seen)-1].Seq)
+	assert.NoError(t, db.Close())
+}
+
+func TestCompression(t *testing.T) {
+	for _, copyOnWrite := range []bool{false, true} {
+		path := "/tmp/unit-test-btree-compressed"
+		uncompressed := func() *btree.BTConfig[treeitem] {
+			c := btree.Configuration[treeitem]().Grade(5).ItemShape(treeitem{})
+			if copyOnWrite {
+				c = c.CopyOnWrite().OrderStatistics()
+			}
+			return c
+		}
+		config := func() *btree.BTConfig[treeitem] {
+			return uncompressed().Compression()
+		}
+		bt, err := btree.Open(path, config().Reset())
+		assert.NoError(t, err)
+		var expected []string
+		for i := range 600 {
+			id := fmt.Sprintf("item-%05d", i)
+			assert.NoError(t, bt.Add(treeitem{Id: id, SomethingMore: int64(i)}))
+			expected = append(expected, id)
+		}
+		for _, id := range expected[:150] {
+			assert.NoError(t, bt.Delete(treeitem{Id: id}))
+		}
+		expected = expected[150:]
+		stats, err := bt.Stats()
+		assert.NoError(t, err)
+		// the items take much less than the room left for them
+		assert.Less(t, stats.DiskBytes*4, stats.AllocatedPages*stats.PageSize)
+		var backup bytes.Buffer
+		assert.NoError(t, bt.Backup(&backup))
+		assert.NoError(t, bt.Close())
+
+		bt, err = btree.Open(path, config())
+		assert.NoError(t, err)
+		assert.NoError(t, bt.Verify())
+		ids := func(bt *btree.Btree[treeitem]) []string {
+			return lo.Map(iterateAll(bt.Iterate()), func(it treeitem, _ int) string { return it.Id })
+		}
+		assert.Equal(t, expected, ids(bt))
+		found, item := bt.Find(treeitem{Id: "item-00234"})
+		assert.True(t, found)
+		assert.Equal(t, int64(234), item.SomethingMore)
+		// pages are written to new records, and the ones they leave are written over once committed
+		stats, err = bt.Stats()
+		assert.NoError(t, err)
+		for range 10 {
+			for _, id := range expected[:30] {
+				assert.NoError(t, bt.Delete(treeitem{Id: id}))
+			}
+			for i, id := range expected[:30] {
+				assert.NoError(t, bt.Add(treeitem{Id: id, SomethingMore: int64(150 + i)}))
+			}
+		}
+		grown, err := bt.Stats()
+		assert.NoError(t, err)
+		// the file only grows by the pages added, not by the rewritten ones
+		perPage := stats.DiskBytes / stats.AllocatedPages
+		assert.Less(t, grown.DiskBytes, stats.DiskBytes*5/4+(grown.AllocatedPages-stats.AllocatedPages)*perPage*2)
+		assert.NoError(t, bt.Close())
+		bt, err = btree.Open(path, config())
+		assert.NoError(t, err)
+		assert.NoError(t, bt.Verify())
+		assert.Equal(t, expected, ids(bt))
+		assert.NoError(t, bt.Close())
+
+		// the format is taken from the file, and backups restore uncompressed
+		readOnly, err := btree.Open(path, uncompressed().ReadOnly())
+		assert.NoError(t, err)
+		assert.Equal(t, expected, ids(readOnly))
+		assert.NoError(t, readOnly.Close())
+		assert.NoError(t, btree.Restore(&backup, "/tmp/unit-test-btree-decompressed"))
+		restored, err := btree.Open("/tmp/unit-test-btree-decompressed", config())
+		assert.NoError(t, err)
+		assert.NoError(t, restored.Verify())
+		assert.Equal(t, expected, ids(restored))
+		stats, _ = restored.Stats()
+		assert.GreaterOrEqual(t, stats.DiskBytes, stats.AllocatedPages*stats.PageSize)
+		assert.NoError(t, restored.Close())
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	path := "/tmp/unit-test-btree-encrypted"
+	key := []byte("0123456789abcdef0123456789abcdef")
+	config := func(key []byte) *btree.BTConfig[user] {
+		return btree.Configuration[user]().Grade(5).ItemShape(user{}).CopyOnWrite().Encryption(key)
+	}
+	bt, err := btree.Open(path, config(key).Reset())
+	assert.NoError(t, err)
+	var expected []user
+	for i := range 200 {
+		u := user{Id: fmt.Sprintf("secret-%05d", i), Email: fmt.Sprintf("secret-%d@example.com", i), Team: int64(i % 4)}
+		assert.NoError(t, bt.Add(u))
+		expected = append(expected, u)
+	}
+	var backup bytes.Buffer
+	assert.NoError(t, bt.Backup(&backup))
+	stats, err := bt.Stats()
+	assert.NoError(t, err)
+	assert.NoError(t, bt.Close())
+
+	// the items are nowhere to be read, while the header still is
+	for _, p := range []string{path, path + ".email.index"} {
+		data, err := os.ReadFile(p)
+		assert.NoError(t, err)
+		assert.NotContains(t, string(data), "secret-")
+	}
+	assert.NotContains(t, backup.String(), "secret-")
+	data, _ := os.ReadFile(path)
+	assert.Equal(t, uint64(len(expected)), binary.LittleEndian.Uint64(data[24:]))
+
+	bt, err = btree.Open(path, config(key))
+	assert.NoError(t, err)
+	assert.NoError(t, bt.Verify())
+	assert.Equal(t, expected, iterateAll(bt.Iterate()))
+	found, err := bt.FindBy("email", "secret-42@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, expected[42:43], found)
+	assert.NoError(t, bt.Close())
+
+	_, err = btree.Open(path, btree.Configuration[user]().Grade(5).ItemShape(user{}))
+	assert.ErrorIs(t, err, btree.ErrEncryption)
+	_, err = btree.Open(path, config([]byte("another key of 32 bytes, wrong!!")))
+	assert.ErrorIs(t, err, btree.ErrEncryption)
+	_, err = btree.Open(path, config(key).ChangeLog())
+	assert.Error(t, err)
+
+	// a page changed on disk fails authentication when it is loaded. Every page but the root is
+	// changed, the pages being sealed in slots of the page size, their counter and their tag
+	tampered := "/tmp/unit-test-btree-tampered"
+	root, slot := int(binary.LittleEndian.Uint64(data[16:])), int(stats.PageSize)+24
+	for offset := 56; offset+slot <= len(data); offset += slot {
+		if offset != root {
+			data[offset+slot-1] ^= 1
+		}
+	}
+	assert.NoError(t, os.WriteFile(tampered, data, 0666))
+	index, err := os.ReadFile(path + ".email.index")
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(tampered+".email.index", index, 0666))
+	bt, err = btree.Open(tampered, config(key))
+	assert.NoError(t, err)
+	it := bt.Iterate()
+	assert.Less(t, len(iterateAll(it)), len(expected))
+	assert.ErrorIs(t, it.Err(), btree.ErrEncryption)
+	_, _, err = bt.FindCtx(context.Background(), expected[42])
+	assert.ErrorIs(t, err, btree.ErrEncryption)
+	assert.ErrorIs(t, bt.Add(user{Id: "secret-new", Email: "new@example.com"}), btree.ErrEncryption)
+	assert.ErrorIs(t, bt.Verify(), btree.ErrEncryption)
+	assert.NoError(t, bt.Close())
+	// the indexes of the tampered file cannot be rebuilt from its pages
+	assert.NoError(t, os.Remove(tampered+".email.index"))
+	_, err = btree.Open(tampered, config(key))
+	assert.ErrorIs(t, err, btree.ErrEncryption)
+
+	// the key is rotated by compacting the tree
+	rotated := []byte("fedcba9876543210")
+	bt, err = btree.Open(path, config(key))
+	assert.NoError(t, err)
+	compacted, err := bt.CompactTo("/tmp/unit-test-btree-rotated", btree.CompactOptions{EncryptionKey: rotated})
+	assert.NoError(t, err)
+	assert.NoError(t, compacted.Close())
+	assert.NoError(t, bt.Close())
+	_, err = btree.Open("/tmp/unit-test-btree-rotated", config(key))
+	assert.ErrorIs(t, err, btree.ErrEncryption)
+	bt, err = btree.Open("/tmp/unit-test-btree-rotated", config(rotated))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, iterateAll(bt.Iterate()))
+	found, err = bt.FindBy("email", "secret-199@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, expected[199:], found)
+	assert.NoError(t, bt.Close())
+
+	// backups keep the pages encrypted
+	assert.NoError(t, btree.Restore(&backup, "/tmp/unit-test-btree-encrypted-restored"))
+	restored, err := btree.Open("/tmp/unit-test-btree-encrypted-restored", config(key))
+	assert.NoError(t, err)
+	assert.NoError(t, restored.Verify())
+	assert.Equal(t, expected, iterateAll(restored.Iterate()))
+	assert.NoError(t, restored.Add(user{Id: "secret-99999", Email: "new@example.com"}))
+	assert.NoError(t, restored.Close())
+}
+
+// countdown is a context cancelled once its error has been checked a number of times
+type countdown struct {
+	context.Context
+	checks int
+}
+
+func (c *countdown) Err() error {
+	if c.checks--; c.checks < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestContext(t *testing.T) {
+	config := btree.Configuration[int64]().Grade(5).ItemSize(8).StoragePath("/tmp/unit-test-btree-context").Reset()
+	bt := config.Make()
+	numbers := lo.Range(300)
+	assert.NoError(t, bt.BulkLoad(lo.Map(numbers, func(n int, _ int) int64 { return int64(n*2 + 2) })...))
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	found, value, err := bt.FindCtx(context.Background(), 42)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, int64(42), value)
+	_, _, err = bt.FindCtx(canceled, 42)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, _, err = bt.FindCtx(&countdown{Context: context.Background(), checks: 1}, 42)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// an insertion cancelled while looking for its leaf leaves the tree as it was
+	assert.ErrorIs(t, bt.AddCtx(&countdown{Context: context.Background(), checks: 1}, 1), context.Canceled)
+	assert.NoError(t, bt.AddCtx(context.Background(), 3))
+	assert.Equal(t, int64(301), bt.Size())
+	found, _ = bt.Find(1)
+	assert.False(t, found)
+
+	// items added one by one stop at the cancellation, the ones added before stay
+	assert.ErrorIs(t, bt.BulkLoadCtx(&countdown{Context: context.Background(), checks: 25}, 5, 7, 9, 11, 13, 15, 17, 19, 21, 23), context.Canceled)
+	assert.Greater(t, bt.Size(), int64(301))
+	assert.Less(t, bt.Size(), int64(311))
+	assert.NoError(t, bt.Verify())
+	assert.ErrorIs(t, bt.VerifyCtx(canceled), context.Canceled)
+	assert.NoError(t, bt.VerifyCtx(context.Background()))
+
+	all := iterateAll(bt.Iterate())
+	it := bt.IterateCtx(context.Background())
+	assert.Equal(t, all, iterateAll(it))
+	assert.NoError(t, it.Err())
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	it = bt.IterateFromCtx(ctx, 100)
+	var seen []int64
+	for it.Next() {
+		if seen = append(seen, it.Value()); len(seen) == 10 {
+			stop()
+		}
+	}
+	assert.ErrorIs(t, it.Err(), context.Canceled)
+	assert.GreaterOrEqual(t, len(seen), 10)
+	assert.Less(t, len(seen), len(all))
+	assert.Equal(t, int64(100), seen[0])
+	assert.False(t, bt.PrefixCtx(canceled, 0).Next())
+	// the iterators whose context is done do not stop the other operations
+	found, _ = bt.Find(100)
+	assert.True(t, found)
+	assert.Equal(t, all, iterateAll(bt.Iterate()))
+	assert.NoError(t, bt.BackupTo("/tmp/unit-test-btree-context-backup", btree.BackupOptions{Compact: true}))
+
+	compacted, err := bt.CompactToCtx(canceled, "/tmp/unit-test-btree-context-compacted")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, compacted)
+	compacted, err = bt.CompactToCtx(context.Background(), "/tmp/unit-test-btree-context-compacted")
+	assert.NoError(t, err)
+	assert.Equal(t, all, iterateAll(compacted.Iterate()))
+	assert.NoError(t, compacted.Close())
+	assert.NoError(t, bt.Close())
+}
+
+func TestWriteBehind(t *testing.T) {
+	path := "/tmp/unit-test-btree-write-behind"
+	diskSize := func() int64 {
+		st, err := os.Stat(path)
+		assert.NoError(t, err)
+		return st.Size()
+	}
+	for _, copyOnWrite := range []bool{false, true} {
+		config := func(options btree.WriteBehindOptions) *btree.BTConfig[int64] {
+			c := btree.Configuration[int64]().Grade(5).ItemSize(8).WriteBehind(options)
+			return lo.Ternary(copyOnWrite, c.CopyOnWrite(), c)
+		}
+		// nothing is written until Sync while the thresholds are out of reach
+		bt, err := btree.Open(path, config(btree.WriteBehindOptions{FlushPages: 100000, FlushInterval: time.Hour, MaxDirtyPages: 100000}).Reset())
+		assert.NoError(t, err)
+		numbers := generateUniqueInts(500)
+		for _, n := range numbers {
+			assert.NoError(t, bt.Add(n))
+		}
+		written := diskSize()
+		for _, n := range numbers {
+			found, _ := bt.Find(n)
+			assert.True(t, found)
+		}
+		assert.NoError(t, bt.Verify())
+		assert.NoError(t, bt.Sync())
+		assert.Greater(t, diskSize(), written)
+		assert.NoError(t, bt.Close())
+
+		// a few dirty pages hold the changes back until they are written
+		bt, err = btree.Open(path, config(btree.WriteBehindOptions{FlushPages: 2, MaxDirtyPages: 4}))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(numbers)), bt.Size())
+		for _, n := range numbers[:200] {
+			assert.NoError(t, bt.Delete(n))
+		}
+		assert.NoError(t, bt.Verify())
+		assert.NoError(t, bt.Close())
+
+		// the interval writes the pages without Sync
+		bt, err = btree.Open(path, config(btree.WriteBehindOptions{FlushPages: 100000, FlushInterval: 10 * time.Millisecond, MaxDirtyPages: 100000}))
+		assert.NoError(t, err)
+		written = diskSize()
+		for n := range int64(300) {
+			assert.NoError(t, bt.Add(n+1_000_000))
+		}
+		assert.Eventually(t, func() bool { return diskSize() > written }, time.Second, 10*time.Millisecond)
+		assert.NoError(t, bt.Close())
+
+		bt, err = btree.Open(path, btree.Configuration[int64]().Grade(5).ItemSize(8).ReadOnly())
+		assert.NoError(t, err)
+		assert.NoError(t, bt.Verify())
+		assert.Equal(t, int64(len(numbers)-200+300), bt.Size())
+		assert.NoError(t, bt.Close())
+	}
+	_, err := btree.Open(path, btree.Configuration[int64]().Grade(5).ItemSize(8).WriteBehind().Durability(btree.DurabilityOnCommit))
+	assert.Error(t, err)
+}
+
+// recorder keeps the metrics reported to it
+type recorder struct {
+	sync.Mutex
+	counters     map[string]int64
+	observations map[string]int
+}
+
+func (r *recorder) Count(metric string, delta int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.counters[metric] += delta
+}
+
+func (r *recorder) Observe(metric string, value float64) {
+	r.Lock()
+	defer r.Unlock()
+	r.observations[metric]++
+}
+
+func TestMetrics(t *testing.T) {
+	path := "/tmp/unit-test-btree-metrics"
+	for _, layout := range []btree.Layout{btree.Classic, btree.BPlus} {
+		r := &recorder{counters: map[string]int64{}, observations: map[string]int{}}
+		config := func() *btree.BTConfig[int64] {
+			return btree.Configuration[int64]().Grade(5).ItemSize(8).CacheSize(16).Layout(layout).Metrics(r)
+		}
+		bt, err := btree.Open(path, config().Reset())
+		assert.NoError(t, err)
+		numbers := generateUniqueInts(300)
+		for _, n := range numbers {
+			assert.NoError(t, bt.Add(n))
+		}
+		for _, n := range numbers {
+			found, _ := bt.Find(n)
+			assert.True(t, found)
+		}
+		for _, n := range numbers[:200] {
+			assert.NoError(t, bt.Delete(n))
+		}
+		// the rebalancing of a range deletion is counted as well
+		merges := r.counters["merges"]
+		rest := slices.Clone(numbers[200:])
+		slices.Sort(rest)
+		removed, err := bt.DeleteRange(rest[10], rest[80])
+		assert.NoError(t, err)
+		assert.Equal(t, int64(71), removed)
+		assert.Greater(t, r.counters["merges"], merges)
+		assert.NoError(t, bt.Sync())
+		assert.NoError(t, bt.Close())
+		assert.Equal(t, len(numbers), r.observations["add.seconds"])
+		assert.Equal(t, len(numbers), r.observations["find.seconds"])
+		assert.Equal(t, 200, r.observations["delete.seconds"])
+		assert.Positive(t, r.observations["fsync.seconds"])
+		for _, counter := range []string{"splits", "merges", "rotations", "page.reads", "page.writes", "bytes.written", "cache.hits", "cache.misses"} {
+			assert.Positive(t, r.counters[counter], counter)
+		}
+	}
+
+	published := metrics.NewExpvar("unit-test-btree-metrics")
+	bt, err := btree.Open(path, btree.Configuration[int64]().Grade(5).ItemSize(8).Metrics(published).Reset())
+	assert.NoError(t, err)
+	for n := range int64(100) {
+		assert.NoError(t, bt.Add(n+1))
+	}
+	assert.NoError(t, bt.Close())
+	var added struct {
+		Count   float64
+		Min     float64
+		Mean    float64
+		Buckets map[string]int64
+	}
+	assert.NoError(t, json.Unmarshal([]byte(expvar.Get("unit-test-btree-metrics").(*expvar.Map).Get("add.seconds").String()), &added))
+	assert.Equal(t, float64(100), added.Count)
+	assert.LessOrEqual(t, added.Min, added.Mean)
+	assert.Len(t, added.Buckets, len(metrics.Buckets)+1)
+	assert.Equal(t, int64(100), added.Buckets["+Inf"])
+	assert.LessOrEqual(t, added.Buckets["0.001"], added.Buckets["10"])
+	assert.NotEqual(t, "0", published.Vars().Get("splits").String())
+}
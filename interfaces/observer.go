@@ -0,0 +1,8 @@
+package interfaces
+
+// Observer receives the metrics of a btree: counters, which only grow, and the values of
+// histograms, such as the durations of the operations in seconds
+type Observer interface {
+	Count(metric string, delta int64)
+	Observe(metric string, value float64)
+}
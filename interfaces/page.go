@@ -18,9 +18,11 @@ type Page[DataType any] interface {
 	IsLeaf() bool
 	Item(index int) Item[DataType]
 	Items(items ...Item[DataType]) PageItems[DataType]
-	Offset() int64
+	Next(next ...int64) int64
+	Offset(...int64) int64
 	Parent(parent ...Page[DataType]) Page[DataType]
 	ParentSlotFor(Page[DataType]) int
+	Prev(prev ...int64) int64
 	RemoveChild(Page[DataType])
 	ResetParent()
 	Same(page Page[DataType]) bool
@@ -0,0 +1,11 @@
+package interfaces
+
+// PageCache keeps the pages of several trees by their offset, up to a single limit. The trees
+// share a data file, so no two of them have a page at the same offset. Each page is saved
+// along with its owner, whose pages are released together
+type PageCache interface {
+	Load(offset int64) any
+	Save(owner any, offset int64, page any, updateOnly bool)
+	Invalidate(offset int64)
+	Release(owner any)
+}
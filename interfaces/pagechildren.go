@@ -4,6 +4,7 @@ type PageChildren[DataType any] interface {
 	All() []Page[DataType]
 	BySize(...bool) PageChildren[DataType]
 	ChildFor(Item[DataType]) Page[DataType]
+	Count(int, ...int64) int64
 	First() Page[DataType]
 	Insert(Page[DataType], int)
 	IsFetched() bool
@@ -14,6 +15,7 @@ type PageChildren[DataType any] interface {
 	Pick(...int) PageChildren[DataType]
 	Popped(int) (int64, PageChildren[DataType])
 	Put(int64, ...int)
+	Relocate(map[int64]int64)
 	Set(Page[DataType], ...Page[DataType]) PageChildren[DataType]
 	Siblings(Page[DataType]) PageChildren[DataType]
 	Size() int
@@ -5,6 +5,7 @@ type PageItems[DataType any] interface {
 	Last() Item[DataType]
 	Item(int) Item[DataType]
 	Lookup(Item[DataType]) int
+	LowerSlotFor(Item[DataType]) int
 	Pop(int) Item[DataType]
 	Split() ([]Item[DataType], []Item[DataType], int)
 	ToSlice() []Item[DataType]
@@ -1,12 +1,26 @@
 package interfaces
 
+import "io"
+
 type Persistence[DataType any] interface {
+	AllocatedPages() (int64, error)
+	Backup(io.Writer) error
+	Begin()
+	Close() error
+	Commit() error
+	DiskSize() (int64, error)
 	LoadRoot() (Page[DataType], error)
 	Load(int64, ...bool) Page[DataType]
 	LoadSize() (int64, error)
 	NewPage(...bool) (Page[DataType], error)
+	PageSize() int64
+	Release(int64)
+	Relocate(int64) (int64, error)
 	Reset()
+	Rollback() error
 	Save(Page[DataType]) error
 	SaveRootReference(int64) error
 	SaveSize(int64) error
+	Snapshot() (Persistence[DataType], error)
+	Sync() error
 }
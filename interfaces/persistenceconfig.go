@@ -1,8 +1,24 @@
 package interfaces
 
+import "reflect"
+
 type PersistenceConfig[DataType any] struct {
 	Path            string
 	PageConstructor func(int64) Page[DataType]
 	ItemConstructor func() Item[DataType]
 	CacheSize       uint32
+	ItemType        reflect.Type
+	Exclusive       bool
+	ReadOnly        bool
+	CopyOnWrite     bool
+	SubtreeCounts   bool
+	Ordering        string
+	BPlus           bool
+	Reset           bool
+	Compress        bool
+	EncryptionKey   []byte
+	WriteBehind     *WriteBehind
+	Observer        Observer
+	Shared          SharedFile
+	Header          int64
 }
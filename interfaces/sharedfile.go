@@ -0,0 +1,23 @@
+package interfaces
+
+import "os"
+
+// SharedFile is a data file holding several trees, which take their pages from it in turn and
+// share the cache of its pages. The bytes the trees write go through it, so that a transaction
+// can keep them until it commits
+type SharedFile interface {
+	Acquire(header int64) error
+	Allocate(size int64) (int64, error)
+	Begin() error
+	Catalog() int64
+	Close() error
+	Commit() error
+	File() *os.File
+	Lookup(offset int64, size int64) ([]byte, bool)
+	NewHeader() (int64, error)
+	Pages() PageCache
+	Release(header int64)
+	Rollback() error
+	Sync() error
+	Write(b []byte, offset int64, header bool) error
+}
@@ -0,0 +1,10 @@
+package interfaces
+
+import "time"
+
+// WriteBehind tells when the pages saved to a data file are written to it in the background
+type WriteBehind struct {
+	FlushPages    int
+	FlushInterval time.Duration
+	MaxDirtyPages int
+}
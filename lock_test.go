@@ -0,0 +1,47 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package main_test
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/mylux/bsistent/btree"
+	"github.com/stretchr/testify/assert"
+)
+
+// holdLock locks the data file through a separate descriptor, as another process would
+func holdLock(t *testing.T, path string, how int) func() {
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	assert.NoError(t, syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB))
+	return func() { f.Close() }
+}
+
+func TestLocked(t *testing.T) {
+	path := "/tmp/unit-test-btree-locked"
+	config := btree.Configuration[int64]().Grade(5).ItemSize(8)
+	bt, err := btree.Open(path, config.Reset())
+	assert.NoError(t, err)
+	assert.NoError(t, bt.BulkLoad(generateUniqueInts(treeSize)...))
+	assert.NoError(t, bt.Close())
+
+	release := holdLock(t, path, syscall.LOCK_SH)
+	_, err = btree.Open(path, btree.Configuration[int64]().Grade(5).ItemSize(8))
+	assert.ErrorIs(t, err, btree.ErrLocked)
+	reader, err := btree.Open(path, btree.Configuration[int64]().Grade(5).ItemSize(8).ReadOnly())
+	assert.NoError(t, err)
+	assert.Equal(t, treeSize, reader.Size())
+	assert.NoError(t, reader.Close())
+	release()
+
+	release = holdLock(t, path, syscall.LOCK_EX)
+	_, err = btree.Open(path, btree.Configuration[int64]().Grade(5).ItemSize(8).ReadOnly())
+	assert.ErrorIs(t, err, btree.ErrLocked)
+	release()
+
+	writer, err := btree.Open(path, btree.Configuration[int64]().Grade(5).ItemSize(8))
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+}
@@ -5,7 +5,7 @@ import (
 	"time"
 
 	"github.com/mylux/bsistent/btree"
-	"github.com/mylux/bsistent/interfaces"
+	"github.com/mylux/bsistent/utils"
 	"golang.org/x/exp/rand"
 )
 
@@ -31,22 +31,8 @@ func generateUniqueInts(size int64) []int64 {
 	return uniqueInts
 }
 
-func countPage(p interfaces.Page[int64]) int {
-	var res int = 0
-	children := p.Children()
-	if children.IsFetched() {
-		if !p.IsLeaf() {
-			for i := range p.Size() + 1 {
-				res += countPage(p.Child(i))
-			}
-		}
-		res += p.Size()
-	}
-	return res
-}
-
-func count(b *btree.Btree[int64]) int {
-	return countPage(b.Root())
+func count(b *btree.Btree[int64]) int64 {
+	return utils.ReturnOrPanic(func() (*btree.Stats, error) { return b.Stats() }).Items
 }
 
 func main() {
@@ -71,7 +57,7 @@ func main() {
 		c := count(b)
 		fmt.Printf("Item count %d vs %d\n", c, b.Size())
 
-		if b.Size() > 0 && c < b.Root().Size() {
+		if b.Size() > 0 && c < int64(b.Root().Size()) {
 			fmt.Println("Tree seems to be partially loaded")
 		}
 	}
@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"math"
+	"strconv"
+	"sync"
+)
+
+// Buckets are the upper bounds, in seconds, of the buckets the histograms count their values in
+var Buckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Expvar publishes the metrics of btrees through expvar, as a map of the counters and the
+// histograms. Several btrees can report to the same Expvar, which then adds their metrics up
+type Expvar struct {
+	sync.Mutex
+	vars *expvar.Map
+}
+
+// NewExpvar publishes the metrics under the given name, which must not be published already
+func NewExpvar(name string) *Expvar {
+	return &Expvar{vars: expvar.NewMap(name)}
+}
+
+func (e *Expvar) Count(metric string, delta int64) {
+	e.vars.Add(metric, delta)
+}
+
+func (e *Expvar) Observe(metric string, value float64) {
+	e.histogram(metric).observe(value)
+}
+
+// Vars returns the map holding the metrics
+func (e *Expvar) Vars() *expvar.Map {
+	return e.vars
+}
+
+func (e *Expvar) histogram(metric string) *Histogram {
+	if h, found := e.vars.Get(metric).(*Histogram); found {
+		return h
+	}
+	e.Lock()
+	defer e.Unlock()
+	// another goroutine may have added it in the meantime
+	if h, found := e.vars.Get(metric).(*Histogram); found {
+		return h
+	}
+	h := &Histogram{min: math.Inf(1), max: math.Inf(-1), buckets: make([]int64, len(Buckets))}
+	e.vars.Set(metric, h)
+	return h
+}
+
+// Histogram sums up the values observed for a metric, and counts them in the fixed Buckets
+// so their percentiles can be worked out
+type Histogram struct {
+	sync.Mutex
+	count   int64
+	sum     float64
+	min     float64
+	max     float64
+	buckets []int64
+}
+
+func (h *Histogram) observe(value float64) {
+	h.Lock()
+	defer h.Unlock()
+	h.count++
+	h.sum += value
+	h.min = min(h.min, value)
+	h.max = max(h.max, value)
+	for i, bound := range Buckets {
+		if value <= bound {
+			h.buckets[i]++
+			break
+		}
+	}
+}
+
+// String returns the histogram as JSON, as expvar requires. The buckets are keyed by their upper
+// bound and hold the number of values up to it, as Prometheus does, the last one being "+Inf"
+func (h *Histogram) String() string {
+	h.Lock()
+	defer h.Unlock()
+	buckets := map[string]int64{"+Inf": h.count}
+	var cumulative int64
+	for i, bound := range Buckets {
+		cumulative += h.buckets[i]
+		buckets[strconv.FormatFloat(bound, 'g', -1, 64)] = cumulative
+	}
+	summary := map[string]any{"count": h.count, "sum": h.sum, "buckets": buckets}
+	if h.count > 0 {
+		summary["min"], summary["max"], summary["mean"] = h.min, h.max, h.sum/float64(h.count)
+	}
+	b, _ := json.Marshal(summary)
+	return string(b)
+}
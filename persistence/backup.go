@@ -0,0 +1,201 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var backupMagic = [8]byte{'B', 'S', 'B', 'A', 'C', 'K', 'U', 'P'}
+
+const backupVersion uint32 = 3
+
+// backupHeaderV1 is the header of the first version of the backup streams
+type backupHeaderV1 struct {
+	Magic      [8]byte
+	Version    uint32
+	PageSize   int64
+	Root       int64
+	Size       int64
+	DataLength int64
+}
+
+// backupHeader opens a backup stream. It is followed by the pages of the data file and a
+// CRC-32 checksum of everything before it. Version 2 added the fingerprint of the ordering,
+// and version 3 the encryption of the pages
+type backupHeader struct {
+	backupHeaderV1
+	Ordering   uint64
+	Encryption backupEncryption
+}
+
+// backupEncryption tells whether the pages of a backup are encrypted, in which case they are
+// copied as they are, along with the key check of the file
+type backupEncryption struct {
+	Encrypted bool
+	KeyCheck  [checkSize]byte
+}
+
+// Backup writes the tree last saved into the data file, or the version pinned by a snapshot,
+// as a backup stream
+func (d *DataFileBtreePersistence[DataType]) Backup(w io.Writer) error {
+	if d.shared != nil {
+		return fmt.Errorf("the pages of a tree sharing its file with others cannot be copied as they are")
+	}
+	if d.writes != nil {
+		// the pages are copied from the file, so the ones waiting to be written are written first
+		if err := d.writes.flush(); err != nil {
+			return err
+		}
+	}
+	pages, err := d.AllocatedPages()
+	if err != nil {
+		return err
+	}
+	header := backupHeader{
+		backupHeaderV1: backupHeaderV1{
+			Magic:      backupMagic,
+			Version:    backupVersion,
+			PageSize:   d.slotSize,
+			Root:       d.rootOffset,
+			Size:       d.size,
+			DataLength: pages * d.slotSize,
+		},
+		Ordering: d.ordering,
+	}
+	if d.cipher != nil {
+		header.Encryption.Encrypted = true
+		if header.Encryption.KeyCheck, err = readKeyCheck(d.fd); err != nil {
+			return err
+		}
+	}
+	checksum := crc32.NewIEEE()
+	out := io.MultiWriter(w, checksum)
+	if err = binary.Write(out, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	var data io.Reader = io.NewSectionReader(d.fd, d.header.data, header.DataLength)
+	if d.table != nil {
+		// the pages are written uncompressed, so the backup restores as an uncompressed file
+		data = &tableReader{table: d.table, pages: pages, pageSize: d.pageSize}
+	}
+	if _, err = io.Copy(out, data); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, checksum.Sum32())
+}
+
+// Restore recreates the data file at the given path from a backup stream. The stream is
+// validated before the file is replaced, which requires it not to be open anywhere else
+func Restore(r io.Reader, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		key, err := registerOpenFile(path, true, false)
+		if err != nil {
+			return err
+		}
+		defer unregisterOpenFile(key)
+	}
+	temp, err := os.CreateTemp(filepath.Dir(path), ".bsistent-restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if err = restoreInto(bufio.NewReader(r), temp); err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+func restoreInto(r io.Reader, f *os.File) error {
+	var header backupHeader
+	var stored uint32
+	checksum := crc32.NewIEEE()
+	in := io.TeeReader(r, checksum)
+	if err := binary.Read(in, binary.LittleEndian, &header.backupHeaderV1); err != nil {
+		return fmt.Errorf("invalid backup: %w", err)
+	}
+	if header.Version >= 2 {
+		if err := binary.Read(in, binary.LittleEndian, &header.Ordering); err != nil {
+			return fmt.Errorf("invalid backup: %w", err)
+		}
+	}
+	if header.Version >= 3 {
+		if err := binary.Read(in, binary.LittleEndian, &header.Encryption); err != nil {
+			return fmt.Errorf("invalid backup: %w", err)
+		}
+	}
+	if err := header.validate(); err != nil {
+		return err
+	}
+	if err := writeHeader(f, &header); err != nil {
+		return err
+	}
+	if n, err := io.Copy(f, io.LimitReader(in, header.DataLength)); err != nil {
+		return err
+	} else if n < header.DataLength {
+		return fmt.Errorf("invalid backup: expected %d bytes of pages, found %d", header.DataLength, n)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &stored); err != nil {
+		return fmt.Errorf("invalid backup: missing checksum: %w", err)
+	}
+	if stored != checksum.Sum32() {
+		return errors.New("invalid backup: checksum mismatch")
+	}
+	return nil
+}
+
+func (h *backupHeader) validate() error {
+	data := headerFor(h.Ordering, false, h.Encryption.Encrypted).data
+	switch {
+	case h.Magic != backupMagic:
+		return errors.New("invalid backup: not a bsistent backup")
+	case h.Version < 1 || h.Version > backupVersion:
+		return fmt.Errorf("invalid backup: unsupported version %d", h.Version)
+	case h.PageSize <= 0 || h.DataLength < 0 || h.DataLength%h.PageSize != 0:
+		return fmt.Errorf("invalid backup: %d bytes of pages do not fit pages of %d bytes", h.DataLength, h.PageSize)
+	case h.Size < 0:
+		return fmt.Errorf("invalid backup: negative tree size %d", h.Size)
+	case h.Root != 0 && (h.Root < data || h.Root >= data+h.DataLength || (h.Root-data)%h.PageSize != 0):
+		return fmt.Errorf("invalid backup: root reference %d is not a page", h.Root)
+	}
+	return nil
+}
+
+func writeHeader(w io.Writer, h *backupHeader) error {
+	var header bytes.Buffer
+	fields := []int64{h.Root, h.Size}
+	if h.Encryption.Encrypted {
+		// the restored file is a new one, so its write counter starts over at a random point
+		counter, err := randomCounter()
+		if err != nil {
+			return err
+		}
+		fields = []int64{encryptedMarker, int64(h.Ordering), h.Root, h.Size, counter}
+	} else if h.Ordering != 0 {
+		fields = append([]int64{orderMarker, int64(h.Ordering)}, fields...)
+	}
+	for _, v := range fields {
+		b, err := encode(v)
+		if err != nil {
+			return err
+		}
+		header.Write(b)
+	}
+	if h.Encryption.Encrypted {
+		header.Write(h.Encryption.KeyCheck[:])
+	}
+	_, err := w.Write(header.Bytes())
+	return err
+}
@@ -0,0 +1,266 @@
+package persistence
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"os"
+	"slices"
+	"sync"
+)
+
+// compressed files start with compressedMarker, followed by the fingerprint of their ordering,
+// the root reference, the size and the first block of their page table
+const (
+	compressedMarker int64 = -3
+	tableOffset      int64 = 32
+	recordsPerBlock  int64 = 512
+	recordSize       int64 = 16
+	blockSize        int64 = 8 + recordsPerBlock*recordSize
+	// recordSlack lets a page grow a little without moving its record
+	recordSlack int64 = 64
+)
+
+// pageRecord tells where the compressed bytes of a page are
+type pageRecord struct {
+	Offset   int64
+	Length   int32
+	Capacity int32
+}
+
+// extent is a stretch of the file holding no record
+type extent struct {
+	offset int64
+	length int64
+}
+
+// pageTable maps the pages of a compressed file, numbered by their offset as if they were not
+// compressed, to their records. It is kept in blocks chained from the header, each starting
+// with the offset of the next one.
+// Pages are always written to a fresh record, so the one the table points to stays whole until
+// the new one is published. The records left behind are kept in abandoned until the change is
+// committed, and then in free to be written over
+type pageTable struct {
+	sync.Mutex
+	fd        *os.File
+	blocks    []int64
+	records   []pageRecord
+	pages     int64
+	end       int64
+	writer    *flate.Writer
+	abandoned []extent
+	free      []extent
+}
+
+// loadPageTable reads the page table of a compressed file, starting it in a new file
+func loadPageTable[DataType any](d *DataFileBtreePersistence[DataType]) (*pageTable, error) {
+	size, err := d.DiskSize()
+	if err != nil {
+		return nil, err
+	}
+	writer, _ := flate.NewWriter(nil, flate.BestSpeed)
+	t := &pageTable{fd: d.fd, end: max(size, tableOffset), writer: writer}
+	if size <= tableOffset {
+		if d.readOnly {
+			return t, nil
+		}
+		return t, t.addBlock(tableOffset)
+	}
+	for next := tableOffset; next > 0; {
+		block, err := d.readBytes(next, blockSize)
+		if err != nil {
+			return nil, err
+		}
+		t.blocks = append(t.blocks, next)
+		next = int64(binary.LittleEndian.Uint64(block))
+		for i := range recordsPerBlock {
+			var r pageRecord
+			binary.Read(bytes.NewReader(block[8+i*recordSize:8+(i+1)*recordSize]), binary.LittleEndian, &r)
+			if r.Offset > 0 {
+				t.pages = int64(len(t.records)) + 1
+			}
+			t.records = append(t.records, r)
+		}
+	}
+	t.free = t.unused()
+	return t, nil
+}
+
+// unused finds the stretches of the file between the blocks and the records of the table
+func (t *pageTable) unused() []extent {
+	used := make([]extent, 0, len(t.blocks)+len(t.records))
+	for _, b := range t.blocks {
+		used = append(used, extent{offset: b, length: blockSize})
+	}
+	for _, r := range t.records {
+		if r.Offset > 0 {
+			used = append(used, extent{offset: r.Offset, length: int64(r.Capacity)})
+		}
+	}
+	slices.SortFunc(used, func(a, b extent) int { return int(a.offset - b.offset) })
+	var gaps []extent
+	next := tableOffset
+	for _, u := range used {
+		if u.offset > next {
+			gaps = append(gaps, extent{offset: next, length: u.offset - next})
+		}
+		next = max(next, u.offset+u.length)
+	}
+	return gaps
+}
+
+// readRecord returns the bytes of the page with the given number, which are blank when it
+// was never saved
+func (t *pageTable) readRecord(page int64, pageSize int64) ([]byte, error) {
+	t.Lock()
+	var r pageRecord
+	if page < int64(len(t.records)) {
+		r = t.records[page]
+	}
+	t.Unlock()
+	b := make([]byte, pageSize)
+	if r.Offset == 0 {
+		return b, nil
+	}
+	compressed := make([]byte, r.Length)
+	if _, err := t.fd.ReadAt(compressed, r.Offset); err != nil {
+		return nil, err
+	}
+	reader := flate.NewReader(bytes.NewReader(compressed))
+	defer reader.Close()
+	if _, err := io.ReadFull(reader, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// writeRecord compresses the bytes of the page with the given number into a new record, taken
+// from the free ones or from the end of the file, and then points the table to it. Returns the
+// number of bytes written
+func (t *pageTable) writeRecord(page int64, b []byte) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+	var compressed bytes.Buffer
+	t.writer.Reset(&compressed)
+	if _, err := t.writer.Write(b); err != nil {
+		return 0, err
+	}
+	if err := t.writer.Close(); err != nil {
+		return 0, err
+	}
+	for page >= int64(len(t.records)) {
+		if err := t.addBlock(t.end); err != nil {
+			return 0, err
+		}
+	}
+	length := int64(compressed.Len())
+	// the whole record is written, so the file always covers the records in it
+	capacity := (length + recordSlack - 1) / recordSlack * recordSlack
+	r := pageRecord{Offset: t.take(capacity), Length: int32(length), Capacity: int32(capacity)}
+	data := append(compressed.Bytes(), make([]byte, capacity-length)...)
+	if _, err := t.fd.WriteAt(data, r.Offset); err != nil {
+		t.abandoned = append(t.abandoned, extent{offset: r.Offset, length: capacity})
+		return 0, err
+	}
+	var entry bytes.Buffer
+	binary.Write(&entry, binary.LittleEndian, r)
+	if _, err := t.fd.WriteAt(entry.Bytes(), t.blocks[page/recordsPerBlock]+8+page%recordsPerBlock*recordSize); err != nil {
+		// the entry may point to either record now, so neither is written over until reopened
+		return 0, err
+	}
+	if old := t.records[page]; old.Offset > 0 {
+		t.abandoned = append(t.abandoned, extent{offset: old.Offset, length: int64(old.Capacity)})
+	}
+	t.records[page] = r
+	t.pages = max(t.pages, page+1)
+	return len(data) + entry.Len(), nil
+}
+
+// take returns the offset of a stretch of the given length, from the first free one that is
+// long enough, or from the end of the file
+func (t *pageTable) take(length int64) int64 {
+	for i, e := range t.free {
+		if e.length >= length {
+			if e.length == length {
+				t.free = slices.Delete(t.free, i, i+1)
+			} else {
+				t.free[i] = extent{offset: e.offset + length, length: e.length - length}
+			}
+			return e.offset
+		}
+	}
+	offset := t.end
+	t.end += length
+	return offset
+}
+
+// release frees the records abandoned by the change being committed, whose pages the table
+// points elsewhere now. Neighbouring free records are joined
+func (t *pageTable) release() {
+	t.Lock()
+	defer t.Unlock()
+	if len(t.abandoned) == 0 {
+		return
+	}
+	free := slices.Concat(t.free, t.abandoned)
+	slices.SortFunc(free, func(a, b extent) int { return int(a.offset - b.offset) })
+	t.free, t.abandoned = free[:0], nil
+	for _, e := range free {
+		if n := len(t.free); n > 0 && t.free[n-1].offset+t.free[n-1].length == e.offset {
+			t.free[n-1].length += e.length
+		} else {
+			t.free = append(t.free, e)
+		}
+	}
+}
+
+// addBlock writes an empty block of the page table at the given offset and chains it
+func (t *pageTable) addBlock(offset int64) error {
+	if _, err := t.fd.WriteAt(make([]byte, blockSize), offset); err != nil {
+		return err
+	}
+	if n := len(t.blocks); n > 0 {
+		next := binary.LittleEndian.AppendUint64(nil, uint64(offset))
+		if _, err := t.fd.WriteAt(next, t.blocks[n-1]); err != nil {
+			return err
+		}
+	}
+	t.blocks = append(t.blocks, offset)
+	t.records = append(t.records, make([]pageRecord, recordsPerBlock)...)
+	t.end = max(t.end, offset+blockSize)
+	return nil
+}
+
+func (t *pageTable) allocatedPages() int64 {
+	t.Lock()
+	defer t.Unlock()
+	return t.pages
+}
+
+// tableReader reads the pages of a compressed file in order, as they would be stored
+// uncompressed
+type tableReader struct {
+	table    *pageTable
+	page     int64
+	pages    int64
+	pageSize int64
+	buffer   []byte
+}
+
+func (r *tableReader) Read(p []byte) (int, error) {
+	for len(r.buffer) == 0 {
+		if r.page == r.pages {
+			return 0, io.EOF
+		}
+		b, err := r.table.readRecord(r.page, r.pageSize)
+		if err != nil {
+			return 0, err
+		}
+		r.buffer = b
+		r.page++
+	}
+	n := copy(p, r.buffer)
+	r.buffer = r.buffer[n:]
+	return n, nil
+}
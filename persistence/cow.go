@@ -0,0 +1,320 @@
+package persistence
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/mylux/bsistent/cache"
+	"github.com/mylux/bsistent/interfaces"
+	"github.com/mylux/bsistent/utils"
+)
+
+// versions tracks the commits of a copy-on-write data file, the snapshots pinning them
+// and the pages that can be reused once no snapshot reaches them anymore
+type versions struct {
+	sync.Mutex
+	version   int64
+	root      int64
+	size      int64
+	pins      map[int64]int
+	pending   []int64
+	released  []releasedPage
+	free      []int64
+	fresh     map[int64]bool
+	snapshots int
+	closing   func() error
+	// reclaimed tells whether the pages left behind before the file was opened were freed
+	reclaimed bool
+}
+
+// versionsState is what a transaction changes of the versions, kept to go back to it
+type versionsState struct {
+	version   int64
+	root      int64
+	size      int64
+	pending   []int64
+	released  []releasedPage
+	free      []int64
+	fresh     map[int64]bool
+	reclaimed bool
+}
+
+type releasedPage struct {
+	offset  int64
+	version int64
+}
+
+type snapshotPin struct {
+	version int64
+	root    int64
+	size    int64
+}
+
+func newVersions() *versions {
+	return &versions{pins: map[int64]int{}, fresh: map[int64]bool{}}
+}
+
+// Commit publishes the root reference and the size saved so far as a new version, which
+// snapshots can be taken from. The pages relocated or released since the previous commit
+// are reused once no snapshot of an older version is open, and so are the records compressed
+// pages were moved from
+func (d *DataFileBtreePersistence[DataType]) Commit() error {
+	if d.table != nil {
+		d.table.release()
+	}
+	if d.versions == nil {
+		return nil
+	}
+	v := d.versions
+	v.Lock()
+	defer v.Unlock()
+	v.version++
+	v.root = d.rootOffset
+	v.size = d.size
+	for _, offset := range v.pending {
+		v.released = append(v.released, releasedPage{offset: offset, version: v.version})
+	}
+	v.pending = nil
+	clear(v.fresh)
+	v.recycle()
+	return nil
+}
+
+// Relocate gives a new offset to the page at the given offset, so its changes do not
+// overwrite the committed version. Pages allocated since the last commit keep their offset
+func (d *DataFileBtreePersistence[DataType]) Relocate(offset int64) (int64, error) {
+	if d.versions == nil {
+		return offset, nil
+	}
+	if d.readOnly {
+		return -1, fmt.Errorf("cannot relocate pages of a read-only data file")
+	}
+	if d.versions.isFresh(offset) {
+		return offset, nil
+	}
+	d.Release(offset)
+	return d.allocate(), nil
+}
+
+// Release tells the page at the given offset is no longer part of the tree
+func (d *DataFileBtreePersistence[DataType]) Release(offset int64) {
+	if d.versions == nil {
+		return
+	}
+	v := d.versions
+	d.cache.Invalidate(offset)
+	v.Lock()
+	defer v.Unlock()
+	if v.fresh[offset] {
+		delete(v.fresh, offset)
+		v.free = append(v.free, offset)
+	} else {
+		v.pending = append(v.pending, offset)
+	}
+}
+
+// Snapshot opens a read-only view of the last committed version. The view reads the data
+// file directly, and the pages it reaches are not reused until it is closed
+func (d *DataFileBtreePersistence[DataType]) Snapshot() (interfaces.Persistence[DataType], error) {
+	if d.versions == nil {
+		return nil, fmt.Errorf("snapshots need a copy-on-write data file")
+	}
+	v := d.versions
+	v.Lock()
+	defer v.Unlock()
+	if v.closing != nil {
+		return nil, fmt.Errorf("data file is closed")
+	}
+	pin := &snapshotPin{version: v.version, root: v.root, size: v.size}
+	if d.pin != nil {
+		// a snapshot of a snapshot sees the same version
+		pin = &snapshotPin{version: d.pin.version, root: d.pin.root, size: d.pin.size}
+	}
+	v.pins[pin.version]++
+	v.snapshots++
+	return &DataFileBtreePersistence[DataType]{
+		path:            d.path,
+		registryKey:     d.registryKey,
+		rootOffset:      pin.root,
+		size:            pin.size,
+		lastPageOffset:  d.lastPageOffset,
+		pageSize:        d.pageSize,
+		header:          d.header,
+		ordering:        d.ordering,
+		countsOffset:    d.countsOffset,
+		readOnly:        true,
+		fd:              d.fd,
+		pageConstructor: d.pageConstructor,
+		itemConstructor: d.itemConstructor,
+		itemType:        d.itemType,
+		cache:           cache.New(&cache.Config[DataType]{}),
+		versions:        v,
+		pin:             pin,
+		shared:          d.shared,
+		table:           d.table,
+		cipher:          d.cipher,
+		slotSize:        d.slotSize,
+		writes:          d.writes,
+		observer:        d.observer,
+		sharedHeader:    d.sharedHeader,
+	}, nil
+}
+
+// allocate picks the offset of a new page, reusing the released ones when possible
+func (d *DataFileBtreePersistence[DataType]) allocate(first ...bool) int64 {
+	if len(first) > 0 && first[0] && d.shared == nil {
+		return d.lastPageOffset
+	}
+	if d.versions == nil {
+		return d.genNewOffset()
+	}
+	v := d.versions
+	v.Lock()
+	defer v.Unlock()
+	if !v.reclaimed {
+		v.reclaimed = true
+		utils.PanicOnError(d.reclaim)
+	}
+	var offset int64
+	if n := len(v.free); n > 0 {
+		offset, v.free = v.free[n-1], v.free[:n-1]
+	} else {
+		offset = d.genNewOffset()
+	}
+	v.fresh[offset] = true
+	return offset
+}
+
+// reclaim frees the pages the committed tree does not reach, which were left behind by the
+// changes made before the data file was opened. The tree is walked when the first page is
+// allocated, so opening the file to read it costs nothing. The pages of a database file are
+// not reclaimed, since the ones of the other trees cannot be told apart
+func (d *DataFileBtreePersistence[DataType]) reclaim() error {
+	pages, err := d.AllocatedPages()
+	if err != nil || pages == 0 || d.shared != nil {
+		return err
+	}
+	v := d.versions
+	reached := make([]bool, pages)
+	reach := func(offset int64) bool {
+		page := d.pageNumber(offset)
+		if page >= 0 && page < pages {
+			reached[page] = true
+		}
+		return page >= 0 && page < pages
+	}
+	// the pages released since the file was opened are freed by the commits
+	for _, offset := range slices.Concat(v.pending, v.free) {
+		reach(offset)
+	}
+	for _, r := range v.released {
+		reach(r.offset)
+	}
+	for next := []int64{d.rootOffset}; len(next) > 0; {
+		offset := next[len(next)-1]
+		next = next[:len(next)-1]
+		if !reach(offset) {
+			return fmt.Errorf("%s has a page at offset %d, beyond its end", d.path, offset)
+		}
+		b, err := d.readPageBytes(offset)
+		if err != nil {
+			return err
+		}
+		sp, err := hydratePage(b, d.bplus)
+		if err != nil {
+			return err
+		}
+		for _, c := range sp.Children {
+			if c > 0 {
+				next = append(next, c)
+			}
+		}
+	}
+	// the free pages are taken from the end, so the ones nearest the header go first
+	for page := pages - 1; page >= 0; page-- {
+		if !reached[page] {
+			v.free = append(v.free, d.header.data+page*d.slotSize)
+		}
+	}
+	return nil
+}
+
+// closeSnapshot unpins the version of a snapshot. The data file itself is closed with the
+// last snapshot when the tree was closed before it
+func (d *DataFileBtreePersistence[DataType]) closeSnapshot() error {
+	v := d.versions
+	v.Lock()
+	defer v.Unlock()
+	if d.pin == nil {
+		return fmt.Errorf("snapshot is already closed")
+	}
+	if v.pins[d.pin.version]--; v.pins[d.pin.version] == 0 {
+		delete(v.pins, d.pin.version)
+	}
+	d.pin = nil
+	d.cache.Release()
+	v.recycle()
+	if v.snapshots--; v.snapshots == 0 && v.closing != nil {
+		return v.closing()
+	}
+	return nil
+}
+
+// deferClose runs the closing of the data file right away, or with the last open snapshot
+func (v *versions) deferClose(closing func() error) error {
+	v.Lock()
+	defer v.Unlock()
+	if v.snapshots > 0 {
+		v.closing = closing
+		return nil
+	}
+	v.closing = func() error { return nil }
+	return closing()
+}
+
+func (v *versions) save() *versionsState {
+	v.Lock()
+	defer v.Unlock()
+	return &versionsState{
+		version:   v.version,
+		root:      v.root,
+		size:      v.size,
+		pending:   slices.Clone(v.pending),
+		released:  slices.Clone(v.released),
+		free:      slices.Clone(v.free),
+		fresh:     maps.Clone(v.fresh),
+		reclaimed: v.reclaimed,
+	}
+}
+
+func (v *versions) restore(s *versionsState) {
+	v.Lock()
+	defer v.Unlock()
+	v.version, v.root, v.size = s.version, s.root, s.size
+	v.pending, v.released, v.free, v.fresh = s.pending, s.released, s.free, s.fresh
+	v.reclaimed = s.reclaimed
+}
+
+func (v *versions) isFresh(offset int64) bool {
+	v.Lock()
+	defer v.Unlock()
+	return v.fresh[offset]
+}
+
+// recycle frees the pages released by a commit when every open snapshot is at least as
+// recent as that commit, since older versions are the only ones that can reach them
+func (v *versions) recycle() {
+	oldest := v.version
+	for version := range v.pins {
+		oldest = min(oldest, version)
+	}
+	v.released = slices.DeleteFunc(v.released, func(r releasedPage) bool {
+		if r.version <= oldest {
+			v.free = append(v.free, r.offset)
+			return true
+		}
+		return false
+	})
+}
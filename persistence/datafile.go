@@ -2,76 +2,251 @@ package persistence
 
 import (
 	"fmt"
+	"hash/fnv"
 	"os"
+	"reflect"
+	"time"
 	"unsafe"
 
 	"github.com/mylux/bsistent/cache"
+	"github.com/mylux/bsistent/constants"
 	"github.com/mylux/bsistent/interfaces"
 	"github.com/mylux/bsistent/utils"
 )
 
+// headerLayout places the fields of the header of a data file
+type headerLayout struct {
+	root int64
+	size int64
+	data int64
+}
+
+// the files ordered by a custom comparator, laid out as a B+ tree or keeping subtree counts start
+// with orderMarker, which no root reference can take, followed by the fingerprint of their
+// ordering and layout
 const (
-	initialOffset     int64 = 16
-	sizeOffset        int64 = 8
-	rootPageRefOffset int64 = 0
+	orderMarker       int64 = -1
+	fingerprintOffset int64 = 8
 )
 
+var plainHeader = headerLayout{root: 0, size: 8, data: 16}
+var orderedHeader = headerLayout{root: 16, size: 24, data: 32}
+
 type DataFileBtreePersistence[DataType any] struct {
-	path            string
-	rootOffset      int64
-	lastPageOffset  int64
-	pageSize        int64
+	path           string
+	registryKey    string
+	rootOffset     int64
+	lastPageOffset int64
+	pageSize       int64
+	countsOffset   int64
+	header         headerLayout
+	ordering       uint64
+	// orderingName, bplus and counted make up the ordering fingerprint, and tell a mismatch of
+	// the layout
+	orderingName    string
+	bplus           bool
+	counted         bool
+	resetting       bool
 	locked          bool
+	readOnly        bool
 	fd              *os.File
 	pageConstructor func(int64) interfaces.Page[DataType]
 	itemConstructor func() interfaces.Item[DataType]
+	itemType        reflect.Type
 	cache           *cache.Cache[DataType]
+	size            int64
+	versions        *versions
+	pin             *snapshotPin
+	// shared is the database file holding the tree along with others, at sharedHeader
+	shared       interfaces.SharedFile
+	sharedHeader int64
+	// compress starts new files compressed, whose pages are then found through table
+	compress bool
+	table    *pageTable
+	// cipher seals the pages of an encrypted file, which take slotSize bytes instead of pageSize
+	cipher   *pageCipher
+	slotSize int64
+	// writes keeps the saved pages until they are written in the background
+	writes   *writeBehind
+	observer interfaces.Observer
+	// beforeTransaction is the state of the versions when the transaction in progress began
+	beforeTransaction *versionsState
 }
 
 func New[DataType any](config *interfaces.PersistenceConfig[DataType]) interfaces.Persistence[DataType] {
-	zeroPg := utils.ReturnOrPanic[[]byte](func() ([]byte, error) {
-		return generateEncodedZeroPage(config.PageConstructor(0).Capacity(), config.ItemConstructor().Capacity())
-	})
+	return utils.ReturnOrPanic(func() (interfaces.Persistence[DataType], error) { return Open(config) })
+}
+
+func Open[DataType any](config *interfaces.PersistenceConfig[DataType]) (interfaces.Persistence[DataType], error) {
+	zeroPg, err := generateEncodedZeroPage(config.PageConstructor(0).Capacity(), config.ItemConstructor().Capacity(), config.BPlus)
+	if err != nil {
+		return nil, err
+	}
+	var fd *os.File
+	var key string
+	if config.Shared != nil {
+		if err = config.Shared.Acquire(config.Header); err != nil {
+			return nil, err
+		}
+		fd = config.Shared.File()
+	} else if fd, key, err = openRegistered(config); err != nil {
+		return nil, err
+	}
 
 	r := &DataFileBtreePersistence[DataType]{
 		path:            config.Path,
+		registryKey:     key,
 		pageSize:        int64(len(zeroPg)),
-		fd:              openFile(config.Path),
+		fd:              fd,
 		pageConstructor: config.PageConstructor,
 		itemConstructor: config.ItemConstructor,
-		lastPageOffset:  initialOffset,
+		itemType:        config.ItemType,
+		readOnly:        config.ReadOnly,
+		ordering:        fingerprint(config.Ordering, config.BPlus, config.SubtreeCounts),
+		orderingName:    config.Ordering,
+		bplus:           config.BPlus,
+		counted:         config.SubtreeCounts,
+		resetting:       config.Reset,
+		shared:          config.Shared,
+		compress:        config.Compress,
+		observer:        config.Observer,
+		sharedHeader:    config.Header,
 		cache: cache.New(&cache.Config[DataType]{
 			Limit:         config.CacheSize,
 			PageGenerator: func() interfaces.Page[DataType] { return config.PageConstructor(0) },
 		}),
 	}
-	utils.PanicOnError(func() error { return loadTreeSize(r) })
-	utils.PanicOnError(func() error { return loadRootPageReference(r) })
+	if config.Shared != nil {
+		r.cache = cache.Shared[DataType](config.Shared.Pages())
+	}
+	if config.SubtreeCounts {
+		// the counts follow the page, so the layout of the pages without them is unchanged
+		r.countsOffset = r.pageSize
+		r.pageSize += int64(utils.ReturnOrPanic(func() (int, error) {
+			return serializer.SizeOf(make([]int64, config.PageConstructor(0).Capacity()+1))
+		}))
+	}
+	r.slotSize = r.pageSize
+	if config.EncryptionKey != nil {
+		if r.cipher, err = newPageCipher(config.EncryptionKey, fd); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	if r.shared != nil {
+		err = loadSharedHeader(r, config.Header)
+	} else {
+		err = loadOrdering(r)
+	}
+	if err == nil && r.readOnly {
+		err = checkHeader(r)
+	} else if err == nil {
+		if err = loadTreeSize(r); err == nil {
+			err = loadRootPageReference(r)
+		}
+	}
+	if err == nil && r.shared == nil {
+		err = restoreLastPageOffset(r)
+	}
+	if config.CopyOnWrite && !r.readOnly {
+		r.versions = newVersions()
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	if config.WriteBehind != nil && !r.readOnly {
+		r.writes = startWriteBehind(fd, *config.WriteBehind)
+	}
+	return r, nil
+}
 
-	return r
+// AllocatedPages returns the number of pages in the data file, which is not known for a tree
+// sharing its file with others
+func (d *DataFileBtreePersistence[DataType]) AllocatedPages() (int64, error) {
+	if d.shared != nil {
+		return 0, nil
+	}
+	if d.table != nil {
+		return d.table.allocatedPages(), nil
+	}
+	size, err := d.DiskSize()
+	if d.writes != nil {
+		size = d.writes.size(size)
+	}
+	if err != nil || size < d.header.data+d.slotSize {
+		return 0, err
+	}
+	return (size - d.header.data) / d.slotSize, nil
+}
+
+func (d *DataFileBtreePersistence[DataType]) Close() error {
+	if d.pin != nil {
+		return d.closeSnapshot()
+	}
+	if d.versions != nil {
+		d.cache.Release()
+		return d.versions.deferClose(d.close)
+	}
+	return d.close()
+}
+
+func (d *DataFileBtreePersistence[DataType]) close() error {
+	var err error
+	if d.writes != nil {
+		err, d.writes = d.writes.close(), nil
+	}
+	if d.shared != nil {
+		// the file is closed along with the database
+		d.cache.Release()
+		d.shared.Release(d.sharedHeader)
+		return err
+	}
+	defer unregisterOpenFile(d.registryKey)
+	d.cache.Release()
+	if err == nil {
+		err = d.Sync()
+	}
+	if err != nil {
+		d.fd.Close()
+		return err
+	}
+	return d.fd.Close()
+}
+
+func (d *DataFileBtreePersistence[DataType]) DiskSize() (int64, error) {
+	st, err := d.fd.Stat()
+	if err != nil {
+		return -1, err
+	}
+	return st.Size(), nil
 }
 
 func (d *DataFileBtreePersistence[DataType]) Load(offset int64, children ...bool) interfaces.Page[DataType] {
 	if pCache := d.loadPageFromCache(offset); pCache != nil {
+		d.count(constants.MetricCacheHits, 1)
 		return pCache
 	}
+	d.count(constants.MetricCacheMisses, 1)
 	defer d.Unlock()
 	if !d.locked {
 		d.Lock()
 		b := utils.ReturnOrPanic(func() ([]byte, error) { return d.readPageBytes(offset) })
-		sp := utils.ReturnOrPanic(func() (*SerializedPage, error) { return hydratePage(b) })
+		d.count(constants.MetricPageReads, 1)
+		sp := utils.ReturnOrPanic(func() (*SerializedPage, error) { return hydratePage(b, d.bplus) })
 		items := make([]interfaces.Item[DataType], 0, sp.Capacity)
 		r := d.pageConstructor(offset)
 		for _, si := range sp.Items {
 			item := d.itemConstructor()
 			if !si.Empty {
-				var itemValue DataType
-				utils.PanicOnError(func() error { return decode(si.Content, &itemValue) })
+				itemValue := utils.ReturnOrPanic(func() (DataType, error) { return d.decodeItem(si.Content) })
 				item.Load(itemValue)
 				items = append(items, item)
 			}
 		}
 		r.Items(items...)
+		r.Next(sp.Next)
+		r.Prev(sp.Prev)
 		for _, c := range sp.Children {
 			if c > 0 {
 				if len(children) > 0 && children[0] {
@@ -81,25 +256,40 @@ func (d *DataFileBtreePersistence[DataType]) Load(offset int64, children ...bool
 				}
 			}
 		}
+		if d.countsOffset > 0 {
+			d.loadCounts(r, sp, b[d.countsOffset:])
+		}
 		d.cache.Save(r)
 		return r
 	}
 	return nil
 }
 
-func (d *DataFileBtreePersistence[DataType]) LoadRoot() (interfaces.Page[DataType], error) {
+func (d *DataFileBtreePersistence[DataType]) LoadRoot() (root interfaces.Page[DataType], err error) {
 	if d.rootOffset > 0 {
+		d.publishOpeningState()
+		// a root that cannot be loaded fails the opening, which then closes the data file
+		defer func() {
+			if r := recover(); r != nil {
+				e, isError := r.(error)
+				if !isError {
+					panic(r)
+				}
+				root, err = nil, e
+			}
+		}()
 		return d.Load(d.rootOffset), nil
 	}
 	p, err := d.NewPage(true)
 	d.rootOffset = int64(p.Offset())
 	d.SaveRootReference(d.rootOffset)
+	d.publishOpeningState()
 	return p, err
 }
 
 func (d *DataFileBtreePersistence[DataType]) LoadReference() (int64, error) {
 	var r int64
-	b, err := d.readBytes(rootPageRefOffset, int64(unsafe.Sizeof(rootPageRefOffset)))
+	b, err := d.readBytes(d.header.root, int64(unsafe.Sizeof(d.header.root)))
 	if err != nil {
 		return -1, err
 	}
@@ -113,11 +303,15 @@ func (d *DataFileBtreePersistence[DataType]) LoadReference() (int64, error) {
 
 func (d *DataFileBtreePersistence[DataType]) LoadSize() (int64, error) {
 	var size int64
-	b, err := d.readBytes(sizeOffset, int64(unsafe.Sizeof(sizeOffset)))
+	if d.pin != nil {
+		return d.size, nil
+	}
+	b, err := d.readBytes(d.header.size, int64(unsafe.Sizeof(d.header.size)))
 	if err != nil {
 		return -1, err
 	}
 	err = decode(b, &size)
+	d.size = size
 	return size, err
 }
 
@@ -129,16 +323,43 @@ func (d *DataFileBtreePersistence[DataType]) NewPage(first ...bool) (interfaces.
 	defer d.Unlock()
 	if !d.locked {
 		d.Lock()
-		err := d.reservePage(first...)
-		return d.pageConstructor(d.lastPageOffset), err
+		offset := d.allocate(first...)
+		err := d.savePageBytes(make([]byte, d.pageSize), offset)
+		return d.pageConstructor(offset), err
 	}
 	return nil, fmt.Errorf("data file temporarily locked")
 }
 
+func (d *DataFileBtreePersistence[DataType]) PageSize() int64 {
+	return d.pageSize
+}
+
 func (d *DataFileBtreePersistence[DataType]) Reset() {
 	d.rootOffset = 0
-	d.lastPageOffset = initialOffset
+	if d.writes != nil {
+		d.writes.discard()
+	}
+	if d.versions != nil {
+		d.versions = newVersions()
+	}
+	if d.shared != nil {
+		// the pages of the other trees stay, so the old pages of this one are left unused
+		utils.PanicOnError(func() error { return d.SaveRootReference(0) })
+		utils.PanicOnError(func() error { return d.SaveSize(0) })
+		return
+	}
 	utils.PanicOnError(func() error { return d.fd.Truncate(0) })
+	utils.PanicOnError(func() error { return writeOrdering(d) })
+	// the file starts over in the configured format
+	d.header, d.table = headerFor(d.ordering, d.compress, d.cipher != nil), nil
+	d.lastPageOffset = d.header.data
+	if d.compress {
+		d.table = utils.ReturnOrPanic(func() (*pageTable, error) { return loadPageTable(d) })
+	}
+	if d.cipher != nil {
+		// the counter goes on from where it was, so no nonce is taken twice
+		utils.PanicOnError(d.cipher.start)
+	}
 	utils.PanicOnError(func() error { return loadTreeSize(d) })
 }
 
@@ -146,7 +367,14 @@ func (d *DataFileBtreePersistence[DataType]) Save(p interfaces.Page[DataType]) e
 	defer d.Unlock()
 	if !d.locked {
 		d.Lock()
-		b, err := serializePage[DataType](p)
+		if p.IsEmpty() {
+			// an empty page has no item to take the layout from, and blank bytes load as an empty page
+			return d.savePageBytes(make([]byte, d.pageSize), p.Offset())
+		}
+		b, err := serializePage[DataType](p, d.bplus)
+		if err == nil && d.countsOffset > 0 {
+			b, err = serializeCounts(p, b)
+		}
 		if err != nil {
 			return err
 		}
@@ -164,7 +392,9 @@ func (d *DataFileBtreePersistence[DataType]) SaveRootReference(offset int64) err
 	if err != nil {
 		return err
 	}
-	_, err = d.saveBytes(o, rootPageRefOffset)
+	if err = d.saveHeaderField(o, d.header.root); err == nil {
+		d.rootOffset = offset
+	}
 	return err
 }
 
@@ -173,7 +403,25 @@ func (d *DataFileBtreePersistence[DataType]) SaveSize(size int64) error {
 	if err != nil {
 		return err
 	}
-	_, err = d.saveBytes(s, sizeOffset)
+	if err = d.saveHeaderField(s, d.header.size); err == nil {
+		d.size = size
+	}
+	return err
+}
+
+// Sync writes the pages waiting to be written in the background, and flushes the data file
+func (d *DataFileBtreePersistence[DataType]) Sync() error {
+	if d.writes != nil {
+		if err := d.writes.flush(); err != nil {
+			return err
+		}
+	}
+	if d.observer == nil {
+		return d.fd.Sync()
+	}
+	start := time.Now()
+	err := d.fd.Sync()
+	d.observer.Observe(constants.MetricSync, time.Since(start).Seconds())
 	return err
 }
 
@@ -181,42 +429,124 @@ func (d *DataFileBtreePersistence[DataType]) Unlock() {
 	d.locked = false
 }
 
+func (d *DataFileBtreePersistence[DataType]) decodeItem(b []byte) (DataType, error) {
+	var itemValue DataType
+	if d.itemType != nil && reflect.TypeFor[DataType]().Kind() == reflect.Interface {
+		// the tree type carries no layout, so the items are decoded into the type of the configured shape
+		v := reflect.New(d.itemType)
+		if err := decode(b, v.Interface()); err != nil {
+			return itemValue, err
+		}
+		return v.Elem().Interface().(DataType), nil
+	}
+	return itemValue, decode(b, &itemValue)
+}
+
 func (d *DataFileBtreePersistence[DataType]) genNewOffset() int64 {
-	d.lastPageOffset += (d.pageSize)
+	if d.shared != nil {
+		d.lastPageOffset = utils.ReturnOrPanic(func() (int64, error) { return d.shared.Allocate(d.pageSize) })
+		return d.lastPageOffset
+	}
+	d.lastPageOffset += (d.slotSize)
 	return d.lastPageOffset
 }
 
+// count adds to a counter of the observer, when there is one
+func (d *DataFileBtreePersistence[DataType]) count(metric string, delta int64) {
+	if d.observer != nil {
+		d.observer.Count(metric, delta)
+	}
+}
+
 func (d *DataFileBtreePersistence[DataType]) loadPageFromCache(offset int64) interfaces.Page[DataType] {
 	return d.cache.Load(offset)
 }
 
-func (d *DataFileBtreePersistence[DataType]) reservePage(first ...bool) error {
-	if len(first) > 0 && first[0] {
-		return d.savePageBytes(make([]byte, d.pageSize), d.lastPageOffset)
+// publishOpeningState makes the tree found when opening a copy-on-write data file
+// available to snapshots until the first commit
+func (d *DataFileBtreePersistence[DataType]) publishOpeningState() {
+	if d.versions != nil && d.pin == nil {
+		d.versions.Lock()
+		defer d.versions.Unlock()
+		if d.versions.version == 0 {
+			d.versions.root = d.rootOffset
+			d.versions.size = d.size
+		}
 	}
-	return d.savePageBytes(make([]byte, d.pageSize), d.genNewOffset())
 }
 
 func (d *DataFileBtreePersistence[DataType]) saveBytes(b []byte, offset int64) (int, error) {
 	return d.fd.WriteAt(b, int64(offset))
 }
 
+// saveHeaderField writes a field of the header, after the pages saved before it when they
+// are written in the background
+func (d *DataFileBtreePersistence[DataType]) saveHeaderField(b []byte, offset int64) error {
+	if d.writes != nil {
+		return d.writes.save(b, offset, true)
+	}
+	if d.shared != nil {
+		return d.shared.Write(b, offset, true)
+	}
+	_, err := d.saveBytes(b, offset)
+	return err
+}
+
 func (d *DataFileBtreePersistence[DataType]) savePageBytes(b []byte, offset int64) error {
+	d.count(constants.MetricPageWrites, 1)
+	if d.table != nil {
+		written, err := d.table.writeRecord(d.pageNumber(offset), b)
+		d.count(constants.MetricBytesWritten, int64(written))
+		return err
+	}
+	if d.cipher != nil {
+		var err error
+		if b, err = d.cipher.seal(offset, b); err != nil {
+			return err
+		}
+	}
+	d.count(constants.MetricBytesWritten, int64(len(b)))
+	if d.writes != nil {
+		return d.writes.save(b, offset, false)
+	}
+	if d.shared != nil {
+		return d.shared.Write(b, offset, false)
+	}
 	r, err := d.saveBytes(b, offset)
-	if int64(r) < d.pageSize && err == nil {
-		return fmt.Errorf("expected to write %d bytes, but only %d were written", d.pageSize, r)
+	if r < len(b) && err == nil {
+		return fmt.Errorf("expected to write %d bytes, but only %d were written", len(b), r)
 	}
 	return err
 }
 
 func (d *DataFileBtreePersistence[DataType]) readBytes(offset int64, size int64) ([]byte, error) {
+	if d.writes != nil {
+		if b, found := d.writes.lookup(offset, size); found {
+			return b, nil
+		}
+	}
+	if d.shared != nil {
+		if b, found := d.shared.Lookup(offset, size); found {
+			return b, nil
+		}
+	}
 	b := make([]byte, size)
 	_, err := d.fd.ReadAt(b, int64(offset))
 	return b, err
 }
 
+func (d *DataFileBtreePersistence[DataType]) pageNumber(offset int64) int64 {
+	return (offset - d.header.data) / d.slotSize
+}
+
 func (d *DataFileBtreePersistence[DataType]) readPageBytes(offset int64) ([]byte, error) {
-	b, err := d.readBytes(offset, d.pageSize)
+	if d.table != nil {
+		return d.table.readRecord(d.pageNumber(offset), d.pageSize)
+	}
+	b, err := d.readBytes(offset, d.slotSize)
+	if err == nil && d.cipher != nil {
+		return d.cipher.open(offset, b)
+	}
 	return b, err
 }
 
@@ -236,16 +566,233 @@ func loadRootPageReference[DataType any](d *DataFileBtreePersistence[DataType])
 	return err
 }
 
-func openFile(path string) *os.File {
-	file, err := os.OpenFile(path, os.O_RDWR, 0666)
+// checkHeader makes sure a data file opened read-only already holds a tree, since its header
+// cannot be initialized
+func checkHeader[DataType any](d *DataFileBtreePersistence[DataType]) error {
+	if d.shared != nil {
+		root, err := d.LoadReference()
+		if err == nil && root == 0 {
+			err = fmt.Errorf("the tree was never written and cannot be opened read-only")
+		}
+		return err
+	}
+	pages, err := d.AllocatedPages()
+	if err != nil {
+		return err
+	}
+	if pages == 0 {
+		return fmt.Errorf("%s holds no tree and cannot be opened read-only", d.path)
+	}
+	_, err = d.LoadReference()
+	return err
+}
+
+// restoreLastPageOffset points the allocation at the last page of an existing data file,
+// so the pages created after reopening it are appended instead of overwriting live ones.
+// Pages are reserved on disk as soon as they are created, so the file size covers all of them
+func restoreLastPageOffset[DataType any](d *DataFileBtreePersistence[DataType]) error {
+	pages, err := d.AllocatedPages()
+	if err != nil {
+		return err
+	}
+	d.lastPageOffset = d.header.data + max(pages-1, 0)*d.slotSize
+	return nil
+}
+
+// loadOrdering makes sure the data file is ordered and encrypted as configured and picks its
+// header layout. A file holding no tree yet takes the configured ordering and encryption
+func loadOrdering[DataType any](d *DataFileBtreePersistence[DataType]) error {
+	size, err := d.DiskSize()
 	if err != nil {
-		if os.IsNotExist(err) {
-			newFile := utils.ReturnOrPanic[*os.File](func() (*os.File, error) { return os.Create(path) })
-			newFile.Close()
-			file = utils.ReturnOrPanic[*os.File](func() (*os.File, error) { return os.OpenFile(path, os.O_RDWR, 0666) })
-		} else {
-			panic(err)
+		return err
+	}
+	var found int64
+	// files keep the format they were started with, new ones take the configured one
+	compressed, encrypted := d.compress, d.cipher != nil
+	if size >= fingerprintOffset {
+		marker, err := d.readHeaderField(0)
+		if err == nil && marker == dbMarker {
+			return fmt.Errorf("%s is a database file, its trees are opened through it", d.path)
+		} else if err == nil && (marker == orderMarker || marker == compressedMarker || marker == encryptedMarker) {
+			found, err = d.readHeaderField(fingerprintOffset)
+		}
+		if err != nil {
+			return err
+		}
+		compressed, encrypted = marker == compressedMarker, marker == encryptedMarker
+	}
+	if uint64(found) != d.ordering || encrypted != (d.cipher != nil) {
+		// a tree about to be reset may change its ordering and its encryption
+		// the pages of another layout may be smaller than the configured ones
+		written := size > headerFor(uint64(found), compressed, encrypted).data || compressed && size > tableOffset
+		if written && !d.resetting {
+			return formatError(d, uint64(found), encrypted)
+		}
+		if !d.readOnly {
+			if err = d.fd.Truncate(0); err != nil {
+				return err
+			}
+			size, compressed, encrypted = 0, d.compress, d.cipher != nil
+		}
+	}
+	if encrypted && d.cipher == nil {
+		return formatError(d, uint64(found), encrypted)
+	} else if !encrypted {
+		d.cipher = nil
+	}
+	d.header = headerFor(d.ordering, compressed, encrypted)
+	d.lastPageOffset = d.header.data
+	if size < fingerprintOffset && !d.readOnly {
+		if err = writeOrdering(d); err != nil {
+			return err
+		}
+	}
+	if compressed {
+		d.table, err = loadPageTable(d)
+	}
+	if encrypted {
+		d.slotSize = d.pageSize + d.cipher.overhead()
+		err = d.cipher.load(size >= d.header.data, d.readOnly)
+	}
+	return err
+}
+
+// formatError tells why a data file cannot be opened with the configured ordering, layout and
+// encryption
+func formatError[DataType any](d *DataFileBtreePersistence[DataType], found uint64, encrypted bool) error {
+	switch {
+	case found != d.ordering:
+		return d.orderingError(d.path, found)
+	case encrypted:
+		return fmt.Errorf("%w: %s is encrypted, but no key was given", constants.ErrEncryption, d.path)
+	default:
+		return fmt.Errorf("%s is not encrypted, it can be compacted into an encrypted file", d.path)
+	}
+}
+
+func (d *DataFileBtreePersistence[DataType]) readHeaderField(offset int64) (int64, error) {
+	var v int64
+	b, err := d.readBytes(offset, int64(unsafe.Sizeof(v)))
+	if err == nil {
+		err = decode(b, &v)
+	}
+	return v, err
+}
+
+// writeOrdering starts the header of a file ordered by a custom comparator, compressed or
+// encrypted. Other files have nothing to write
+func writeOrdering[DataType any](d *DataFileBtreePersistence[DataType]) error {
+	if d.ordering == 0 && !d.compress && d.cipher == nil {
+		return nil
+	}
+	marker := utils.Ternary(d.compress, compressedMarker, orderMarker)
+	if d.cipher != nil {
+		marker = encryptedMarker
+	}
+	for _, v := range [][2]int64{{0, marker}, {fingerprintOffset, int64(d.ordering)}} {
+		b, err := encode(v[1])
+		if err == nil {
+			_, err = d.saveBytes(b, v[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orderingError tells whether the tree written with the found fingerprint has another layout
+// or another ordering than the configured ones
+func (d *DataFileBtreePersistence[DataType]) orderingError(tree string, found uint64) error {
+	layouts := map[bool]string{false: "classic", true: "B+"}
+	counts := map[bool]string{false: "without", true: "with"}
+	for _, bplus := range []bool{d.bplus, !d.bplus} {
+		for _, counted := range []bool{d.counted, !d.counted} {
+			if found != fingerprint(d.orderingName, bplus, counted) {
+				continue
+			}
+			if bplus != d.bplus {
+				return fmt.Errorf("%w: %s was written with the %s layout, but the %s one was given", constants.ErrLayout, tree, layouts[bplus], layouts[d.bplus])
+			}
+			return fmt.Errorf("%w: %s was written %s subtree counts, but they were configured %s them", constants.ErrLayout, tree, counts[counted], counts[d.counted])
+		}
+	}
+	return fmt.Errorf("%w: %s was written with ordering %x, but %x was given", constants.ErrOrdering, tree, found, d.ordering)
+}
+
+// fingerprint identifies an ordering by its name, along with the B+ layout and the subtree
+// counts, which are recorded as part of the ordering. 0 is the default ordering of the classic
+// layout without counts
+func fingerprint(ordering string, bplus bool, counted bool) uint64 {
+	if ordering == "" && !bplus && !counted {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(ordering))
+	if bplus {
+		h.Write([]byte("\x00bplus"))
+	}
+	if counted {
+		h.Write([]byte("\x00counts"))
+	}
+	return max(h.Sum64(), 1)
+}
+
+// headerFor places the header fields of a compressed file like the ones of an ordered file,
+// while its pages are numbered as in an uncompressed file with the same ordering, so they
+// keep their offsets when copied into one. Encrypted files have a header of their own
+func headerFor(fingerprint uint64, compressed bool, encrypted bool) headerLayout {
+	if encrypted {
+		return encryptedHeader
+	}
+	layout := layoutFor(fingerprint)
+	if compressed {
+		layout.root, layout.size = orderedHeader.root, orderedHeader.size
+	}
+	return layout
+}
+
+func layoutFor(fingerprint uint64) headerLayout {
+	if fingerprint == 0 {
+		return plainHeader
+	}
+	return orderedHeader
+}
+
+// openRegistered opens a data file of its own, locking it as configured
+func openRegistered[DataType any](config *interfaces.PersistenceConfig[DataType]) (*os.File, string, error) {
+	fd, err := openFile(config.Path, config.ReadOnly)
+	if err != nil {
+		return nil, "", err
+	}
+	key, err := registerOpenFile(config.Path, config.Exclusive, config.ReadOnly)
+	if err != nil {
+		fd.Close()
+		return nil, "", err
+	}
+	return fd, key, nil
+}
+
+func openFile(path string, readOnly bool) (*os.File, error) {
+	if readOnly {
+		return os.Open(path)
+	}
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+}
+
+// loadCounts restores the number of items under each child, saved after the page
+func (d *DataFileBtreePersistence[DataType]) loadCounts(p interfaces.Page[DataType], sp *SerializedPage, b []byte) {
+	var counts []int64
+	utils.PanicOnError(func() error { return decode(b, &counts) })
+	byOffset := map[int64]int64{}
+	for i, c := range sp.Children {
+		if c > 0 && i < len(counts) {
+			byOffset[c] = counts[i]
+		}
+	}
+	for i, offset := range p.Children().Offsets() {
+		if count, found := byOffset[offset]; found {
+			p.Children().Count(i, count)
 		}
 	}
-	return file
 }
@@ -0,0 +1,173 @@
+package persistence
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+
+	"github.com/mylux/bsistent/constants"
+)
+
+// encrypted files start with encryptedMarker, followed by the fingerprint of their ordering,
+// the root reference and the size, which are left readable. Then come the write counter
+// reserved so far and the key check, a tag that only the key of the file produces
+const (
+	encryptedMarker int64 = -4
+	counterOffset   int64 = 32
+	checkOffset     int64 = 40
+	checkSize       int64 = 16
+	counterSize     int64 = 8
+	// reservedWrites are the counter values taken at once, so the counter is saved to the
+	// header once every reservedWrites page writes
+	reservedWrites int64 = 1024
+)
+
+var encryptedHeader = headerLayout{root: 16, size: 24, data: checkOffset + checkSize}
+
+// pageCipher seals each page written to an encrypted file with AES-GCM. A page is stored
+// as the write counter used to seal it followed by the sealed bytes, and its nonce is made of
+// the counter and its offset, which also authenticates it, so a page cannot be moved
+// elsewhere in the file
+type pageCipher struct {
+	sync.Mutex
+	aead     cipher.AEAD
+	fd       *os.File
+	next     int64
+	reserved int64
+}
+
+// newPageCipher makes the cipher of an encrypted file with the given AES key
+func newPageCipher(key []byte, fd *os.File) (*pageCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &pageCipher{aead: aead, fd: fd}, nil
+}
+
+// overhead is the number of bytes an encrypted page takes besides its content
+func (c *pageCipher) overhead() int64 {
+	return counterSize + int64(c.aead.Overhead())
+}
+
+// load checks the key against the one the file was written with and restores the write
+// counter, starting the header of a new file
+func (c *pageCipher) load(started bool, readOnly bool) error {
+	if !started {
+		if readOnly {
+			return nil
+		}
+		return c.start()
+	}
+	b := make([]byte, counterSize+checkSize)
+	if _, err := c.fd.ReadAt(b, counterOffset); err != nil {
+		return err
+	}
+	if _, err := c.aead.Open(nil, c.nonce(0, 0), b[counterSize:], nil); err != nil {
+		return constants.ErrEncryption
+	}
+	// the writes before the file was closed took counters below the reserved one
+	c.next = int64(binary.LittleEndian.Uint64(b))
+	c.reserved = c.next
+	return nil
+}
+
+// start writes the key check of a new or reset file. Its counter starts at a random point,
+// so the pages of a file reset with the same key are never sealed with the nonces of the
+// pages it held before
+func (c *pageCipher) start() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.next == 0 {
+		start, err := randomCounter()
+		if err != nil {
+			return err
+		}
+		c.next = start
+	}
+	if _, err := c.fd.WriteAt(c.aead.Seal(nil, c.nonce(0, 0), nil, nil), checkOffset); err != nil {
+		return err
+	}
+	return c.reserve()
+}
+
+// reserve saves the counter after the next reservedWrites ones to the header. It is flushed
+// before any of them is used, so a crash never leaves pages sealed with counters that the file
+// reopens below
+func (c *pageCipher) reserve() error {
+	reserved := c.next + reservedWrites
+	if _, err := c.fd.WriteAt(binary.LittleEndian.AppendUint64(nil, uint64(reserved)), counterOffset); err != nil {
+		return err
+	}
+	if err := c.fd.Sync(); err != nil {
+		return err
+	}
+	c.reserved = reserved
+	return nil
+}
+
+// seal encrypts the bytes of the page at the given offset
+func (c *pageCipher) seal(offset int64, b []byte) ([]byte, error) {
+	c.Lock()
+	if c.next >= c.reserved {
+		if err := c.reserve(); err != nil {
+			c.Unlock()
+			return nil, err
+		}
+	}
+	counter := c.next
+	c.next++
+	c.Unlock()
+	sealed := binary.LittleEndian.AppendUint64(make([]byte, 0, int64(len(b))+c.overhead()), uint64(counter))
+	return c.aead.Seal(sealed, c.nonce(counter, offset), b, c.additionalData(offset)), nil
+}
+
+// open decrypts the bytes of the page at the given offset, failing when they were not sealed
+// there with the key of the file
+func (c *pageCipher) open(offset int64, b []byte) ([]byte, error) {
+	counter := int64(binary.LittleEndian.Uint64(b))
+	plain, err := c.aead.Open(nil, c.nonce(counter, offset), b[counterSize:], c.additionalData(offset))
+	if err != nil {
+		return nil, fmt.Errorf("%w: the page at offset %d failed authentication", constants.ErrEncryption, offset)
+	}
+	return plain, nil
+}
+
+// nonce is made of the write counter and the low bytes of the offset of the page. The
+// counter alone never repeats within a file, the offset is only there to spread the nonces
+func (c *pageCipher) nonce(counter int64, offset int64) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.LittleEndian.PutUint64(nonce, uint64(counter))
+	binary.LittleEndian.PutUint32(nonce[counterSize:], uint32(offset))
+	return nonce
+}
+
+func (c *pageCipher) additionalData(offset int64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(offset))
+}
+
+// randomCounter picks where the write counter of a new file starts, so the counters of two
+// files sealed with the same key are unlikely to ever meet
+func randomCounter() (int64, error) {
+	start, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return 0, err
+	}
+	return start.Int64() + 1, nil
+}
+
+// readKeyCheck returns the key check of an encrypted file, which its backups carry along
+func readKeyCheck(fd *os.File) ([checkSize]byte, error) {
+	var check [checkSize]byte
+	_, err := fd.ReadAt(check[:], checkOffset)
+	return check, err
+}
@@ -0,0 +1,61 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+)
+
+// the journal of a database file holds the writes of the transaction being committed, each as
+// its offset, its length and its bytes, followed by their number and the fnv64a hash of all
+// the rest. A journal cut short does not match its hash, and its transaction never committed
+const journalTrailer int64 = 16
+
+func journalPath(path string) string {
+	return path + ".journal"
+}
+
+// encodeJournal lays out the writes of a batch, the pages before the header fields
+func encodeJournal(batch *writeBatch) []byte {
+	var b []byte
+	var count uint64
+	for _, writes := range []map[int64][]byte{batch.pages, batch.header} {
+		for offset, data := range writes {
+			b = binary.LittleEndian.AppendUint64(b, uint64(offset))
+			b = binary.LittleEndian.AppendUint64(b, uint64(len(data)))
+			b = append(b, data...)
+			count++
+		}
+	}
+	b = binary.LittleEndian.AppendUint64(b, count)
+	h := fnv.New64a()
+	h.Write(b)
+	return binary.LittleEndian.AppendUint64(b, h.Sum64())
+}
+
+// decodeJournal returns the writes of a complete journal, or nil when it is empty or was cut
+// short. The header fields are returned as pages, since the journal is written as a whole
+func decodeJournal(b []byte) *writeBatch {
+	if int64(len(b)) < journalTrailer {
+		return nil
+	}
+	body := b[:len(b)-8]
+	h := fnv.New64a()
+	h.Write(body)
+	if h.Sum64() != binary.LittleEndian.Uint64(b[len(b)-8:]) {
+		return nil
+	}
+	count := binary.LittleEndian.Uint64(body[len(body)-8:])
+	entries := body[:len(body)-8]
+	batch := newWriteBatch()
+	for range count {
+		if len(entries) < 16 {
+			return nil
+		}
+		offset, length := int64(binary.LittleEndian.Uint64(entries)), binary.LittleEndian.Uint64(entries[8:])
+		if entries = entries[16:]; uint64(len(entries)) < length {
+			return nil
+		}
+		batch.pages[offset], entries = entries[:length], entries[length:]
+	}
+	return batch
+}
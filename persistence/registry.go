@@ -0,0 +1,74 @@
+package persistence
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/mylux/bsistent/constants"
+)
+
+type openFileEntry struct {
+	count     int
+	exclusive bool
+	shared    bool
+	lock      *os.File
+}
+
+var openFiles = struct {
+	sync.Mutex
+	entries map[string]*openFileEntry
+}{entries: map[string]*openFileEntry{}}
+
+// registerOpenFile keeps track of the data files open in this process. An exclusive
+// registration fails if the file is already open and prevents any other until it is released.
+// The first registration of a file also locks it against other processes: read-only ones share
+// the lock, writers hold it exclusively, upgrading a shared lock if this process already has one
+func registerOpenFile(path string, exclusive bool, readOnly bool) (string, error) {
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(key); err == nil {
+		key = resolved
+	}
+	openFiles.Lock()
+	defer openFiles.Unlock()
+	entry := openFiles.entries[key]
+	if entry != nil && (exclusive || entry.exclusive) {
+		return "", constants.ErrAlreadyOpen
+	}
+	if entry == nil {
+		lock, err := os.Open(key)
+		if err != nil {
+			return "", err
+		}
+		if err = lockFile(lock, readOnly); err != nil {
+			lock.Close()
+			return "", err
+		}
+		entry = &openFileEntry{exclusive: exclusive, shared: readOnly, lock: lock}
+		openFiles.entries[key] = entry
+	} else if entry.shared && !readOnly {
+		if err = lockFile(entry.lock, false); err != nil {
+			// flock conversions are not atomic, so the shared lock may have been dropped
+			lockFile(entry.lock, true)
+			return "", err
+		}
+		entry.shared = false
+	}
+	entry.count++
+	return key, nil
+}
+
+func unregisterOpenFile(key string) {
+	openFiles.Lock()
+	defer openFiles.Unlock()
+	if entry := openFiles.entries[key]; entry != nil {
+		if entry.count--; entry.count == 0 {
+			unlockFile(entry.lock)
+			entry.lock.Close()
+			delete(openFiles.entries, key)
+		}
+	}
+}
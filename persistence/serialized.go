@@ -15,12 +15,25 @@ type SerializedItem struct {
 	Content []byte
 }
 
+// SerializedPage is a page as it is stored. Next and Prev link the leaves of the B+ layout, and
+// are only stored in its pages
 type SerializedPage struct {
 	Offset   int64
 	Capacity int64
 	Items    []SerializedItem
 	Parent   int64
 	Children []int64
+	Next     int64
+	Prev     int64
+}
+
+// classicPage is a page of the classic layout as it is stored, without the leaf links
+type classicPage struct {
+	Offset   int64
+	Capacity int64
+	Items    []SerializedItem
+	Parent   int64
+	Children []int64
 }
 
 var serializer *serialization.Serializer = &serialization.Serializer{}
@@ -47,7 +60,7 @@ func generateZeroItem(size int64) *SerializedItem {
 	}
 }
 
-func generateEncodedZeroPage(capacity int, itemValueSize int64) ([]byte, error) {
+func generateEncodedZeroPage(capacity int, itemValueSize int64, linked bool) ([]byte, error) {
 	encodedItems := make([]SerializedItem, capacity)
 	for i := range capacity {
 		encodedItems[i] = SerializedItem{
@@ -62,10 +75,10 @@ func generateEncodedZeroPage(capacity int, itemValueSize int64) ([]byte, error)
 		Parent:   1,
 		Items:    encodedItems,
 		Children: make([]int64, capacity+1),
-	})
+	}, linked)
 }
 
-func serializePage[T any](p interfaces.Page[T]) ([]byte, error) {
+func serializePage[T any](p interfaces.Page[T], linked bool) ([]byte, error) {
 	var err error
 	var pit *SerializedItem
 	items := make([]SerializedItem, p.Capacity())
@@ -90,17 +103,36 @@ func serializePage[T any](p interfaces.Page[T]) ([]byte, error) {
 		Capacity: int64(p.Capacity()),
 		Items:    items,
 		Children: sChildren,
-	})
+		Next:     p.Next(),
+		Prev:     p.Prev(),
+	}, linked)
+}
+
+// serializeCounts appends the number of items under each child of the page to its bytes
+func serializeCounts[T any](p interfaces.Page[T], b []byte) ([]byte, error) {
+	counts := make([]int64, p.Capacity()+1)
+	for i := range p.Children().Size() {
+		counts[i] = p.Children().Count(i)
+	}
+	return encode(counts, bytes.NewBuffer(b))
 }
 
-func encodePage(sp *SerializedPage) ([]byte, error) {
-	return encode(*sp)
+func encodePage(sp *SerializedPage, linked bool) ([]byte, error) {
+	if linked {
+		return encode(*sp)
+	}
+	return encode(classicPage{Offset: sp.Offset, Capacity: sp.Capacity, Items: sp.Items, Parent: sp.Parent, Children: sp.Children})
 }
 
-func hydratePage(data []byte) (*SerializedPage, error) {
+func hydratePage(data []byte, linked bool) (*SerializedPage, error) {
 	var p SerializedPage
-	err := decode(data, &p)
-	return &p, err
+	if linked {
+		err := decode(data, &p)
+		return &p, err
+	}
+	var c classicPage
+	err := decode(data, &c)
+	return &SerializedPage{Offset: c.Offset, Capacity: c.Capacity, Items: c.Items, Parent: c.Parent, Children: c.Children}, err
 }
 
 func decode(r []byte, s any) error {
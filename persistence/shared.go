@@ -0,0 +1,349 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/mylux/bsistent/cache"
+	"github.com/mylux/bsistent/constants"
+	"github.com/mylux/bsistent/interfaces"
+)
+
+// database files start with dbMarker, which no root reference can take, followed by the header
+// of the catalog of their trees
+const (
+	dbMarker      int64 = -2
+	catalogHeader int64 = 8
+	// sharedHeaderSize holds the page size, the fingerprint of the ordering, the root reference
+	// and the size of a tree in a database file
+	sharedHeaderSize int64 = 32
+)
+
+// SharedFile is a database file, where each tree has its own header and the pages of all of
+// them are appended to the end of the file as they are allocated
+type SharedFile struct {
+	sync.Mutex
+	path        string
+	registryKey string
+	fd          *os.File
+	end         int64
+	open        map[int64]bool
+	pages       *cache.Pool
+	// pending keeps the bytes of the transaction in progress, which are written to the journal
+	// and then to the file when it commits. A read-only database keeps in it the ones of a
+	// transaction it finds in the journal, since it cannot write them
+	pending *writeBatch
+	// began is the end of the file when the transaction in progress began
+	began   int64
+	journal *os.File
+	// failed tells why the file could not be written after the journal was, so no other change
+	// is written before the journal is written again, when the database is opened
+	failed error
+}
+
+// OpenShared opens a database file, starting it when it is empty. The cache of its pages keeps
+// up to the given number of them for all the trees
+func OpenShared(path string, readOnly bool, cacheSize uint32) (*SharedFile, error) {
+	fd, err := openFile(path, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	key, err := registerOpenFile(path, true, readOnly)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	s := &SharedFile{path: path, registryKey: key, fd: fd, open: map[int64]bool{}, pages: cache.NewPool(cacheSize)}
+	if err = s.recover(readOnly); err == nil {
+		err = s.start(readOnly)
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Acquire marks the tree with the given header as open, failing if it already is
+func (s *SharedFile) Acquire(header int64) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.open[header] {
+		return constants.ErrAlreadyOpen
+	}
+	s.open[header] = true
+	return nil
+}
+
+// Allocate reserves the given number of bytes at the end of the file
+func (s *SharedFile) Allocate(size int64) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	offset := s.end
+	if _, err := s.fd.WriteAt(make([]byte, size), offset); err != nil {
+		return -1, err
+	}
+	s.end += size
+	return offset, nil
+}
+
+// Begin starts a transaction, keeping the bytes written from then on until it commits
+func (s *SharedFile) Begin() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.failed != nil {
+		return s.failed
+	}
+	if s.pending != nil {
+		return fmt.Errorf("a transaction is already in progress on %s", s.path)
+	}
+	s.pending, s.began = newWriteBatch(), s.end
+	return nil
+}
+
+// Catalog returns the header of the tree listing the others
+func (s *SharedFile) Catalog() int64 {
+	return catalogHeader
+}
+
+func (s *SharedFile) Close() error {
+	defer unregisterOpenFile(s.registryKey)
+	if s.journal != nil {
+		s.journal.Close()
+	}
+	if err := s.Sync(); err != nil {
+		s.fd.Close()
+		return err
+	}
+	return s.fd.Close()
+}
+
+// Commit writes the bytes of the transaction to the journal, and then to the file. The
+// transaction holds once the journal is flushed: when the file cannot be written afterwards,
+// its bytes are still read from memory, and the journal is written when the database is opened
+func (s *SharedFile) Commit() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.pending == nil {
+		return fmt.Errorf("no transaction is in progress on %s", s.path)
+	}
+	if len(s.pending.pages)+len(s.pending.header) > 0 {
+		if err := s.journal.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := s.journal.WriteAt(encodeJournal(s.pending), 0); err != nil {
+			return err
+		}
+		if err := s.journal.Sync(); err != nil {
+			return err
+		}
+		if err := s.apply(s.pending); err != nil {
+			s.failed = fmt.Errorf("%s was left with its journal to be written: %w", s.path, err)
+			return s.failed
+		}
+	}
+	s.pending = nil
+	return nil
+}
+
+func (s *SharedFile) File() *os.File {
+	return s.fd
+}
+
+// Lookup returns the bytes the transaction in progress wrote at the given offset
+func (s *SharedFile) Lookup(offset int64, size int64) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if s.pending == nil {
+		return nil, false
+	}
+	b, found := s.pending.lookup(offset)
+	return b, found && int64(len(b)) == size
+}
+
+// NewHeader reserves the header of a new tree
+func (s *SharedFile) NewHeader() (int64, error) {
+	return s.Allocate(sharedHeaderSize)
+}
+
+// Pages returns the cache the trees of the database keep their pages in
+func (s *SharedFile) Pages() interfaces.PageCache {
+	return s.pages
+}
+
+func (s *SharedFile) Release(header int64) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.open, header)
+}
+
+// Rollback drops the bytes of the transaction in progress, and gives back the space it
+// allocated. A transaction committed to the journal already is kept, and its failure returned
+func (s *SharedFile) Rollback() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.failed != nil || s.pending == nil {
+		return s.failed
+	}
+	s.pending = nil
+	if s.end > s.began && s.fd.Truncate(s.began) == nil {
+		s.end = s.began
+	}
+	return nil
+}
+
+func (s *SharedFile) Sync() error {
+	return s.fd.Sync()
+}
+
+// Write writes the bytes at the given offset, or keeps them along with the transaction in
+// progress. The header fields of a transaction are written after its pages
+func (s *SharedFile) Write(b []byte, offset int64, header bool) error {
+	s.Lock()
+	defer s.Unlock()
+	switch {
+	case s.failed != nil:
+		return s.failed
+	case s.pending == nil:
+		_, err := s.fd.WriteAt(b, offset)
+		return err
+	case header:
+		s.pending.header[offset] = b
+	default:
+		s.pending.pages[offset] = b
+	}
+	return nil
+}
+
+// recover writes the transaction held by the journal, which committed before the database was
+// last closed but was not written to the file. A read-only database reads it from memory instead
+func (s *SharedFile) recover(readOnly bool) error {
+	data, err := os.ReadFile(journalPath(s.path))
+	if readOnly {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		s.pending = decodeJournal(data)
+		return err
+	}
+	if s.journal, err = os.OpenFile(journalPath(s.path), os.O_RDWR|os.O_CREATE, 0666); err != nil {
+		return err
+	}
+	if batch := decodeJournal(data); batch != nil {
+		return s.apply(batch)
+	}
+	if len(data) > 0 {
+		return s.clearJournal()
+	}
+	return nil
+}
+
+// apply writes the bytes of a transaction written to the journal, and then empties the journal
+func (s *SharedFile) apply(batch *writeBatch) error {
+	if err := batch.write(s.fd); err != nil {
+		return err
+	}
+	if err := s.fd.Sync(); err != nil {
+		return err
+	}
+	return s.clearJournal()
+}
+
+func (s *SharedFile) clearJournal() error {
+	if err := s.journal.Truncate(0); err != nil {
+		return err
+	}
+	return s.journal.Sync()
+}
+
+func (s *SharedFile) start(readOnly bool) error {
+	st, err := s.fd.Stat()
+	if err != nil {
+		return err
+	}
+	s.end = st.Size()
+	if s.end == 0 && !readOnly {
+		marker, err := encode(dbMarker)
+		if err != nil {
+			return err
+		}
+		if _, err = s.fd.WriteAt(append(marker, make([]byte, sharedHeaderSize)...), 0); err != nil {
+			return err
+		}
+		s.end = catalogHeader + sharedHeaderSize
+		return nil
+	}
+	var marker int64
+	if s.end >= catalogHeader+sharedHeaderSize {
+		b := make([]byte, catalogHeader)
+		if _, err = s.fd.ReadAt(b, 0); err != nil {
+			return err
+		}
+		err = decode(b, &marker)
+	}
+	if err == nil && marker != dbMarker {
+		err = fmt.Errorf("%s is not a database file", s.path)
+	}
+	return err
+}
+
+// loadSharedHeader points the header of a tree at its place in a database file, making sure
+// the tree was written with the same page size and ordering unless it is about to be reset
+func loadSharedHeader[DataType any](d *DataFileBtreePersistence[DataType], header int64) error {
+	d.header = headerLayout{root: header + 16, size: header + 24, data: header + sharedHeaderSize}
+	pageSize, err := d.readHeaderField(header)
+	if err != nil {
+		return err
+	}
+	ordering, err := d.readHeaderField(header + 8)
+	if err != nil {
+		return err
+	}
+	root, err := d.readHeaderField(d.header.root)
+	if err != nil {
+		return err
+	}
+	if root != 0 && !d.resetting {
+		if pageSize != d.pageSize {
+			return fmt.Errorf("the tree was written with pages of %d bytes, but they take %d bytes with this configuration", pageSize, d.pageSize)
+		}
+		if uint64(ordering) != d.ordering {
+			return d.orderingError("the tree", uint64(ordering))
+		}
+	}
+	if d.readOnly {
+		return nil
+	}
+	for _, v := range [][2]int64{{header, d.pageSize}, {header + 8, int64(d.ordering)}} {
+		b, err := encode(v[1])
+		if err == nil {
+			err = d.saveHeaderField(b, v[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Begin keeps the state of the copy-on-write versions, which the tree goes back to should the
+// transaction be rolled back
+func (d *DataFileBtreePersistence[DataType]) Begin() {
+	if d.versions != nil {
+		d.beforeTransaction = d.versions.save()
+	}
+}
+
+// Rollback drops the pages of the tree kept in memory, and reads the root reference again as
+// the file holds it, once the transaction was rolled back
+func (d *DataFileBtreePersistence[DataType]) Rollback() error {
+	if d.beforeTransaction != nil {
+		d.versions.restore(d.beforeTransaction)
+		d.beforeTransaction = nil
+	}
+	d.cache.Release()
+	_, err := d.LoadReference()
+	return err
+}
@@ -0,0 +1,188 @@
+package persistence
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mylux/bsistent/interfaces"
+)
+
+// writeBatch holds the bytes saved to a data file and not written yet, by offset. The header
+// fields are written after the pages, so the header never refers to pages that were not written
+type writeBatch struct {
+	pages  map[int64][]byte
+	header map[int64][]byte
+}
+
+func newWriteBatch() *writeBatch {
+	return &writeBatch{pages: map[int64][]byte{}, header: map[int64][]byte{}}
+}
+
+func (w *writeBatch) lookup(offset int64) ([]byte, bool) {
+	if b, found := w.pages[offset]; found {
+		return b, true
+	}
+	b, found := w.header[offset]
+	return b, found
+}
+
+func (w *writeBatch) write(fd *os.File) error {
+	for _, writes := range []map[int64][]byte{w.pages, w.header} {
+		for offset, b := range writes {
+			if _, err := fd.WriteAt(b, offset); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeBehind keeps the pages saved to a data file until a background goroutine writes them,
+// once enough of them wait or at every interval. Reads look for the bytes waiting to be written
+// before the ones in the file, and the changes wait for a flush when too many pages do
+type writeBehind struct {
+	sync.Mutex
+	fd       *os.File
+	options  interfaces.WriteBehind
+	pending  *writeBatch
+	flushing *writeBatch
+	end      int64
+	err      error
+	room     *sync.Cond
+	// flushes makes the flushes run one at a time
+	flushes sync.Mutex
+	wake    chan struct{}
+	stop    chan struct{}
+	done    sync.WaitGroup
+}
+
+// startWriteBehind starts the goroutine writing the pages of the data file in the background
+func startWriteBehind(fd *os.File, options interfaces.WriteBehind) *writeBehind {
+	w := &writeBehind{
+		fd:      fd,
+		options: options,
+		pending: newWriteBatch(),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	w.room = sync.NewCond(&w.Mutex)
+	ticker := time.NewTicker(options.FlushInterval)
+	w.done.Add(1)
+	go func() {
+		defer w.done.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.wake:
+			case <-ticker.C:
+			case <-w.stop:
+				return
+			}
+			w.flush()
+		}
+	}()
+	return w
+}
+
+// save keeps the bytes to be written at the given offset, waiting for a flush when too many
+// pages are waiting already
+func (w *writeBehind) save(b []byte, offset int64, header bool) error {
+	w.Lock()
+	defer w.Unlock()
+	for !header && w.err == nil && w.dirtyPages() >= w.options.MaxDirtyPages {
+		w.wakeUp()
+		w.room.Wait()
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if header {
+		w.pending.header[offset] = b
+	} else {
+		w.pending.pages[offset] = b
+	}
+	w.end = max(w.end, offset+int64(len(b)))
+	if len(w.pending.pages) >= w.options.FlushPages {
+		w.wakeUp()
+	}
+	return nil
+}
+
+// lookup returns the bytes waiting to be written at the given offset
+func (w *writeBehind) lookup(offset int64, size int64) ([]byte, bool) {
+	w.Lock()
+	defer w.Unlock()
+	for _, batch := range []*writeBatch{w.pending, w.flushing} {
+		if batch == nil {
+			continue
+		}
+		if b, found := batch.lookup(offset); found && int64(len(b)) == size {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// flush writes the pages waiting to be written, and then their header fields
+func (w *writeBehind) flush() error {
+	w.flushes.Lock()
+	defer w.flushes.Unlock()
+	w.Lock()
+	if w.err != nil {
+		w.Unlock()
+		return w.err
+	}
+	batch := w.pending
+	w.pending, w.flushing = newWriteBatch(), batch
+	w.Unlock()
+	err := batch.write(w.fd)
+	w.Lock()
+	defer w.Unlock()
+	w.flushing = nil
+	if err != nil {
+		// the pages of the batch are lost, so every later change fails
+		w.err = err
+	}
+	w.room.Broadcast()
+	return err
+}
+
+// discard drops the bytes waiting to be written, when the data file is reset
+func (w *writeBehind) discard() {
+	w.flushes.Lock()
+	defer w.flushes.Unlock()
+	w.Lock()
+	defer w.Unlock()
+	w.pending, w.end = newWriteBatch(), 0
+	w.room.Broadcast()
+}
+
+// close flushes the pages waiting to be written and stops the background goroutine
+func (w *writeBehind) close() error {
+	close(w.stop)
+	w.done.Wait()
+	return w.flush()
+}
+
+// size returns the size the data file will have once the waiting pages are written
+func (w *writeBehind) size(diskSize int64) int64 {
+	w.Lock()
+	defer w.Unlock()
+	return max(diskSize, w.end)
+}
+
+func (w *writeBehind) dirtyPages() int {
+	n := len(w.pending.pages)
+	if w.flushing != nil {
+		n += len(w.flushing.pages)
+	}
+	return n
+}
+
+func (w *writeBehind) wakeUp() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
@@ -69,6 +69,26 @@ func GetTaggedFieldValues(v any, tagName, tagKey string, pTagValue ...string) []
 	return r
 }
 
+func KeepTaggedFields[T any](v T, tagName, tagKey string) T {
+	val := reflect.ValueOf(v)
+	if val.Kind() != reflect.Struct {
+		return v
+	}
+	typ := val.Type()
+	r := reflect.New(typ).Elem()
+	kept := false
+	for i := 0; i < val.NumField(); i++ {
+		if found, _ := GetFieldTagKey(typ.Field(i), tagName, tagKey); found && r.Field(i).CanSet() {
+			r.Field(i).Set(val.Field(i))
+			kept = true
+		}
+	}
+	if !kept {
+		return v
+	}
+	return r.Interface().(T)
+}
+
 func GetFieldTagKey(field reflect.StructField, tagName string, tagKey string) (bool, string) {
 	if tagParts := strings.Split(field.Tag.Get(tagName), ";"); len(tagParts) > 0 {
 		for _, part := range tagParts {